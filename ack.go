@@ -0,0 +1,316 @@
+package numberserver
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
+)
+
+// Handshake lines (sent by the client as its first line) opting in
+// to the acknowledgement protocol, replied per line or per batch
+const (
+	ACK_HANDSHAKE       = "ack"
+	ACK_BATCH_HANDSHAKE = "ack batch"
+)
+
+// Max time spent writing acknowledgements to a client before giving up
+const ACK_WRITE_TIMEOUT = 10 * time.Second
+
+// Returned for the new numbers that couldn't be logged before shutting down
+var errNotLogged = errors.New("the server shut down before logging it")
+
+// Outcome of a line, as acknowledged to the client
+type AckStatus int
+
+const (
+	// Unique number, flushed into the log file
+	AckNew AckStatus = iota
+	// Number already received, by this connection or another one. Its
+	// first copy may not be flushed yet: if it's lost, the number is
+	// forgotten, so it's only known to be logged once acknowledged as new
+	AckDuplicate
+	// Invalid line (see InputError)
+	AckRejected
+	// Unique number that couldn't be logged (it's forgotten, so a retry
+	// is acknowledged as new)
+	AckLost
+	// Replies to a query (see QUERY_PREFIX): the number was or wasn't seen
+	AckSeen
+	AckUnseen
+)
+
+func (s AckStatus) String() string {
+	switch s {
+	case AckDuplicate:
+		return "DUP"
+	case AckRejected:
+		return "ERR"
+	case AckLost:
+		return "LOST"
+	case AckSeen:
+		return "SEEN"
+	case AckUnseen:
+		return "UNSEEN"
+	}
+	return "NEW"
+}
+
+// How a connection is acknowledged
+type ackMode int
+
+const (
+	ackNone ackMode = iota
+	ackPerLine
+	ackPerBatch
+)
+
+// Whether the line is a handshake, and the mode it asks for
+func parseHandshake(line string) (ackMode, bool) {
+	switch line {
+	case ACK_HANDSHAKE:
+		return ackPerLine, true
+	case ACK_BATCH_HANDSHAKE:
+		return ackPerBatch, true
+	}
+	return ackNone, false
+}
+
+// A line waiting to be acknowledged
+type ackEntry struct {
+	status AckStatus
+	input  string
+	// Rejection reason (see errorLine)
+	err   error
+	ready bool
+}
+
+// Replies the acknowledgements of a connection in the same order its
+// lines were read, from its own routine. New numbers are acknowledged
+// only once the logger flushed them (see OnFlushed).
+// It owns the connection: it's closed once every line is acknowledged
+//
+// Replies, per line:
+//
+//	NEW <input> | DUP <input> | LOST <input> | ERR <code> <reason> <quoted input>
+//
+// or per batch (the lines acknowledged at once, in order):
+//
+//	ACK <lines> new=<n> dup=<n> err=<n> lost=<n>
+//
+// Queries are always replied on their own line (SEEN <input> | UNSEEN <input>)
+type connAcker struct {
+	sync.Mutex
+	conn      net.Conn
+	mode      ackMode
+	handshake string
+	pending   []ackEntry
+	// Absolute position of pending[0], and of the new numbers not flushed yet
+	head      int64
+	unflushed []int64
+	// No more lines are coming (see finish)
+	finished bool
+	wake     chan struct{}
+	done     chan struct{}
+}
+
+func newConnAcker(conn net.Conn, mode ackMode, handshake string) *connAcker {
+	return &connAcker{
+		conn:      conn,
+		mode:      mode,
+		handshake: handshake,
+		wake:      make(chan struct{}, 1),
+		done:      make(chan struct{}),
+	}
+}
+
+// Queues the acknowledgement of a line. New numbers wait for settle
+func (a *connAcker) add(status AckStatus, input string, err error) {
+	a.Lock()
+	defer a.Unlock()
+	if status == AckNew {
+		a.unflushed = append(a.unflushed, a.head+int64(len(a.pending)))
+	}
+	a.pending = append(a.pending, ackEntry{status: status, input: input, err: err, ready: status != AckNew})
+	a.signal()
+}
+
+// Settles the oldest new number not flushed yet: it was flushed
+// (or lost, if err isn't nil)
+func (a *connAcker) settle(err error) {
+	a.Lock()
+	defer a.Unlock()
+	if len(a.unflushed) == 0 {
+		return
+	}
+	entry := &a.pending[a.unflushed[0]-a.head]
+	a.unflushed = a.unflushed[1:]
+	entry.ready = true
+	if err != nil {
+		entry.status = AckLost
+	}
+	a.signal()
+}
+
+// Settles every new number not flushed yet as lost
+func (a *connAcker) abort() {
+	a.Lock()
+	unflushed := len(a.unflushed)
+	a.Unlock()
+	for i := 0; i < unflushed; i++ {
+		a.settle(errNotLogged)
+	}
+}
+
+// No more lines will be added: the connection is closed
+// once the pending ones are acknowledged
+func (a *connAcker) finish() {
+	a.Lock()
+	defer a.Unlock()
+	a.finished = true
+	a.signal()
+}
+
+// Must be called holding the lock
+func (a *connAcker) signal() {
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Writes the acknowledgements as they get ready, until finished
+func (a *connAcker) run() {
+	defer close(a.done)
+	defer a.conn.Close()
+	writer := bufio.NewWriter(a.conn)
+	// A client that isn't reading anymore doesn't stop the acknowledgements
+	// from being settled, they're just not written
+	failed := false
+	write := func(line string) {
+		if failed {
+			return
+		}
+		a.conn.SetWriteDeadline(time.Now().Add(ACK_WRITE_TIMEOUT))
+		writer.WriteString(line)
+		if err := writer.Flush(); err != nil {
+			failed = true
+		}
+	}
+	write("OK " + a.handshake + "\n")
+	for {
+		a.Lock()
+		ready := 0
+		for ready < len(a.pending) && a.pending[ready].ready {
+			ready++
+		}
+		entries := a.pending[:ready]
+		a.pending = a.pending[ready:]
+		a.head += int64(ready)
+		over := a.finished && len(a.pending) == 0
+		a.Unlock()
+		if len(entries) > 0 {
+			write(ackReplies(entries, a.mode))
+		}
+		if over {
+			return
+		}
+		if len(entries) == 0 {
+			<-a.wake
+		}
+	}
+}
+
+// Replies for the entries acknowledged at once
+func ackReplies(entries []ackEntry, mode ackMode) string {
+	var replies []byte
+	// Lines summarized in a batch, until a query's reply (or the end)
+	lines := 0
+	counts := make(map[AckStatus]int)
+	summarize := func() {
+		if lines > 0 {
+			replies = append(replies, fmt.Sprintf("ACK %d new=%d dup=%d err=%d lost=%d\n", lines,
+				counts[AckNew], counts[AckDuplicate], counts[AckRejected], counts[AckLost])...)
+		}
+		lines = 0
+		counts = make(map[AckStatus]int)
+	}
+	for _, entry := range entries {
+		query := entry.status == AckSeen || entry.status == AckUnseen
+		switch {
+		case mode == ackPerBatch && !query:
+			lines++
+			counts[entry.status]++
+			continue
+		case mode == ackPerBatch:
+			summarize()
+		}
+		if entry.status == AckRejected {
+			replies = append(replies, errorLine(entry.err)...)
+			continue
+		}
+		replies = append(replies, entry.status.String()+" "+entry.input+"\n"...)
+	}
+	summarize()
+	return string(replies)
+}
+
+// Routes the logger's flush notifications to the connections' ackers
+type ackRouter struct {
+	sync.Mutex
+	ackers map[uint64]*connAcker
+	// Running ackers
+	running sync.WaitGroup
+}
+
+func newAckRouter() *ackRouter {
+	return &ackRouter{ackers: make(map[uint64]*connAcker)}
+}
+
+// Starts acknowledging the connection's lines (see connAcker)
+func (r *ackRouter) start(connID uint64, conn net.Conn, mode ackMode, handshake string) *connAcker {
+	acker := newConnAcker(conn, mode, handshake)
+	r.Lock()
+	r.ackers[connID] = acker
+	r.Unlock()
+	r.running.Add(1)
+	go func() {
+		defer r.running.Done()
+		acker.run()
+		r.Lock()
+		delete(r.ackers, connID)
+		r.Unlock()
+	}()
+	return acker
+}
+
+// Flush hook of the logger (see OnFlushed). Records of connections
+// without acknowledgements are ignored
+func (r *ackRouter) flushed(records []logformat.Record, err error) {
+	r.Lock()
+	defer r.Unlock()
+	for _, record := range records {
+		if acker, ok := r.ackers[record.ConnID]; ok {
+			acker.settle(err)
+		}
+	}
+}
+
+// Settles whatever is left as lost, then waits for every acker to finish.
+// Must be called once no more numbers are logged
+func (r *ackRouter) close() {
+	r.Lock()
+	ackers := make([]*connAcker, 0, len(r.ackers))
+	for _, acker := range r.ackers {
+		ackers = append(ackers, acker)
+	}
+	r.Unlock()
+	for _, acker := range ackers {
+		acker.abort()
+	}
+	r.running.Wait()
+}
@@ -0,0 +1,140 @@
+package numberserver
+
+import (
+	"bufio"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type ackRepliesCase struct {
+	Name     string
+	Mode     ackMode
+	Entries  []ackEntry
+	Expected string
+}
+
+func TestAck(t *testing.T) {
+	rejected := &InputError{Code: ERR_WRONG_LENGTH, Reason: "wrong_length", Input: "12"}
+
+	t.Run("Parse Handshake", func(t *testing.T) {
+		mode, ok := parseHandshake("ack")
+		assert.True(t, ok)
+		assert.Equal(t, ackPerLine, mode)
+		mode, ok = parseHandshake("ack batch")
+		assert.True(t, ok)
+		assert.Equal(t, ackPerBatch, mode)
+		_, ok = parseHandshake("000000001")
+		assert.False(t, ok)
+	})
+
+	t.Run("Ack Replies", func(t *testing.T) {
+		entries := []ackEntry{
+			{status: AckNew, input: "000000001"},
+			{status: AckDuplicate, input: "000000001"},
+			{status: AckRejected, input: "12", err: rejected},
+			{status: AckLost, input: "000000002"},
+		}
+		testCases := []ackRepliesCase{
+			{
+				Name:     "Per line",
+				Mode:     ackPerLine,
+				Entries:  entries,
+				Expected: "NEW 000000001\nDUP 000000001\nERR 1 wrong_length \"12\"\nLOST 000000002\n",
+			},
+			{
+				Name:     "Per batch",
+				Mode:     ackPerBatch,
+				Entries:  entries,
+				Expected: "ACK 4 new=1 dup=1 err=1 lost=1\n",
+			},
+			{
+				Name: "Queries per line",
+				Mode: ackPerLine,
+				Entries: []ackEntry{
+					{status: AckSeen, input: "000000001"},
+					{status: AckUnseen, input: "000000002"},
+				},
+				Expected: "SEEN 000000001\nUNSEEN 000000002\n",
+			},
+			{
+				Name: "Queries per batch",
+				Mode: ackPerBatch,
+				Entries: []ackEntry{
+					{status: AckNew, input: "000000001"},
+					{status: AckSeen, input: "000000001"},
+					{status: AckDuplicate, input: "000000001"},
+					{status: AckNew, input: "000000002"},
+				},
+				Expected: "ACK 1 new=1 dup=0 err=0 lost=0\nSEEN 000000001\nACK 2 new=1 dup=1 err=0 lost=0\n",
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				assert.Equal(t, tc.Expected, ackReplies(tc.Entries, tc.Mode))
+			})
+		}
+	})
+
+	t.Run("Acknowledged in order", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer client.Close()
+		acker := newConnAcker(server, ackPerLine, "ack")
+		go acker.run()
+		reader := bufio.NewReader(client)
+		readLine := func() string {
+			client.SetReadDeadline(time.Now().Add(5 * time.Second))
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			return line
+		}
+		assert.Equal(t, "OK ack\n", readLine())
+		acker.add(AckNew, "000000001", nil)
+		acker.add(AckDuplicate, "000000003", nil)
+		acker.add(AckNew, "000000002", nil)
+		acker.add(AckRejected, "12", rejected)
+		// Nothing is replied until the first new number is flushed
+		acker.settle(nil)
+		assert.Equal(t, "NEW 000000001\n", readLine())
+		assert.Equal(t, "DUP 000000003\n", readLine())
+		acker.settle(errors.New("disk full"))
+		acker.finish()
+		assert.Equal(t, "LOST 000000002\n", readLine())
+		assert.Equal(t, "ERR 1 wrong_length \"12\"\n", readLine())
+		select {
+		case <-acker.done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The acker didn't finish")
+		}
+		_, err := reader.ReadString('\n')
+		assert.Error(t, err, "The connection should have been closed")
+	})
+
+	t.Run("Abort", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer client.Close()
+		router := newAckRouter()
+		acker := router.start(7, server, ackPerBatch, "ack batch")
+		acker.add(AckNew, "000000001", nil)
+		acker.add(AckNew, "000000002", nil)
+		acker.finish()
+		received := make(chan []string)
+		go func() {
+			var lines []string
+			scanner := bufio.NewScanner(client)
+			for scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			received <- lines
+		}()
+		// Records of other connections are ignored
+		router.flushed([]logformat.Record{{Number: 1, ConnID: 8}}, nil)
+		router.close()
+		assert.Equal(t, []string{"OK ack batch", "ACK 2 new=0 dup=0 err=0 lost=2"}, <-received)
+	})
+}
@@ -0,0 +1,211 @@
+package numberserver
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+)
+
+// Content type of Prometheus' text exposition format
+const PROMETHEUS_CONTENT_TYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Max size of a bulk lookup's body (see serveNumbers)
+const MAX_LOOKUP_BODY = 1 << 20
+
+// Routes of the admin HTTP API (see Config's AdminAddr):
+//
+//	/metrics      metrics in Prometheus' text format (see Metrics)
+//	/healthz      200 while the process is alive
+//	/readyz       200 while accepting numbers, 503 otherwise (see Ready)
+//	/stats        current statistics, as JSON (without resetting them)
+//	/connections  active client connections, as JSON (see Connections)
+//	/numbers/<n>  whether the number was seen, as JSON
+//	/numbers      which of the numbers POSTed (a JSON list) are new
+func (s *Server) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/metrics", s.serveMetrics)
+	mux.HandleFunc("/healthz", s.serveHealth)
+	mux.HandleFunc("/readyz", s.serveReady)
+	mux.HandleFunc("/stats", s.serveStats)
+	mux.HandleFunc("/connections", s.serveConnections)
+	mux.HandleFunc("/numbers/", s.serveNumber)
+	mux.HandleFunc("/numbers", s.serveNumbers)
+	return mux
+}
+
+// Checks whether the server is accepting numbers: it's listening,
+// not draining (i.e. shutting down) and its log file is writable
+func (s *Server) Ready() error {
+	if s.listeners == nil {
+		return errors.New("The server wasn't started")
+	}
+	select {
+	case <-s.stopping:
+		return errors.New("The server is draining")
+	default:
+	}
+	if err := s.logger.Writable(); err != nil {
+		return fmt.Errorf("The log file isn't writable: %w", err)
+	}
+	return nil
+}
+
+// Current statistics, as served by /stats
+type jsonStats struct {
+	// Since the last report (see Statistics)
+	Received   int `json:"received"`
+	Duplicates int `json:"duplicates"`
+	// Since the start
+	Total    int `json:"total"`
+	Rejected int `json:"rejected"`
+	TimedOut int `json:"timed_out"`
+	// Unique numbers known by the tracker (including the recovered ones)
+	Tracked           int   `json:"tracked"`
+	ActiveConnections int64 `json:"active_connections"`
+}
+
+// Serves the metrics in Prometheus' text format
+func (s *Server) serveMetrics(writer http.ResponseWriter, request *http.Request) {
+	if !allowRead(writer, request) {
+		return
+	}
+	writer.Header().Set("Content-Type", PROMETHEUS_CONTENT_TYPE)
+	s.metrics.WritePrometheus(writer, s.tracker, s.logger)
+}
+
+func (s *Server) serveHealth(writer http.ResponseWriter, request *http.Request) {
+	if !allowRead(writer, request) {
+		return
+	}
+	fmt.Fprintln(writer, "ok")
+}
+
+func (s *Server) serveReady(writer http.ResponseWriter, request *http.Request) {
+	if !allowRead(writer, request) {
+		return
+	}
+	if err := s.Ready(); err != nil {
+		http.Error(writer, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	fmt.Fprintln(writer, "ready")
+}
+
+func (s *Server) serveStats(writer http.ResponseWriter, request *http.Request) {
+	if !allowRead(writer, request) {
+		return
+	}
+	current := s.tracker.Stats.Current()
+	writeJSON(writer, jsonStats{
+		Received:          current.Received,
+		Duplicates:        current.Duplicates,
+		Total:             current.Total,
+		Rejected:          current.Rejected,
+		TimedOut:          current.TimedOut,
+		Tracked:           s.tracker.KnownNumbers.Len(),
+		ActiveConnections: s.metrics.Snapshot().Active,
+	})
+}
+
+func (s *Server) serveConnections(writer http.ResponseWriter, request *http.Request) {
+	if !allowRead(writer, request) {
+		return
+	}
+	writeJSON(writer, s.Connections())
+}
+
+// A number looked up, as served by /numbers/<n>
+type jsonLookup struct {
+	Number uint64 `json:"number"`
+	Seen   bool   `json:"seen"`
+}
+
+// Numbers looked up in bulk, as served by /numbers
+// (in the same order they were passed)
+type jsonBulkLookup struct {
+	New  []uint64 `json:"new"`
+	Seen []uint64 `json:"seen"`
+}
+
+// Replies whether the number in the path was seen
+func (s *Server) serveNumber(writer http.ResponseWriter, request *http.Request) {
+	if !allowRead(writer, request) {
+		return
+	}
+	input := strings.TrimPrefix(request.URL.Path, "/numbers/")
+	value, err := strconv.ParseUint(input, 10, 32)
+	if err != nil {
+		http.Error(writer, fmt.Sprintf("Invalid number: %s", input), http.StatusBadRequest)
+		return
+	}
+	if err := s.checkLookup(value); err != nil {
+		http.Error(writer, err.Error(), http.StatusBadRequest)
+		return
+	}
+	atomic.AddUint64(&s.metrics.queries, 1)
+	writeJSON(writer, jsonLookup{Number: value, Seen: s.tracker.Seen(int(value))})
+}
+
+// Replies which of the numbers passed (a JSON list, e.g. [1, 42]) are new,
+// so producers can send only those
+func (s *Server) serveNumbers(writer http.ResponseWriter, request *http.Request) {
+	if request.Method != http.MethodPost {
+		writer.Header().Set("Allow", "POST")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var numbers []uint64
+	decoder := json.NewDecoder(http.MaxBytesReader(writer, request.Body, MAX_LOOKUP_BODY))
+	if err := decoder.Decode(&numbers); err != nil {
+		http.Error(writer, fmt.Sprintf("Expected a JSON list of numbers: %v", err), http.StatusBadRequest)
+		return
+	}
+	lookup := jsonBulkLookup{New: []uint64{}, Seen: []uint64{}}
+	for _, value := range numbers {
+		if err := s.checkLookup(value); err != nil {
+			http.Error(writer, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if s.tracker.Seen(int(value)) {
+			lookup.Seen = append(lookup.Seen, value)
+		} else {
+			lookup.New = append(lookup.New, value)
+		}
+	}
+	atomic.AddUint64(&s.metrics.queries, uint64(len(numbers)))
+	writeJSON(writer, lookup)
+}
+
+// Checks that a number looked up has up to the digits accepted
+func (s *Server) checkLookup(value uint64) error {
+	digits := s.checker.GetNumLimit()
+	if value >= uint64(math.Pow10(digits)) {
+		return fmt.Errorf("Invalid number: %d (expected up to %d digits)", value, digits)
+	}
+	return nil
+}
+
+// Only GET and HEAD are allowed (replies 405 otherwise)
+func allowRead(writer http.ResponseWriter, request *http.Request) bool {
+	if request.Method != http.MethodGet && request.Method != http.MethodHead {
+		writer.Header().Set("Allow", "GET, HEAD")
+		http.Error(writer, "Method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	return true
+}
+
+func writeJSON(writer http.ResponseWriter, value interface{}) {
+	encoded, err := json.Marshal(value)
+	if err != nil {
+		http.Error(writer, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writer.Header().Set("Content-Type", "application/json")
+	writer.Write(append(encoded, '\n'))
+}
@@ -0,0 +1,180 @@
+package numberserver
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAdmin(t *testing.T) {
+	// Started server with the admin API on an ephemeral port
+	startAdmin := func(t *testing.T) (*Server, func()) {
+		config, cleanup := setupServer(t)
+		config.AdminAddr = "127.0.0.1:0"
+		server := startServer(t, config)
+		return server, func() {
+			server.Shutdown(context.Background())
+			cleanup()
+		}
+	}
+	get := func(t *testing.T, server *Server, path string) (*http.Response, string) {
+		response, err := http.Get("http://" + server.AdminAddr().String() + path)
+		require.NoError(t, err)
+		defer response.Body.Close()
+		body, err := ioutil.ReadAll(response.Body)
+		require.NoError(t, err)
+		return response, string(body)
+	}
+
+	t.Run("Metrics", func(t *testing.T) {
+		server, cleanup := startAdmin(t)
+		defer cleanup()
+		conn := sendLines(t, server, "000000001", "000000001", "bad")
+		defer conn.Close()
+		require.Eventually(t, func() bool { return server.Metrics().Snapshot().Invalid == 1 },
+			5*time.Second, time.Millisecond)
+
+		response, body := get(t, server, "/metrics")
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, PROMETHEUS_CONTENT_TYPE, response.Header.Get("Content-Type"))
+		for _, sample := range []string{
+			"numberserver_unique_numbers_total 1\n",
+			"numberserver_duplicate_numbers_total 1\n",
+			"numberserver_invalid_inputs_total 1\n",
+			"numberserver_connections_accepted_total 1\n",
+			"numberserver_read_bytes_total 24\n",
+			"numberserver_tracked_numbers 1\n",
+		} {
+			assert.Contains(t, body, sample)
+		}
+	})
+
+	t.Run("Health", func(t *testing.T) {
+		server, cleanup := startAdmin(t)
+		defer cleanup()
+		response, body := get(t, server, "/healthz")
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "ok\n", body)
+		response, err := http.Post("http://"+server.AdminAddr().String()+"/healthz", "text/plain", nil)
+		require.NoError(t, err)
+		response.Body.Close()
+		assert.Equal(t, http.StatusMethodNotAllowed, response.StatusCode)
+	})
+
+	t.Run("Readiness", func(t *testing.T) {
+		server, cleanup := startAdmin(t)
+		defer cleanup()
+		require.Eventually(t, func() bool { return server.Ready() == nil }, 5*time.Second, time.Millisecond)
+		response, body := get(t, server, "/readyz")
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.Equal(t, "ready\n", body)
+		// Log file gone
+		require.NoError(t, os.Remove(server.config.Logfile))
+		response, body = get(t, server, "/readyz")
+		assert.Equal(t, http.StatusServiceUnavailable, response.StatusCode)
+		assert.Contains(t, body, "The log file isn't writable")
+	})
+
+	t.Run("Draining", func(t *testing.T) {
+		server, cleanup := startAdmin(t)
+		defer cleanup()
+		require.Eventually(t, func() bool { return server.Ready() == nil }, 5*time.Second, time.Millisecond)
+		require.NoError(t, server.Shutdown(context.Background()))
+		recorder := httptest.NewRecorder()
+		server.adminHandler().ServeHTTP(recorder, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+		assert.Equal(t, http.StatusServiceUnavailable, recorder.Code)
+		assert.Contains(t, recorder.Body.String(), "draining")
+	})
+
+	t.Run("Stats", func(t *testing.T) {
+		server, cleanup := startAdmin(t)
+		defer cleanup()
+		conn := sendLines(t, server, "000000001", "000000002", "000000001")
+		defer conn.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Stats.Current().Duplicates == 1 },
+			5*time.Second, time.Millisecond)
+		// Reading them doesn't reset them
+		for i := 0; i < 2; i++ {
+			response, body := get(t, server, "/stats")
+			assert.Equal(t, http.StatusOK, response.StatusCode)
+			assert.Equal(t, "application/json", response.Header.Get("Content-Type"))
+			var stats jsonStats
+			require.NoError(t, json.Unmarshal([]byte(body), &stats))
+			assert.Equal(t, jsonStats{Received: 2, Duplicates: 1, Total: 2, Tracked: 2, ActiveConnections: 1}, stats)
+		}
+	})
+
+	t.Run("Lookup", func(t *testing.T) {
+		server, cleanup := startAdmin(t)
+		defer cleanup()
+		conn := sendLines(t, server, "000000042")
+		defer conn.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Seen(42) }, 5*time.Second, time.Millisecond)
+
+		response, body := get(t, server, "/numbers/42")
+		assert.Equal(t, http.StatusOK, response.StatusCode)
+		assert.JSONEq(t, `{"number":42,"seen":true}`, body)
+		_, body = get(t, server, "/numbers/000000043")
+		assert.JSONEq(t, `{"number":43,"seen":false}`, body)
+		for _, invalid := range []string{"/numbers/abc", "/numbers/-1", "/numbers/1000000000"} {
+			response, _ = get(t, server, invalid)
+			assert.Equal(t, http.StatusBadRequest, response.StatusCode, "Path %s", invalid)
+		}
+
+		post := func(t *testing.T, body string) (int, string) {
+			response, err := http.Post("http://"+server.AdminAddr().String()+"/numbers", "application/json",
+				strings.NewReader(body))
+			require.NoError(t, err)
+			defer response.Body.Close()
+			content, err := ioutil.ReadAll(response.Body)
+			require.NoError(t, err)
+			return response.StatusCode, string(content)
+		}
+		status, body := post(t, `[1, 42, 7]`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"new":[1,7],"seen":[42]}`, body)
+		status, body = post(t, `[]`)
+		assert.Equal(t, http.StatusOK, status)
+		assert.JSONEq(t, `{"new":[],"seen":[]}`, body)
+		for _, invalid := range []string{`[1, -2]`, `{"numbers": [1]}`, `[1000000000]`} {
+			status, _ = post(t, invalid)
+			assert.Equal(t, http.StatusBadRequest, status, "Body %s", invalid)
+		}
+		assert.False(t, server.Tracker().Seen(1), "Lookups shouldn't register numbers")
+	})
+
+	t.Run("Connections", func(t *testing.T) {
+		server, cleanup := startAdmin(t)
+		defer cleanup()
+		first := sendLines(t, server, "000000001", "000000001")
+		defer first.Close()
+		second := sendLines(t, server, "000000002")
+		defer second.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Seen(2) && len(server.Connections()) == 2 },
+			5*time.Second, time.Millisecond)
+		require.Eventually(t, func() bool { return server.Tracker().Stats.Current().Duplicates == 1 },
+			5*time.Second, time.Millisecond)
+
+		_, body := get(t, server, "/connections")
+		var connections []ConnectionInfo
+		require.NoError(t, json.Unmarshal([]byte(body), &connections))
+		require.Len(t, connections, 2)
+		assert.Equal(t, first.LocalAddr().String(), connections[0].Client)
+		assert.Equal(t, uint64(1), connections[0].Received)
+		assert.Equal(t, uint64(1), connections[0].Duplicates)
+		assert.Equal(t, second.LocalAddr().String(), connections[1].Client)
+		assert.Equal(t, uint64(1), connections[1].Received)
+
+		first.Close()
+		require.Eventually(t, func() bool { return len(server.Connections()) == 1 }, 5*time.Second, time.Millisecond)
+	})
+}
@@ -1,7 +1,8 @@
-package main
+package numberserver
 
 import (
 	"fmt"
+	"sync"
 )
 
 // Exposes basic methods for the validation of input
@@ -9,11 +10,15 @@ import (
 type Checker interface {
 	CheckTermination(string) bool
 	ValidateInput(string) bool
+	// Returns why the input is invalid (nil if it's valid)
+	CheckInput(string) error
 }
 
 // This would be used to check inputs
 type NumberChecker struct {
 	// making the fields private to let validation to Setters
+	// (the termination keyword can change while checking, see Server's Reload)
+	mu          sync.RWMutex
 	termination string
 	numLimit    int
 }
@@ -25,6 +30,8 @@ func NewDefaultNumberChecker() *NumberChecker {
 
 // Custom setter for termination keyword (used to stop the connection)
 func (nc *NumberChecker) SetTermination(newTerminate string) {
+	nc.mu.Lock()
+	defer nc.mu.Unlock()
 	nc.termination = newTerminate
 }
 
@@ -45,6 +52,8 @@ func (nc *NumberChecker) GetNumLimit() int {
 
 // Basic getter of the Termination string of this NumberChecker
 func (nc *NumberChecker) GetTermination() string {
+	nc.mu.RLock()
+	defer nc.mu.RUnlock()
 	return nc.termination
 }
 
@@ -53,7 +62,7 @@ func (nc *NumberChecker) GetTermination() string {
 // Checks the input passed and indicates whether it
 // corresponds to the terminate string (input == nc.terminate) order.
 func (nc *NumberChecker) CheckTermination(input string) bool {
-	return input == nc.termination
+	return input == nc.GetTermination()
 }
 
 // Validates whether the passed string corresponds
@@ -75,3 +84,35 @@ func (nc *NumberChecker) ValidateInput(input string) bool {
 	}
 	return true
 }
+
+// Codes of the reasons why an input is rejected
+const (
+	ERR_WRONG_LENGTH = 1
+	ERR_NON_DIGIT    = 2
+)
+
+// Why an input didn't pass the validation (see CheckInput)
+type InputError struct {
+	Code int
+	// Short, machine-readable reason: wrong_length or non_digit
+	Reason string
+	Input  string
+}
+
+func (e *InputError) Error() string {
+	return fmt.Sprintf("invalid input %q: %s", e.Input, e.Reason)
+}
+
+// Same as ValidateInput, but explaining why the input is invalid.
+// Returns nil for valid inputs
+func (nc *NumberChecker) CheckInput(input string) error {
+	if len(input) != nc.numLimit {
+		return &InputError{Code: ERR_WRONG_LENGTH, Reason: "wrong_length", Input: input}
+	}
+	for _, char := range input {
+		if char < '0' || char > '9' {
+			return &InputError{Code: ERR_NON_DIGIT, Reason: "non_digit", Input: input}
+		}
+	}
+	return nil
+}
@@ -1,9 +1,11 @@
-package main
+package numberserver
 
 import (
+	"errors"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type validateInputTestCase struct {
@@ -25,6 +27,13 @@ type setNumLimitCase struct {
 	Errored  bool
 }
 
+type checkInputCase struct {
+	Name  string
+	Input string
+	// 0 if valid
+	Code int
+}
+
 type getIntValueCase struct {
 	Name     string
 	Input    string
@@ -153,4 +162,29 @@ func TestNumberChecker(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("Check Input", func(t *testing.T) {
+		numberChecker := NewDefaultNumberChecker()
+		testCases := []checkInputCase{
+			{Name: "Valid", Input: "007007009"},
+			{Name: "Too short", Input: "00700700", Code: ERR_WRONG_LENGTH},
+			{Name: "Too long", Input: "0070070090", Code: ERR_WRONG_LENGTH},
+			{Name: "Non digit", Input: "00700700a", Code: ERR_NON_DIGIT},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				err := numberChecker.CheckInput(tc.Input)
+				assert.Equal(t, tc.Code == 0, numberChecker.ValidateInput(tc.Input),
+					"CheckInput and ValidateInput should agree")
+				if tc.Code == 0 {
+					assert.NoError(t, err)
+					return
+				}
+				var inputErr *InputError
+				require.True(t, errors.As(err, &inputErr))
+				assert.Equal(t, tc.Code, inputErr.Code)
+				assert.Equal(t, tc.Input, inputErr.Input)
+			})
+		}
+	})
 }
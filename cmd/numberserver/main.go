@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/mountolive/numberserver"
+	"github.com/urfave/cli"
+)
+
+func main() {
+	// **** Flag parsing ****
+	app := cli.NewApp()
+	app.Name = "Number logger"
+	app.Usage = `Writes numbers to defined log file.
+                   Numbers can have up to the max number
+							     of digits defined by the user: 9 by default.
+							     When the termination ("terminate") keyword is prompted,
+							     the program will attempt to shutdown gracefully.
+							     This termination keyword can be changed on start (see --help)`
+	app.Flags = []cli.Flag{
+		&cli.StringFlag{
+			Name: CONFIG_FLAG,
+			Usage: "Config file (YAML) with the settings by their flags' names, e.g. max-lifetime: 60. " +
+				"Settings can also be set by environment variables, e.g. NUMBERSERVER_MAX_LIFETIME " +
+				"(precedence: flag > environment > config file > default)",
+		},
+	}
+	for _, setting := range settings {
+		app.Flags = append(app.Flags, setting.flag())
+	}
+	// Server's config, set only if the flags are parsed (e.g. not on --help)
+	var config *numberserver.Config
+	// Resolves the settings again, with the same flags (see reloadOnHangup)
+	var reload func() (numberserver.Config, error)
+	// Parsing of flags
+	app.Action = func(ctx *cli.Context) error {
+		load := func() (numberserver.Config, error) {
+			resolved, err := loadSettings(ctx)
+			if err != nil {
+				return numberserver.Config{}, err
+			}
+			return buildConfig(resolved)
+		}
+		parsed, err := load()
+		if err != nil {
+			return err
+		}
+		config = &parsed
+		reload = load
+		return nil
+	}
+	app.Commands = []cli.Command{
+		{
+			Name:  "config",
+			Usage: "Inspects the configuration",
+			Subcommands: []cli.Command{
+				{
+					Name:  "print",
+					Usage: "Prints the effective configuration (as a config file) and where each setting came from",
+					Action: func(ctx *cli.Context) error {
+						resolved, err := loadSettings(ctx)
+						if err != nil {
+							return err
+						}
+						if _, err := buildConfig(resolved); err != nil {
+							return err
+						}
+						printed, err := printSettings(resolved)
+						if err != nil {
+							return err
+						}
+						fmt.Print(string(printed))
+						return nil
+					},
+				},
+			},
+		},
+	}
+	err := app.Run(os.Args)
+	if err != nil {
+		fmt.Printf("An error occurred while trying to parse options: %v\n", err)
+		fmt.Println("Aborting...")
+		return
+	}
+	// The config won't be set, for example, if the user calls the --help subcommand
+	if config == nil {
+		return
+	}
+
+	// **** Actual server ****
+	server, err := numberserver.NewServer(*config)
+	if err != nil {
+		fmt.Printf("%v\n", err)
+		fmt.Println("Aborting...")
+		return
+	}
+	// Global context
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := server.Start(ctx); err != nil {
+		fmt.Printf("%v\n", err)
+		fmt.Println("Aborting...")
+		return
+	}
+	// When shuttingdown
+	exit := make(chan os.Signal, 1)
+	signal.Notify(exit, os.Interrupt, os.Kill)
+	go gracefulShutdown(exit, cancel)
+	// When reloading
+	hangup := make(chan os.Signal, 1)
+	signal.Notify(hangup, syscall.SIGHUP)
+	go reloadOnHangup(ctx, hangup, server, reload)
+	// Blocks until every number accepted is logged
+	if err := server.Wait(); err != nil {
+		fmt.Printf("%v\n", err)
+	}
+}
+
+// Shuts the server down on a kill/interrupt signal
+func gracefulShutdown(exit <-chan os.Signal, cancel context.CancelFunc) {
+	<-exit
+	fmt.Println("Received kill/intrrupt signal...")
+	cancel()
+}
+
+// Reloads the config on every hangup signal (see Server's Reload),
+// until ctx is canceled
+func reloadOnHangup(ctx context.Context, hangup <-chan os.Signal, server *numberserver.Server,
+	load func() (numberserver.Config, error)) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hangup:
+		}
+		fmt.Println("Received hangup signal, reloading the config...")
+		config, err := load()
+		if err != nil {
+			fmt.Printf("An error occurred while reloading the config, nothing changed: %v\n", err)
+			continue
+		}
+		report, err := server.Reload(config)
+		if err != nil {
+			fmt.Printf("An error occurred while reloading the config, nothing changed: %v\n", err)
+			continue
+		}
+		fmt.Println(report)
+	}
+}
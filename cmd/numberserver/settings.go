@@ -0,0 +1,504 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/mountolive/numberserver"
+	"github.com/mountolive/numberserver/logformat"
+	"github.com/urfave/cli"
+	"gopkg.in/yaml.v3"
+)
+
+// Prefix of the environment variables setting the flags, followed by
+// the flag's name in upper case (e.g. NUMBERSERVER_MAX_LIFETIME)
+const ENV_PREFIX = "NUMBERSERVER_"
+
+// Flag (or environment variable) with the path of the config file
+const CONFIG_FLAG = "config"
+
+// Printed instead of the secrets' values (see printSettings)
+const REDACTED = "<redacted>"
+
+// Kinds of settings' values
+type settingKind int
+
+const (
+	kindString settingKind = iota
+	kindInt
+	kindInt64
+	kindBool
+	// Can be repeated (each flag adds a value)
+	kindList
+)
+
+// A setting of the server. It's set by its flag, or else by its
+// environment variable, or else in the config file (by the flag's name,
+// e.g. max-lifetime: 60), or else it keeps its default value
+type setting struct {
+	name  string
+	alias string
+	kind  settingKind
+	// Default value, as a string
+	value string
+	usage string
+	// Redacted when printed (see printSettings)
+	secret bool
+	// Config's field it sets (see numberserver.ConfigError)
+	field string
+	apply func(config *numberserver.Config, values []string) error
+}
+
+func stringSetting(name, alias, value, usage, field string,
+	set func(config *numberserver.Config, value string) error) setting {
+	return setting{name: name, alias: alias, kind: kindString, value: value, usage: usage, field: field,
+		apply: func(config *numberserver.Config, values []string) error {
+			return set(config, values[0])
+		}}
+}
+
+func intSetting(name, alias string, value int, usage, field string,
+	set func(config *numberserver.Config, value int)) setting {
+	return setting{name: name, alias: alias, kind: kindInt, value: strconv.Itoa(value), usage: usage, field: field,
+		apply: func(config *numberserver.Config, values []string) error {
+			parsed, err := strconv.Atoi(values[0])
+			if err != nil {
+				return errors.New("expected an integer")
+			}
+			set(config, parsed)
+			return nil
+		}}
+}
+
+func int64Setting(name string, usage, field string, set func(config *numberserver.Config, value int64)) setting {
+	return setting{name: name, kind: kindInt64, value: "0", usage: usage, field: field,
+		apply: func(config *numberserver.Config, values []string) error {
+			parsed, err := strconv.ParseInt(values[0], 10, 64)
+			if err != nil {
+				return errors.New("expected an integer")
+			}
+			set(config, parsed)
+			return nil
+		}}
+}
+
+func boolSetting(name, alias, usage, field string, set func(config *numberserver.Config, value bool)) setting {
+	return setting{name: name, alias: alias, kind: kindBool, value: "false", usage: usage, field: field,
+		apply: func(config *numberserver.Config, values []string) error {
+			parsed, err := strconv.ParseBool(values[0])
+			if err != nil {
+				return errors.New("expected true or false")
+			}
+			set(config, parsed)
+			return nil
+		}}
+}
+
+func secretSetting(s setting) setting {
+	s.secret = true
+	return s
+}
+
+// Every setting of the server, in the order they're listed
+var settings = []setting{
+	intSetting("port", "p", 4000, "Port to be listened to", "Port",
+		func(c *numberserver.Config, value int) { c.Port = value }),
+	{
+		name: "listen",
+		kind: kindList,
+		usage: "Listen to (instead of --port): host:port, tcp4://host:port, tcp6://[host]:port, " +
+			"unix://<socket path> or udp://host:port (also udp4 and udp6), optionally followed by " +
+			",mode=<octal permissions> (sockets), ,maxconn=<connections> of its own (not udp) and " +
+			",size=<max datagram bytes> (udp) (can be repeated)",
+		field: "Listen",
+		apply: func(c *numberserver.Config, values []string) error {
+			for _, definition := range values {
+				listen, err := numberserver.ParseListen(definition)
+				if err != nil {
+					return err
+				}
+				c.Listen = append(c.Listen, listen)
+			}
+			return nil
+		},
+	},
+	stringSetting("tls-cert", "", "", "TLS certificate file (PEM), for the clients' connections (TLS is "+
+		"disabled if empty). It's loaded again on SIGHUP", "TLSCert",
+		func(c *numberserver.Config, value string) error {
+			c.TLSCert = value
+			return nil
+		}),
+	stringSetting("tls-key", "", "", "TLS key file (PEM) of the --tls-cert", "TLSKey",
+		func(c *numberserver.Config, value string) error {
+			c.TLSKey = value
+			return nil
+		}),
+	stringSetting("tls-client-ca", "", "", "CA bundle (PEM) verifying the clients' certificates, which are "+
+		"required then (mutual TLS)", "TLSClientCA",
+		func(c *numberserver.Config, value string) error {
+			c.TLSClientCA = value
+			return nil
+		}),
+	boolSetting("append", "a", "Whether to append to existing log file or recreate on start", "Append",
+		func(c *numberserver.Config, value bool) { c.Append = value }),
+	stringSetting("logfile", "l", "./numbers.log", "Log file's path where the inputs would be written", "Logfile",
+		func(c *numberserver.Config, value string) error {
+			c.Logfile = value
+			return nil
+		}),
+	stringSetting("termination", "t", "terminate", "Terminate keyword, for shutting down the server", "Termination",
+		func(c *numberserver.Config, value string) error {
+			c.Termination = value
+			return nil
+		}),
+	stringSetting("termination-from", "", "any", "Who can send the termination keyword on the port: any, "+
+		"none (only the --admin-socket can) or a comma separated list of IPs and CIDRs", "TerminationAccess",
+		func(c *numberserver.Config, value string) (err error) {
+			c.TerminationAccess, err = numberserver.ParseTerminationAccess(value)
+			return err
+		}),
+	secretSetting(stringSetting("termination-token", "", "",
+		"Token required after the termination keyword, e.g. \"terminate <token>\" (not required if empty)",
+		"TerminationToken",
+		func(c *numberserver.Config, value string) error {
+			c.TerminationToken = value
+			return nil
+		})),
+	stringSetting("admin-socket", "", "", "Unix socket accepting the termination keyword from the user "+
+		"running the server, no matter --termination-from (disabled if empty)", "AdminSocket",
+		func(c *numberserver.Config, value string) error {
+			c.AdminSocket = value
+			return nil
+		}),
+	intSetting("digits", "d", 9, "Max number of digits permitted for int input (max: 9)", "Digits",
+		func(c *numberserver.Config, value int) { c.Digits = value }),
+	intSetting("interval", "i", 10, "Show statistics every * seconds", "Interval",
+		func(c *numberserver.Config, value int) { c.Interval = time.Second * time.Duration(value) }),
+	stringSetting("stats-format", "", "text",
+		"Format of the statistics: text (sentences) or json (a JSON object per line)", "StatsFormat",
+		func(c *numberserver.Config, value string) (err error) {
+			c.StatsFormat, err = numberserver.ParseStatsFormat(value)
+			return err
+		}),
+	stringSetting("stats-file", "", "", "File where the statistics are appended (STDOUT if empty)", "StatsFile",
+		func(c *numberserver.Config, value string) error {
+			c.StatsFile = value
+			return nil
+		}),
+	intSetting("maxconn", "c", 5, "Max number of concurrent connections allowed", "MaxConn",
+		func(c *numberserver.Config, value int) { c.MaxConn = value }),
+	stringSetting("overload", "", "block", "What to do with connections beyond --maxconn: block "+
+		"(leave them in the backlog until a place is free), reject (reply busy and close) or queue (wait up to --overload-timeout, "+
+		"then reject)", "Overload",
+		func(c *numberserver.Config, value string) (err error) {
+			c.Overload, err = numberserver.ParseOverloadPolicy(value)
+			return err
+		}),
+	intSetting("overload-timeout", "", 5000,
+		"Max milliseconds a connection waits for a place (with --overload queue)", "OverloadTimeout",
+		func(c *numberserver.Config, value int) { c.OverloadTimeout = time.Millisecond * time.Duration(value) }),
+	intSetting("idle-timeout", "", 0,
+		"Close connections waiting more than * milliseconds for a new line (0 disables it)", "IdleTimeout",
+		func(c *numberserver.Config, value int) { c.IdleTimeout = time.Millisecond * time.Duration(value) }),
+	intSetting("read-timeout", "", 0,
+		"Close connections taking more than * milliseconds to send a whole line (0 disables it)", "ReadTimeout",
+		func(c *numberserver.Config, value int) { c.ReadTimeout = time.Millisecond * time.Duration(value) }),
+	intSetting("max-lifetime", "", 0, "Close connections open for more than * seconds (0 disables it)",
+		"MaxLifetime",
+		func(c *numberserver.Config, value int) { c.MaxLifetime = time.Second * time.Duration(value) }),
+	stringSetting("on-invalid", "", "close", "What to do with clients sending invalid lines: close, "+
+		"reply-close or reply-continue (replying with an error line)", "OnInvalid",
+		func(c *numberserver.Config, value string) (err error) {
+			c.OnInvalid, err = numberserver.ParseInvalidPolicy(value)
+			return err
+		}),
+	stringSetting("format", "f", "text",
+		"Log file's format: text (zero-padded numbers), jsonl, csv or binary (4 bytes little-endian)", "Format",
+		func(c *numberserver.Config, value string) (err error) {
+			c.Format, err = logformat.ParseFormat(value)
+			return err
+		}),
+	intSetting("buffer-size", "", 0,
+		"Size in bytes of the log file's write buffer (0 writes every line right away)", "BufferSize",
+		func(c *numberserver.Config, value int) { c.BufferSize = value }),
+	intSetting("flush-interval", "", 1000,
+		"Flush the log file's write buffer every * milliseconds (0 disables it)", "FlushInterval",
+		func(c *numberserver.Config, value int) { c.FlushInterval = time.Millisecond * time.Duration(value) }),
+	stringSetting("fsync", "", "never", "When to fsync the log file while running: never, interval or flush",
+		"Fsync",
+		func(c *numberserver.Config, value string) (err error) {
+			c.Fsync, err = numberserver.ParseFsyncPolicy(value)
+			return err
+		}),
+	intSetting("fsync-interval", "", 1000, "Fsync the log file every * milliseconds (with --fsync interval)",
+		"FsyncInterval",
+		func(c *numberserver.Config, value int) { c.FsyncInterval = time.Millisecond * time.Duration(value) }),
+	int64Setting("rotate-size", "Rotate the log file once it reaches * bytes (0 disables it)", "RotateSize",
+		func(c *numberserver.Config, value int64) { c.RotateSize = value }),
+	intSetting("rotate-age", "", 0, "Rotate the log file every * seconds (0 disables it)", "RotateAge",
+		func(c *numberserver.Config, value int) { c.RotateAge = time.Second * time.Duration(value) }),
+	intSetting("keep-segments", "", 0,
+		"Keep only the last * rotated segments of the log file (0 keeps all of them)", "KeepSegments",
+		func(c *numberserver.Config, value int) { c.KeepSegments = value }),
+	stringSetting("compress", "", "none", "Compression of the rotated segments of the log file: none or gzip (requires rotation)",
+		"Compression",
+		func(c *numberserver.Config, value string) (err error) {
+			c.Compression, err = numberserver.ParseCompression(value)
+			return err
+		}),
+	{
+		name: "sink",
+		kind: kindList,
+		usage: "Also send unique numbers to: stdout, file:<path>, unix:<socket> or an http(s) URL, " +
+			"optionally followed by ,policy=retry|block|drop and ,batch=<entries> (can be repeated)",
+		field: "Sinks",
+		apply: func(c *numberserver.Config, values []string) error {
+			for _, definition := range values {
+				sink, err := numberserver.ParseSink(definition)
+				if err != nil {
+					return err
+				}
+				c.Sinks = append(c.Sinks, sink)
+			}
+			return nil
+		},
+	},
+	stringSetting("snapshot-dir", "", "",
+		"Directory where snapshots of the unique numbers are kept (disabled if empty)", "SnapshotDir",
+		func(c *numberserver.Config, value string) error {
+			c.SnapshotDir = value
+			return nil
+		}),
+	intSetting("snapshot-interval", "", 60, "Take a snapshot every * seconds", "SnapshotInterval",
+		func(c *numberserver.Config, value int) { c.SnapshotInterval = time.Second * time.Duration(value) }),
+	stringSetting("admin-addr", "", "", "Address (host:port) of the admin HTTP API: /metrics, /healthz, "+
+		"/readyz, /stats and /connections (disabled if empty)", "AdminAddr",
+		func(c *numberserver.Config, value string) error {
+			c.AdminAddr = value
+			return nil
+		}),
+}
+
+// Environment variable of a setting
+func envName(name string) string {
+	return ENV_PREFIX + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+}
+
+// Command line flag of the setting
+func (s setting) flag() cli.Flag {
+	name := s.name
+	if s.alias != "" {
+		name += ", " + s.alias
+	}
+	switch s.kind {
+	case kindInt:
+		value, _ := strconv.Atoi(s.value)
+		return &cli.IntFlag{Name: name, Value: value, Usage: s.usage}
+	case kindInt64:
+		value, _ := strconv.ParseInt(s.value, 10, 64)
+		return &cli.Int64Flag{Name: name, Value: value, Usage: s.usage}
+	case kindBool:
+		return &cli.BoolFlag{Name: name, Usage: s.usage}
+	case kindList:
+		return &cli.StringSliceFlag{Name: name, Usage: s.usage}
+	}
+	return &cli.StringFlag{Name: name, Value: s.value, Usage: s.usage}
+}
+
+// Value of the setting's flag, as strings
+func (s setting) flagValues(ctx *cli.Context) []string {
+	switch s.kind {
+	case kindInt:
+		return []string{strconv.Itoa(ctx.GlobalInt(s.name))}
+	case kindInt64:
+		return []string{strconv.FormatInt(ctx.GlobalInt64(s.name), 10)}
+	case kindBool:
+		return []string{strconv.FormatBool(ctx.GlobalBool(s.name))}
+	case kindList:
+		return ctx.GlobalStringSlice(s.name)
+	}
+	return []string{ctx.GlobalString(s.name)}
+}
+
+// The effective value of a setting, and where it came from
+// (e.g. "flag --port" or "default")
+type resolvedSetting struct {
+	setting
+	values []string
+	source string
+}
+
+// Settings read from a config file (YAML), by name
+type configFile struct {
+	path   string
+	values map[string][]string
+}
+
+// Reads a config file: a YAML mapping of settings' names to their values
+// (lists, for settings that can be repeated)
+func readConfigFile(path string) (*configFile, error) {
+	// Only YAML is supported (a file without an extension is read as YAML)
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml", "":
+	default:
+		return nil, fmt.Errorf("Unsupported format of the config file %s (expected YAML: .yaml or .yml)", path)
+	}
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("An error occurred while reading the config file: %w", err)
+	}
+	var document map[string]interface{}
+	if err := yaml.Unmarshal(content, &document); err != nil {
+		return nil, fmt.Errorf("An error occurred while parsing the config file %s: %w", path, err)
+	}
+	file := &configFile{path: path, values: make(map[string][]string)}
+	for name, value := range document {
+		if _, ok := findSetting(name); !ok {
+			return nil, fmt.Errorf("Unknown setting %q in the config file %s", name, path)
+		}
+		switch typed := value.(type) {
+		case nil:
+			file.values[name] = []string{""}
+		case []interface{}:
+			values := make([]string, 0, len(typed))
+			for _, item := range typed {
+				values = append(values, fmt.Sprint(item))
+			}
+			file.values[name] = values
+		case map[string]interface{}:
+			return nil, fmt.Errorf("Invalid %s in the config file %s: expected a value or a list", name, path)
+		default:
+			file.values[name] = []string{fmt.Sprint(typed)}
+		}
+	}
+	return file, nil
+}
+
+func findSetting(name string) (setting, bool) {
+	for _, setting := range settings {
+		if setting.name == name {
+			return setting, true
+		}
+	}
+	return setting{}, false
+}
+
+// Resolves every setting with precedence flag > environment > file > default
+// (file can be nil, lookupEnv is usually os.LookupEnv)
+func resolveSettings(ctx *cli.Context, lookupEnv func(string) (string, bool),
+	file *configFile) []resolvedSetting {
+	resolved := make([]resolvedSetting, 0, len(settings))
+	for _, setting := range settings {
+		current := resolvedSetting{setting: setting, values: []string{setting.value}, source: "default"}
+		if setting.kind == kindList {
+			current.values = nil
+		}
+		if ctx.GlobalIsSet(setting.name) {
+			current.values = setting.flagValues(ctx)
+			current.source = "flag --" + setting.name
+		} else if value, ok := lookupEnv(envName(setting.name)); ok {
+			current.values = []string{value}
+			if setting.kind == kindList {
+				current.values = strings.Fields(value)
+			}
+			current.source = "environment variable " + envName(setting.name)
+		} else if values, ok := file.lookup(setting.name); ok {
+			current.values = values
+			current.source = "config file " + file.path
+		}
+		resolved = append(resolved, current)
+	}
+	return resolved
+}
+
+func (f *configFile) lookup(name string) ([]string, bool) {
+	if f == nil {
+		return nil, false
+	}
+	values, ok := f.values[name]
+	return values, ok
+}
+
+// Config with the resolved settings. Errors name the setting
+// and where its value came from
+func buildConfig(resolved []resolvedSetting) (numberserver.Config, error) {
+	config := numberserver.DefaultConfig()
+	for _, setting := range resolved {
+		if setting.kind != kindList && len(setting.values) != 1 {
+			return config, fmt.Errorf("Invalid %s (%s): expected a single value", setting.name, setting.source)
+		}
+		if err := setting.apply(&config, setting.values); err != nil {
+			return config, fmt.Errorf("Invalid %s %q (%s): %v", setting.name,
+				strings.Join(setting.values, " "), setting.source, err)
+		}
+	}
+	if err := config.Validate(); err != nil {
+		var configErr *numberserver.ConfigError
+		if errors.As(err, &configErr) {
+			for _, setting := range resolved {
+				if setting.field == configErr.Field {
+					return config, fmt.Errorf("%v (%s, from %s)", err, setting.name, setting.source)
+				}
+			}
+		}
+		return config, err
+	}
+	return config, nil
+}
+
+// Config file's path, from its flag or environment variable (empty if none)
+func configPath(ctx *cli.Context, lookupEnv func(string) (string, bool)) string {
+	if ctx.GlobalIsSet(CONFIG_FLAG) {
+		return ctx.GlobalString(CONFIG_FLAG)
+	}
+	path, _ := lookupEnv(envName(CONFIG_FLAG))
+	return path
+}
+
+// Resolves the settings (see resolveSettings), reading the config file if any
+func loadSettings(ctx *cli.Context) ([]resolvedSetting, error) {
+	var file *configFile
+	if path := configPath(ctx, os.LookupEnv); path != "" {
+		var err error
+		file, err = readConfigFile(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return resolveSettings(ctx, os.LookupEnv, file), nil
+}
+
+// Writes the settings as a config file (YAML), commenting where
+// each value came from. Secrets are redacted
+func printSettings(resolved []resolvedSetting) ([]byte, error) {
+	document := &yaml.Node{Kind: yaml.MappingNode}
+	tags := map[settingKind]string{kindString: "!!str", kindInt: "!!int", kindInt64: "!!int", kindBool: "!!bool"}
+	for _, setting := range resolved {
+		key := &yaml.Node{Kind: yaml.ScalarNode, Value: setting.name}
+		var value *yaml.Node
+		if setting.kind == kindList {
+			value = &yaml.Node{Kind: yaml.SequenceNode, Style: yaml.FlowStyle}
+			for _, item := range setting.values {
+				value.Content = append(value.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: item})
+			}
+		} else {
+			value = &yaml.Node{Kind: yaml.ScalarNode, Tag: tags[setting.kind], Value: setting.values[0]}
+			if setting.secret && value.Value != "" {
+				value.Value = REDACTED
+			}
+		}
+		value.LineComment = setting.source
+		document.Content = append(document.Content, key, value)
+	}
+	encoded, err := yaml.Marshal(document)
+	if err != nil {
+		return nil, fmt.Errorf("An error occurred while printing the config: %w", err)
+	}
+	return encoded, nil
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/urfave/cli"
+)
+
+// Context with the settings' flags parsed from args
+func parseFlags(t *testing.T, args ...string) *cli.Context {
+	set := flag.NewFlagSet("test", flag.ContinueOnError)
+	for _, setting := range settings {
+		setting.flag().Apply(set)
+	}
+	require.Nil(t, set.Parse(args))
+	return cli.NewContext(cli.NewApp(), set, nil)
+}
+
+func fakeEnv(variables map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		value, ok := variables[name]
+		return value, ok
+	}
+}
+
+func TestSettings(t *testing.T) {
+	dir, err := ioutil.TempDir("", "settings")
+	require.Nil(t, err)
+	defer os.RemoveAll(dir)
+	writeFile := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		require.Nil(t, ioutil.WriteFile(path, []byte(content), 0644))
+		return path
+	}
+	sources := func(resolved []resolvedSetting) map[string]string {
+		bySetting := make(map[string]string)
+		for _, setting := range resolved {
+			bySetting[setting.name] = setting.source
+		}
+		return bySetting
+	}
+
+	t.Run("Defaults", func(t *testing.T) {
+		resolved := resolveSettings(parseFlags(t), fakeEnv(nil), nil)
+		config, err := buildConfig(resolved)
+		require.Nil(t, err)
+		require.Equal(t, 4000, config.Port)
+		require.Equal(t, 10*time.Second, config.Interval)
+		require.Equal(t, "default", sources(resolved)["port"])
+	})
+
+	t.Run("Precedence", func(t *testing.T) {
+		path := writeFile("precedence.yaml", "port: 4100\nmaxconn: 7\ndigits: 5\nsink: [stdout]\n")
+		file, err := readConfigFile(path)
+		require.Nil(t, err)
+		env := fakeEnv(map[string]string{"NUMBERSERVER_PORT": "4200", "NUMBERSERVER_MAXCONN": "8"})
+		resolved := resolveSettings(parseFlags(t, "--port", "4300"), env, file)
+		config, err := buildConfig(resolved)
+		require.Nil(t, err)
+		require.Equal(t, 4300, config.Port)
+		require.Equal(t, 8, config.MaxConn)
+		require.Equal(t, 5, config.Digits)
+		require.Len(t, config.Sinks, 1)
+		bySetting := sources(resolved)
+		require.Equal(t, "flag --port", bySetting["port"])
+		require.Equal(t, "environment variable NUMBERSERVER_MAXCONN", bySetting["maxconn"])
+		require.Equal(t, "config file "+path, bySetting["digits"])
+	})
+
+	t.Run("Environment lists", func(t *testing.T) {
+		env := fakeEnv(map[string]string{"NUMBERSERVER_SINK": "stdout file:/tmp/numbers"})
+		config, err := buildConfig(resolveSettings(parseFlags(t), env, nil))
+		require.Nil(t, err)
+		require.Len(t, config.Sinks, 2)
+	})
+
+	t.Run("Errors name the source", func(t *testing.T) {
+		path := writeFile("invalid.yaml", "maxconn: -1\n")
+		file, err := readConfigFile(path)
+		require.Nil(t, err)
+		_, err = buildConfig(resolveSettings(parseFlags(t), fakeEnv(nil), file))
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "maxconn, from config file "+path)
+
+		env := fakeEnv(map[string]string{"NUMBERSERVER_INTERVAL": "often"})
+		_, err = buildConfig(resolveSettings(parseFlags(t), env, nil))
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "environment variable NUMBERSERVER_INTERVAL")
+
+		_, err = buildConfig(resolveSettings(parseFlags(t, "--overload", "drop"), fakeEnv(nil), nil))
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "flag --overload")
+	})
+
+	t.Run("Unknown settings", func(t *testing.T) {
+		_, err := readConfigFile(writeFile("unknown.yaml", "bogus: 1\n"))
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "bogus")
+	})
+
+	t.Run("Unsupported format", func(t *testing.T) {
+		_, err := readConfigFile(writeFile("numberserver.toml", "port = 4100\n"))
+		require.NotNil(t, err)
+		require.Contains(t, err.Error(), "Unsupported format")
+		file, err := readConfigFile(writeFile("numberserver.yml", "port: 4100\n"))
+		require.NoError(t, err)
+		require.Equal(t, []string{"4100"}, file.values["port"])
+	})
+
+	t.Run("Print", func(t *testing.T) {
+		env := fakeEnv(map[string]string{"NUMBERSERVER_DIGITS": "5"})
+		resolved := resolveSettings(parseFlags(t, "--port", "4100"), env, nil)
+		printed, err := printSettings(resolved)
+		require.Nil(t, err)
+		require.Contains(t, string(printed), "port: 4100 # flag --port\n")
+		require.Contains(t, string(printed), "digits: 5 # environment variable NUMBERSERVER_DIGITS\n")
+		require.Contains(t, string(printed), "admin-addr: \"\" # default\n")
+		// Secrets aren't printed
+		resolved = resolveSettings(parseFlags(t, "--termination-token", "s3cret"), fakeEnv(nil), nil)
+		redacted, err := printSettings(resolved)
+		require.Nil(t, err)
+		require.NotContains(t, string(redacted), "s3cret")
+		require.Contains(t, string(redacted), "termination-token: <redacted> # flag --termination-token\n")
+		// Can be read back as a config file
+		file, err := readConfigFile(writeFile("printed.yaml", string(printed)))
+		require.Nil(t, err)
+		config, err := buildConfig(resolveSettings(parseFlags(t), fakeEnv(nil), file))
+		require.Nil(t, err)
+		require.Equal(t, 4100, config.Port)
+		require.Equal(t, 5, config.Digits)
+	})
+}
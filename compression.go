@@ -0,0 +1,110 @@
+package numberserver
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// Compression applied to the rotated segments of the log.
+// The active segment is always plain text: segments are compressed
+// once they're rotated (closed), see Compress.
+// Only gzip is supported (there's no zstd in the standard library)
+type Compression int
+
+const (
+	CompressNone Compression = iota
+	CompressGzip
+)
+
+// Parses a compression's name: none or gzip
+func ParseCompression(name string) (Compression, error) {
+	switch name {
+	case "none", "":
+		return CompressNone, nil
+	case "gzip":
+		return CompressGzip, nil
+	}
+	return CompressNone, fmt.Errorf("Unknown compression: %s (expected none or gzip)", name)
+}
+
+// Extension added to the compressed files
+func (c Compression) Extension() string {
+	if c == CompressGzip {
+		return ".gz"
+	}
+	return ""
+}
+
+// Compresses the file in path into path+extension, removing the original
+// afterwards. The compressed file is written under a temporary name
+// and renamed once complete, so readers never see it partially written
+func compressFile(path string, compression Compression) error {
+	if compression == CompressNone {
+		return nil
+	}
+	source, err := os.Open(path)
+	if err != nil {
+		return fmt.Errorf("An error occurred while compressing a log segment: %w", err)
+	}
+	defer source.Close()
+	target := path + compression.Extension()
+	tmp, err := os.Create(target + ".tmp")
+	if err != nil {
+		return fmt.Errorf("An error occurred while compressing a log segment: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+	writer := gzip.NewWriter(tmp)
+	_, err = io.Copy(writer, source)
+	if closeErr := writer.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), target)
+	}
+	if err == nil {
+		err = os.Remove(path)
+	}
+	if err != nil {
+		return fmt.Errorf("An error occurred while compressing a log segment: %w", err)
+	}
+	return nil
+}
+
+// Whether the path belongs to a compressed segment
+func isCompressed(path string) bool {
+	return strings.HasSuffix(path, CompressGzip.Extension())
+}
+
+// Opens a part of the log for reading, decompressing it if needed
+func openSegment(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil || !isCompressed(path) {
+		return file, err
+	}
+	reader, err := gzip.NewReader(file)
+	if err != nil {
+		file.Close()
+		return nil, fmt.Errorf("An error occurred while decompressing %s: %w", path, err)
+	}
+	return &decompressedFile{Reader: reader, file: file}, nil
+}
+
+// Closes both the decompressor and the underlying file
+type decompressedFile struct {
+	*gzip.Reader
+	file *os.File
+}
+
+func (d *decompressedFile) Close() error {
+	d.Reader.Close()
+	return d.file.Close()
+}
@@ -0,0 +1,203 @@
+package numberserver
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mountolive/numberserver/logformat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type brokenSegmentCase struct {
+	Name string
+	// Breaks the first compressed segment of the log file in path
+	Break func(t *testing.T, path string)
+}
+
+func TestCompression(t *testing.T) {
+	setup := func(t *testing.T) (string, func()) {
+		dir, err := ioutil.TempDir("", "compression")
+		require.NoError(t, err)
+		return filepath.Join(dir, "numbers.log"), func() { os.RemoveAll(dir) }
+	}
+
+	t.Run("Parse Compression", func(t *testing.T) {
+		for name, expected := range map[string]Compression{
+			"none": CompressNone, "": CompressNone, "gzip": CompressGzip,
+		} {
+			compression, err := ParseCompression(name)
+			require.NoError(t, err)
+			assert.Equal(t, expected, compression)
+		}
+		_, err := ParseCompression("rar")
+		assert.Error(t, err)
+	})
+
+	t.Run("Compress and open segment", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		path := segmentPath(logfile, 1)
+		require.NoError(t, ioutil.WriteFile(path, []byte("1\n2\n"), 0644))
+		require.NoError(t, compressFile(path, CompressGzip))
+		_, err := os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "The plain segment should have been removed")
+
+		segment, err := openSegment(path + ".gz")
+		require.NoError(t, err)
+		defer segment.Close()
+		content, err := ioutil.ReadAll(segment)
+		require.NoError(t, err)
+		assert.Equal(t, "1\n2\n", string(content))
+	})
+
+	t.Run("Plain segment preferred while compressing", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		path := segmentPath(logfile, 1)
+		require.NoError(t, ioutil.WriteFile(path, []byte("1\n"), 0644))
+		require.NoError(t, ioutil.WriteFile(path+".gz", []byte("partial"), 0644))
+		require.NoError(t, ioutil.WriteFile(segmentPath(logfile, 2)+".gz", []byte(""), 0644))
+		segments, err := rotatedSegments(logfile)
+		require.NoError(t, err)
+		assert.Equal(t, []logSegment{
+			{Path: path, Seq: 1},
+			{Path: segmentPath(logfile, 2) + ".gz", Seq: 2, Compressed: true},
+		}, segments)
+	})
+
+	t.Run("Rotated segments compressed", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		logger := NewLogger(Filename(logfile), RotateSize(40), KeepSegments(2), Compress(CompressGzip))
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		for i := 0; i < 18; i++ {
+			readStream <- fmt.Sprintf("%09d", i)
+		}
+		close(readStream)
+		require.NoError(t, logger.Wait())
+
+		paths, err := LogSegments(logfile)
+		require.NoError(t, err)
+		assert.Equal(t, []string{segmentPath(logfile, 3) + ".gz", segmentPath(logfile, 4) + ".gz", logfile}, paths)
+
+		// Readers decompress transparently
+		log, err := OpenLog(logfile)
+		require.NoError(t, err)
+		defer log.Close()
+		var lines []string
+		scanner := bufio.NewScanner(log)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		require.Len(t, lines, 10)
+		assert.Equal(t, "000000008", lines[0])
+
+		tracker := NewNumberTracker()
+		report, err := tracker.RecoverFile(logfile, logformat.Text, NewDefaultNumberChecker())
+		require.NoError(t, err)
+		assert.Equal(t, 10, report.Recovered)
+	})
+
+	t.Run("Archiving a pruned segment", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		for seq := 1; seq <= 3; seq++ {
+			require.NoError(t, ioutil.WriteFile(segmentPath(logfile, seq), []byte("1\n"), 0644))
+		}
+		logger := NewLogger(Filename(logfile), RotateSize(40), KeepSegments(1), Compress(CompressGzip))
+		// The segment is already gone (e.g. pruned), the rest is still archived
+		assert.NoError(t, logger.archive(segmentPath(logfile, 4)))
+		paths, err := LogSegments(logfile)
+		require.NoError(t, err)
+		assert.Equal(t, []string{segmentPath(logfile, 3)}, paths)
+	})
+
+	t.Run("Snapshot over compressed segments", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		dir := filepath.Dir(logfile)
+		require.NoError(t, ioutil.WriteFile(logfile, []byte("1\n2\n"), 0644))
+		snapshotter := NewSnapshotter(dir, logfile, logformat.Text, NewDefaultNumberChecker(), NewMapDeduplicator())
+		require.NoError(t, snapshotter.Snapshot())
+		// Rotated and compressed after the snapshot
+		file, err := os.OpenFile(logfile, os.O_APPEND|os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		file.WriteString("3\n")
+		file.Close()
+		require.NoError(t, os.Rename(logfile, segmentPath(logfile, 1)))
+		require.NoError(t, compressFile(segmentPath(logfile, 1), CompressGzip))
+		require.NoError(t, ioutil.WriteFile(logfile, []byte("4\n"), 0644))
+
+		tracker := NewNumberTracker()
+		report, err := NewSnapshotter(dir, logfile, logformat.Text, NewDefaultNumberChecker(), NewMapDeduplicator()).Restore(tracker)
+		require.NoError(t, err)
+		assert.NoError(t, report.SnapshotError)
+		assert.Equal(t, 2, report.Snapshot)
+		assert.Equal(t, 4, report.Recovered)
+		assert.Equal(t, 0, report.Duplicates)
+	})
+
+	t.Run("Snapshot over a truncated compressed segment", func(t *testing.T) {
+		testCases := []brokenSegmentCase{
+			{
+				Name: "Shorter than the offset",
+				Break: func(t *testing.T, path string) {
+					require.NoError(t, ioutil.WriteFile(segmentPath(path, 1), []byte("1\n"), 0644))
+					require.NoError(t, compressFile(segmentPath(path, 1), CompressGzip))
+				},
+			},
+			{
+				Name: "Truncated",
+				Break: func(t *testing.T, path string) {
+					var lines []byte
+					for i := 0; i < 1000; i++ {
+						lines = append(lines, fmt.Sprintf("%d\n", i)...)
+					}
+					require.NoError(t, ioutil.WriteFile(segmentPath(path, 1), lines, 0644))
+					require.NoError(t, compressFile(segmentPath(path, 1), CompressGzip))
+					compressed, err := ioutil.ReadFile(segmentPath(path, 1) + ".gz")
+					require.NoError(t, err)
+					require.NoError(t, ioutil.WriteFile(segmentPath(path, 1)+".gz", compressed[:20], 0644))
+				},
+			},
+			{
+				Name: "Unreadable",
+				Break: func(t *testing.T, path string) {
+					require.NoError(t, ioutil.WriteFile(segmentPath(path, 1)+".gz", []byte("not gzip"), 0644))
+				},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				logfile, cleanup := setup(t)
+				defer cleanup()
+				dir := filepath.Dir(logfile)
+				require.NoError(t, ioutil.WriteFile(logfile, []byte("1\n2\n"), 0644))
+				snapshotter := NewSnapshotter(dir, logfile, logformat.Text, NewDefaultNumberChecker(),
+					NewMapDeduplicator())
+				require.NoError(t, snapshotter.Snapshot())
+				// Rotated after the snapshot, but its compressed file got broken
+				require.NoError(t, os.Remove(logfile))
+				tc.Break(t, logfile)
+				require.NoError(t, ioutil.WriteFile(logfile, []byte("4\n"), 0644))
+
+				tracker := NewNumberTracker()
+				report, err := NewSnapshotter(dir, logfile, logformat.Text, NewDefaultNumberChecker(),
+					NewMapDeduplicator()).Restore(tracker)
+				require.NoError(t, err)
+				assert.True(t, errors.Is(report.SnapshotError, ErrInvalidSnapshot), "Got: %v", report.SnapshotError)
+				assert.Equal(t, 0, report.Snapshot)
+				assert.True(t, tracker.Seen(4))
+				assert.False(t, tracker.Seen(2), "The snapshot's numbers shouldn't be kept")
+			})
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package numberserver
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An active client connection, as listed by Server's Connections
+type ConnectionInfo struct {
+	ID          uint64    `json:"id"`
+	Client      string    `json:"client"`
+	ConnectedAt time.Time `json:"connected_at"`
+	// Lines received so far: unique and duplicate numbers, and invalid ones
+	Received   uint64 `json:"received"`
+	Duplicates uint64 `json:"duplicates"`
+	Invalid    uint64 `json:"invalid"`
+}
+
+// Counters of an active connection
+type connStats struct {
+	// First fields, to keep them 64-bit aligned for atomic ops
+	received    uint64
+	duplicates  uint64
+	invalid     uint64
+	id          uint64
+	client      string
+	connectedAt time.Time
+}
+
+// Counts a number read, either unique or duplicate
+func (c *connStats) numberReceived(unique bool) {
+	if unique {
+		atomic.AddUint64(&c.received, 1)
+	} else {
+		atomic.AddUint64(&c.duplicates, 1)
+	}
+}
+
+func (c *connStats) invalidReceived() {
+	atomic.AddUint64(&c.invalid, 1)
+}
+
+// Active connections of a server, by id
+type connRegistry struct {
+	mu     sync.Mutex
+	active map[uint64]*connStats
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{active: make(map[uint64]*connStats)}
+}
+
+// Registers a connection, returning its counters (see remove)
+func (r *connRegistry) add(id uint64, client string) *connStats {
+	stats := &connStats{id: id, client: client, connectedAt: time.Now()}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.active[id] = stats
+	return stats
+}
+
+func (r *connRegistry) remove(id uint64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	delete(r.active, id)
+}
+
+// Active connections, in order of arrival
+func (r *connRegistry) list() []ConnectionInfo {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	connections := make([]ConnectionInfo, 0, len(r.active))
+	for _, stats := range r.active {
+		connections = append(connections, ConnectionInfo{
+			ID:          stats.id,
+			Client:      stats.client,
+			ConnectedAt: stats.connectedAt,
+			Received:    atomic.LoadUint64(&stats.received),
+			Duplicates:  atomic.LoadUint64(&stats.duplicates),
+			Invalid:     atomic.LoadUint64(&stats.invalid),
+		})
+	}
+	sort.Slice(connections, func(i, j int) bool { return connections[i].ID < connections[j].ID })
+	return connections
+}
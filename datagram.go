@@ -0,0 +1,88 @@
+package numberserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
+)
+
+// Max size of the UDP datagrams, unless set (see ListenConfig's DatagramSize)
+const DEFAULT_DATAGRAM_SIZE = 8192
+
+// Receives datagrams until the packets' connection is closed (any other
+// error cancels the server). Each one carries one or more numbers, one per
+// line, and it's only passed on if all of them are valid: otherwise, or if
+// it was bigger than size (truncated), it's counted and dropped. Nothing is
+// replied, so queries and the termination keyword (which could be spoofed)
+// are invalid lines. Numbers are logged as coming from the sender, on connID
+func serveDatagrams(ctx context.Context, cancel context.CancelFunc, packets net.PacketConn, size int,
+	connID uint64, checker Checker, tracker *NumberTracker, metrics *Metrics,
+	recordInput chan<- logformat.Record) {
+	if size == 0 {
+		size = DEFAULT_DATAGRAM_SIZE
+	}
+	// A byte more, to tell the truncated ones apart
+	buffer := make([]byte, size+1)
+	for {
+		read, sender, err := packets.ReadFrom(buffer)
+		if err != nil {
+			fmt.Printf("The server stopped receiving datagrams (%v) \n", err)
+			if ctx.Err() == nil {
+				cancel()
+			}
+			return
+		}
+		atomic.AddUint64(&metrics.datagrams, 1)
+		atomic.AddUint64(&metrics.bytesRead, uint64(read))
+		if read > size {
+			atomic.AddUint64(&metrics.truncatedDatagrams, 1)
+			continue
+		}
+		numbers, err := datagramNumbers(checker, buffer[:read])
+		if err != nil {
+			atomic.AddUint64(&metrics.invalidDatagrams, 1)
+			continue
+		}
+		receivedAt := time.Now()
+		for _, value := range numbers {
+			// Marking it as seen (only true the first time)
+			unique := tracker.track(value)
+			metrics.received(unique)
+			if !unique {
+				continue
+			}
+			recordInput <- logformat.Record{
+				Number:     uint32(value),
+				ReceivedAt: receivedAt,
+				Client:     sender.String(),
+				ConnID:     connID,
+			}
+		}
+	}
+}
+
+// Numbers of a datagram's lines (the last one can end without a newline),
+// or the error of the first invalid line
+func datagramNumbers(checker Checker, datagram []byte) ([]int, error) {
+	var numbers []int
+	scanner := bufio.NewScanner(bytes.NewReader(datagram))
+	for scanner.Scan() {
+		input := scanner.Text()
+		if err := checker.CheckInput(input); err != nil {
+			return nil, err
+		}
+		value, err := strconv.Atoi(input)
+		if err != nil {
+			return nil, err
+		}
+		numbers = append(numbers, value)
+	}
+	return numbers, scanner.Err()
+}
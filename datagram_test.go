@@ -0,0 +1,110 @@
+package numberserver
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type datagramNumbersCase struct {
+	Name     string
+	Datagram string
+	Expected []int
+	Invalid  bool
+}
+
+func TestDatagrams(t *testing.T) {
+	testCases := []datagramNumbersCase{
+		{Name: "Single number", Datagram: "000000001", Expected: []int{1}},
+		{Name: "Several lines", Datagram: "000000001\n000000002\r\n000000003\n", Expected: []int{1, 2, 3}},
+		{Name: "Empty", Datagram: ""},
+		{Name: "Invalid line", Datagram: "000000001\n0000000x2\n", Invalid: true},
+		{Name: "Empty line", Datagram: "000000001\n\n000000002\n", Invalid: true},
+		{Name: "Termination", Datagram: "terminate\n", Invalid: true},
+	}
+	checker := NewDefaultNumberChecker()
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			numbers, err := datagramNumbers(checker, []byte(tc.Datagram))
+			if tc.Invalid {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.Expected, numbers)
+		})
+	}
+
+	// Starts a server receiving datagrams (up to size bytes), returning
+	// a connection to send them
+	startUDP := func(t *testing.T, size int) (*Server, net.Conn, func()) {
+		config, cleanup := setupServer(t)
+		config.Listen = []ListenConfig{{Network: "udp4", Address: "127.0.0.1:0", DatagramSize: size}}
+		server := startServer(t, config)
+		conn, err := net.Dial("udp4", server.Addr().String())
+		require.NoError(t, err)
+		return server, conn, func() {
+			conn.Close()
+			server.Shutdown(context.Background())
+			cleanup()
+		}
+	}
+	// Waits until the server received that many datagrams
+	received := func(t *testing.T, server *Server, datagrams uint64) {
+		require.Eventually(t, func() bool {
+			return server.Metrics().Snapshot().Datagrams == datagrams
+		}, 5*time.Second, time.Millisecond)
+	}
+
+	t.Run("Numbers received", func(t *testing.T) {
+		server, conn, cleanup := startUDP(t, 0)
+		defer cleanup()
+		_, err := conn.Write([]byte("000000001\n000000002\n"))
+		require.NoError(t, err)
+		_, err = conn.Write([]byte("000000002\n000000003"))
+		require.NoError(t, err)
+		received(t, server, 2)
+		require.Eventually(t, func() bool {
+			return server.Tracker().Seen(1) && server.Tracker().Seen(2) && server.Tracker().Seen(3)
+		}, 5*time.Second, time.Millisecond)
+		snapshot := server.Metrics().Snapshot()
+		assert.Equal(t, uint64(3), snapshot.Unique)
+		assert.Equal(t, uint64(1), snapshot.Duplicates)
+		assert.Equal(t, uint64(0), snapshot.Accepted)
+	})
+
+	t.Run("Invalid datagrams dropped", func(t *testing.T) {
+		server, conn, cleanup := startUDP(t, 0)
+		defer cleanup()
+		_, err := conn.Write([]byte("000000001\nterminate\n"))
+		require.NoError(t, err)
+		received(t, server, 1)
+		// Still receiving (the termination keyword is ignored)
+		_, err = conn.Write([]byte("000000002\n"))
+		require.NoError(t, err)
+		received(t, server, 2)
+		require.Eventually(t, func() bool { return server.Tracker().Seen(2) }, 5*time.Second, time.Millisecond)
+		assert.False(t, server.Tracker().Seen(1))
+		assert.Equal(t, uint64(1), server.Metrics().Snapshot().InvalidDatagrams)
+	})
+
+	t.Run("Truncated datagrams dropped", func(t *testing.T) {
+		server, conn, cleanup := startUDP(t, 20)
+		defer cleanup()
+		_, err := conn.Write([]byte("000000001\n000000002\n000000003\n"))
+		require.NoError(t, err)
+		received(t, server, 1)
+		_, err = conn.Write([]byte("000000004\n000000005\n"))
+		require.NoError(t, err)
+		received(t, server, 2)
+		require.Eventually(t, func() bool { return server.Tracker().Seen(5) }, 5*time.Second, time.Millisecond)
+		assert.False(t, server.Tracker().Seen(1))
+		snapshot := server.Metrics().Snapshot()
+		assert.Equal(t, uint64(1), snapshot.TruncatedDatagrams)
+		assert.Equal(t, uint64(0), snapshot.InvalidDatagrams)
+	})
+}
@@ -0,0 +1,192 @@
+package numberserver
+
+import (
+	"math"
+	"math/bits"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// Backend used by the NumberTracker to keep the set
+// of numbers already seen by the server
+type Deduplicator interface {
+	// Marks the number as seen. Returns true only if
+	// the number wasn't seen before (test-and-set)
+	Add(uint32) bool
+	// Indicates whether the number was already seen
+	Contains(uint32) bool
+	// Forgets the number, as if it was never seen. Returns true
+	// only if it was seen before
+	Remove(uint32) bool
+	// Number of unique numbers seen so far
+	Len() int
+	// Calls the passed function for every number seen, in ascending
+	// order, until it returns false
+	Range(func(uint32) bool)
+}
+
+// Deduplicator backed by a plain map.
+// It's cheap for small sets, but its memory footprint
+// grows quickly with the number of uniques
+type MapDeduplicator struct {
+	sync.Mutex
+	known map[uint32]bool
+}
+
+// Creates an empty MapDeduplicator
+func NewMapDeduplicator() *MapDeduplicator {
+	return &MapDeduplicator{known: make(map[uint32]bool)}
+}
+
+// Marks the number as seen, returns true if it wasn't before
+func (m *MapDeduplicator) Add(input uint32) bool {
+	m.Lock()
+	defer m.Unlock()
+	if m.known[input] {
+		return false
+	}
+	m.known[input] = true
+	return true
+}
+
+// Checks whether the number was already seen
+func (m *MapDeduplicator) Contains(input uint32) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.known[input]
+}
+
+// Forgets the number, returns true if it was seen before
+func (m *MapDeduplicator) Remove(input uint32) bool {
+	m.Lock()
+	defer m.Unlock()
+	if !m.known[input] {
+		return false
+	}
+	delete(m.known, input)
+	return true
+}
+
+// Number of unique numbers kept in the map
+func (m *MapDeduplicator) Len() int {
+	m.Lock()
+	defer m.Unlock()
+	return len(m.known)
+}
+
+// Iterates over the known numbers, in ascending order
+func (m *MapDeduplicator) Range(fn func(uint32) bool) {
+	m.Lock()
+	known := make([]uint32, 0, len(m.known))
+	for value := range m.known {
+		known = append(known, value)
+	}
+	m.Unlock()
+	sort.Slice(known, func(i, j int) bool { return known[i] < known[j] })
+	for _, value := range known {
+		if !fn(value) {
+			return
+		}
+	}
+}
+
+// Deduplicator backed by a dense bitset, one bit per possible number.
+// Its size is fixed on creation (see NewBitsetDeduplicator), so it's meant
+// for bounded domains, like the one defined by NumberChecker's numLimit.
+// Every operation is lock-free (atomic operations over 64 bits words)
+type BitsetDeduplicator struct {
+	// First field, to keep it 64-bit aligned for atomic ops
+	count int64
+	words []uint64
+	size  uint64
+}
+
+// Creates a BitsetDeduplicator able to hold numbers in the range [0, size)
+func NewBitsetDeduplicator(size uint64) *BitsetDeduplicator {
+	return &BitsetDeduplicator{words: make([]uint64, (size+63)/64), size: size}
+}
+
+// Creates a BitsetDeduplicator big enough to hold every number
+// with up to the passed number of digits (9 digits => ~125 MB)
+func NewBitsetDeduplicatorForDigits(digits int) *BitsetDeduplicator {
+	if digits < 0 {
+		digits = 0
+	}
+	return NewBitsetDeduplicator(uint64(math.Pow10(digits)))
+}
+
+// Marks the number as seen, returns true if it wasn't before.
+// Numbers out of the bitset's range are never reported as new
+func (b *BitsetDeduplicator) Add(input uint32) bool {
+	value := uint64(input)
+	if value >= b.size {
+		return false
+	}
+	word := &b.words[value/64]
+	mask := uint64(1) << (value % 64)
+	for {
+		old := atomic.LoadUint64(word)
+		if old&mask != 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(word, old, old|mask) {
+			atomic.AddInt64(&b.count, 1)
+			return true
+		}
+	}
+}
+
+// Checks whether the number was already seen
+func (b *BitsetDeduplicator) Contains(input uint32) bool {
+	value := uint64(input)
+	if value >= b.size {
+		return false
+	}
+	mask := uint64(1) << (value % 64)
+	return atomic.LoadUint64(&b.words[value/64])&mask != 0
+}
+
+// Forgets the number, returns true if it was seen before
+func (b *BitsetDeduplicator) Remove(input uint32) bool {
+	value := uint64(input)
+	if value >= b.size {
+		return false
+	}
+	word := &b.words[value/64]
+	mask := uint64(1) << (value % 64)
+	for {
+		old := atomic.LoadUint64(word)
+		if old&mask == 0 {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(word, old, old&^mask) {
+			atomic.AddInt64(&b.count, -1)
+			return true
+		}
+	}
+}
+
+// Number of bits currently set
+func (b *BitsetDeduplicator) Len() int {
+	return int(atomic.LoadInt64(&b.count))
+}
+
+// Iterates over the bits set, in ascending order
+func (b *BitsetDeduplicator) Range(fn func(uint32) bool) {
+	for index := range b.words {
+		word := atomic.LoadUint64(&b.words[index])
+		for word != 0 {
+			bit := uint64(bits.TrailingZeros64(word))
+			if !fn(uint32(uint64(index)*64 + bit)) {
+				return
+			}
+			word &= word - 1
+		}
+	}
+}
+
+// Capacity of the bitset (numbers in [0, Size()) can be held)
+func (b *BitsetDeduplicator) Size() uint64 {
+	return b.size
+}
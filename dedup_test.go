@@ -0,0 +1,162 @@
+package numberserver
+
+import (
+	"math/rand"
+	"runtime"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+type deduplicatorCase struct {
+	Name    string
+	Backend func() Deduplicator
+}
+
+func dedupBackends() []deduplicatorCase {
+	return []deduplicatorCase{
+		{
+			Name:    "Map",
+			Backend: func() Deduplicator { return NewMapDeduplicator() },
+		},
+		{
+			Name:    "Bitset",
+			Backend: func() Deduplicator { return NewBitsetDeduplicatorForDigits(6) },
+		},
+	}
+}
+
+func TestDeduplicator(t *testing.T) {
+	t.Run("Canary test", func(t *testing.T) {
+		var _ Deduplicator = &MapDeduplicator{}
+		var _ Deduplicator = &BitsetDeduplicator{}
+	})
+
+	for _, tc := range dedupBackends() {
+		t.Run(tc.Name+" Add and Contains", func(t *testing.T) {
+			genericError := "Got: %v, Expected: %v"
+			dedup := tc.Backend()
+			assert.False(t, dedup.Contains(42), genericError, true, false)
+			assert.True(t, dedup.Add(42), genericError, false, true)
+			assert.True(t, dedup.Contains(42), genericError, false, true)
+			assert.False(t, dedup.Add(42), genericError, true, false)
+			assert.True(t, dedup.Add(999999), genericError, false, true)
+			assert.True(t, dedup.Add(0), genericError, false, true)
+			assert.Equal(t, 3, dedup.Len(), genericError, dedup.Len(), 3)
+		})
+
+		t.Run(tc.Name+" Remove", func(t *testing.T) {
+			dedup := tc.Backend()
+			assert.False(t, dedup.Remove(42))
+			dedup.Add(42)
+			dedup.Add(7)
+			assert.True(t, dedup.Remove(42))
+			assert.False(t, dedup.Contains(42))
+			assert.False(t, dedup.Remove(42))
+			assert.Equal(t, 1, dedup.Len())
+			// New again
+			assert.True(t, dedup.Add(42))
+		})
+
+		t.Run(tc.Name+" Range", func(t *testing.T) {
+			dedup := tc.Backend()
+			for _, value := range []uint32{700, 3, 64, 63, 999999} {
+				dedup.Add(value)
+			}
+			var ranged []uint32
+			dedup.Range(func(value uint32) bool {
+				ranged = append(ranged, value)
+				return true
+			})
+			assert.Equal(t, []uint32{3, 63, 64, 700, 999999}, ranged)
+			// Stopping early
+			ranged = nil
+			dedup.Range(func(value uint32) bool {
+				ranged = append(ranged, value)
+				return len(ranged) < 2
+			})
+			assert.Equal(t, []uint32{3, 63}, ranged)
+		})
+
+		t.Run(tc.Name+" Concurrent Add", func(t *testing.T) {
+			dedup := tc.Backend()
+			var wg sync.WaitGroup
+			var mu sync.Mutex
+			newOnes := 0
+			// Every goroutine tries to add the same numbers,
+			// only one of them should succeed per number
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for value := uint32(0); value < 1000; value++ {
+						if dedup.Add(value) {
+							mu.Lock()
+							newOnes++
+							mu.Unlock()
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			assert.Equal(t, 1000, newOnes)
+			assert.Equal(t, 1000, dedup.Len())
+		})
+	}
+
+	t.Run("Bitset out of range", func(t *testing.T) {
+		dedup := NewBitsetDeduplicatorForDigits(2)
+		assert.Equal(t, uint64(100), dedup.Size())
+		assert.True(t, dedup.Add(99))
+		assert.False(t, dedup.Add(100))
+		assert.False(t, dedup.Contains(100))
+		assert.Equal(t, 1, dedup.Len())
+	})
+}
+
+// Reports the heap used after adding b.N random 9 digits numbers
+func benchmarkDedupMemory(b *testing.B, create func() Deduplicator) {
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	dedup := create()
+	for i := 0; i < b.N; i++ {
+		dedup.Add(uint32(rand.Intn(999999999)))
+	}
+	runtime.GC()
+	runtime.ReadMemStats(&after)
+	b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/(1<<20), "heap-MB")
+	runtime.KeepAlive(dedup)
+}
+
+// Measures parallel throughput of Add over random 9 digits numbers
+func benchmarkDedupThroughput(b *testing.B, create func() Deduplicator) {
+	dedup := create()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		random := rand.New(rand.NewSource(rand.Int63()))
+		for pb.Next() {
+			dedup.Add(uint32(random.Intn(999999999)))
+		}
+	})
+}
+
+func newMapBackend() Deduplicator    { return NewMapDeduplicator() }
+func newBitsetBackend() Deduplicator { return NewBitsetDeduplicatorForDigits(9) }
+
+func BenchmarkMapDeduplicatorMemory(b *testing.B) {
+	benchmarkDedupMemory(b, newMapBackend)
+}
+
+func BenchmarkBitsetDeduplicatorMemory(b *testing.B) {
+	benchmarkDedupMemory(b, newBitsetBackend)
+}
+
+func BenchmarkMapDeduplicatorThroughput(b *testing.B) {
+	benchmarkDedupThroughput(b, newMapBackend)
+}
+
+func BenchmarkBitsetDeduplicatorThroughput(b *testing.B) {
+	benchmarkDedupThroughput(b, newBitsetBackend)
+}
@@ -0,0 +1,104 @@
+package numberserver
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Limiter of the concurrent connections, which can be resized while
+// they're being served (see Server's Reload). Shrinking it doesn't close
+// any connection: new ones wait until the active ones go below the max
+type connLimiter struct {
+	mu     sync.Mutex
+	max    int
+	active int
+	// Closed (and replaced) whenever a place might have been freed
+	changed chan struct{}
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max, changed: make(chan struct{})}
+}
+
+// Takes a place if there's one free
+func (l *connLimiter) tryAcquire() bool {
+	acquired, _ := l.poll()
+	return acquired
+}
+
+// Waits for a place, until ctx is done or the timeout fires
+// (a nil timeout never fires). Returns whether it was taken
+func (l *connLimiter) acquire(ctx context.Context, timeout <-chan time.Time) bool {
+	for {
+		acquired, changed := l.poll()
+		if acquired {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-timeout:
+			return false
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Waits until there's a free place, without taking it,
+// or until ctx is done. Returns whether there's one
+func (l *connLimiter) wait(ctx context.Context) bool {
+	for {
+		l.mu.Lock()
+		free, changed := l.active < l.max, l.changed
+		l.mu.Unlock()
+		if free {
+			return true
+		}
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// Takes a place if there's one free, otherwise returns
+// the channel closed once there might be one
+func (l *connLimiter) poll() (bool, <-chan struct{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.active < l.max {
+		l.active++
+		return true, nil
+	}
+	return false, l.changed
+}
+
+func (l *connLimiter) release() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.active--
+	l.notify()
+}
+
+// Changes the max of concurrent connections
+func (l *connLimiter) resize(max int) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.max = max
+	l.notify()
+}
+
+// Current max of concurrent connections
+func (l *connLimiter) limit() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.max
+}
+
+// Wakes up the waiters. Must be called holding mu
+func (l *connLimiter) notify() {
+	close(l.changed)
+	l.changed = make(chan struct{})
+}
@@ -0,0 +1,75 @@
+package numberserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestConnLimiter(t *testing.T) {
+	t.Run("Try acquire", func(t *testing.T) {
+		limiter := newConnLimiter(2)
+		assert.True(t, limiter.tryAcquire())
+		assert.True(t, limiter.tryAcquire())
+		assert.False(t, limiter.tryAcquire())
+		limiter.release()
+		assert.True(t, limiter.tryAcquire())
+	})
+
+	t.Run("Acquire waits for a release", func(t *testing.T) {
+		limiter := newConnLimiter(1)
+		assert.True(t, limiter.tryAcquire())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			limiter.release()
+		}()
+		assert.True(t, limiter.acquire(context.Background(), nil))
+	})
+
+	t.Run("Acquire times out", func(t *testing.T) {
+		limiter := newConnLimiter(0)
+		assert.False(t, limiter.acquire(context.Background(), time.After(20*time.Millisecond)))
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.False(t, limiter.acquire(ctx, nil))
+	})
+
+	t.Run("Wait for a free place", func(t *testing.T) {
+		limiter := newConnLimiter(1)
+		assert.True(t, limiter.tryAcquire())
+		go func() {
+			time.Sleep(20 * time.Millisecond)
+			limiter.release()
+		}()
+		assert.True(t, limiter.wait(context.Background()))
+		// The place is still free
+		assert.True(t, limiter.wait(context.Background()))
+		assert.True(t, limiter.tryAcquire())
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		assert.False(t, limiter.wait(ctx))
+	})
+
+	t.Run("Resize", func(t *testing.T) {
+		limiter := newConnLimiter(1)
+		assert.True(t, limiter.tryAcquire())
+		acquired := make(chan bool)
+		go func() {
+			acquired <- limiter.acquire(context.Background(), nil)
+		}()
+		// Growing it lets the waiter in
+		limiter.resize(2)
+		assert.True(t, <-acquired)
+		assert.Equal(t, 2, limiter.limit())
+		// Shrinking it keeps the active ones, but no new one gets in
+		// until they go below the new max
+		limiter.resize(1)
+		assert.False(t, limiter.tryAcquire())
+		limiter.release()
+		assert.False(t, limiter.tryAcquire())
+		limiter.release()
+		assert.True(t, limiter.tryAcquire())
+	})
+}
@@ -0,0 +1,213 @@
+package numberserver
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// An address the server listens to (see Config's Listen)
+type ListenConfig struct {
+	// tcp, tcp4, tcp6, unix, or udp, udp4 or udp6 (see serveDatagrams)
+	Network string
+	// host:port, or the socket's path
+	Address string
+	// Permissions of a Unix socket (0 keeps the default ones)
+	Mode os.FileMode
+	// Max concurrent connections of its own (0 shares Config's MaxConn)
+	MaxConn int
+	// Max size of the UDP datagrams (DEFAULT_DATAGRAM_SIZE if 0)
+	DatagramSize int
+}
+
+// Parses a listen definition, as passed to the --listen flag:
+//
+//	<address>[,mode=<octal permissions>][,maxconn=<connections>][,size=<bytes>]
+//
+// where address is host:port (TCP), tcp://host:port, tcp4://host:port,
+// tcp6://[host]:port, unix://<socket path> or udp://host:port (also udp4
+// and udp6). Modes only apply to sockets, and sizes to UDP, which has no
+// connections to limit
+func ParseListen(definition string) (ListenConfig, error) {
+	parts := strings.Split(definition, ",")
+	listen := ListenConfig{Network: "tcp", Address: parts[0]}
+	if separator := strings.Index(parts[0], "://"); separator >= 0 {
+		listen.Network, listen.Address = parts[0][:separator], parts[0][separator+3:]
+	}
+	switch listen.Network {
+	case "tcp", "tcp4", "tcp6", "udp", "udp4", "udp6":
+		if _, _, err := net.SplitHostPort(listen.Address); err != nil {
+			return listen, fmt.Errorf("Invalid address to listen to: %s (expected host:port)", listen.Address)
+		}
+	case "unix":
+		if listen.Address == "" {
+			return listen, fmt.Errorf("Invalid address to listen to: %s (expected unix://<socket path>)", definition)
+		}
+	default:
+		return listen, fmt.Errorf("Unknown network to listen to: %s (expected tcp, tcp4, tcp6, unix, udp, udp4 or udp6)",
+			listen.Network)
+	}
+	for _, option := range parts[1:] {
+		name, value := option, ""
+		if separator := strings.Index(option, "="); separator >= 0 {
+			name, value = option[:separator], option[separator+1:]
+		}
+		switch name {
+		case "mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil || mode > 0777 || listen.Network != "unix" {
+				return listen, fmt.Errorf("Invalid mode of %s: %s (expected octal permissions of a unix socket)",
+					parts[0], value)
+			}
+			listen.Mode = os.FileMode(mode)
+		case "maxconn":
+			maxConn, err := strconv.Atoi(value)
+			if err != nil || maxConn < 0 || listen.datagrams() {
+				return listen, fmt.Errorf("Invalid maxconn of %s: %s", parts[0], value)
+			}
+			listen.MaxConn = maxConn
+		case "size":
+			size, err := strconv.Atoi(value)
+			if err != nil || size <= 0 || !listen.datagrams() {
+				return listen, fmt.Errorf("Invalid size of %s: %s (expected the bytes of a udp datagram)",
+					parts[0], value)
+			}
+			listen.DatagramSize = size
+		default:
+			return listen, fmt.Errorf("Unknown option of %s: %s (expected mode, maxconn or size)", parts[0], option)
+		}
+	}
+	return listen, nil
+}
+
+func (l ListenConfig) String() string {
+	return l.Network + "://" + l.Address
+}
+
+// Whether it receives UDP datagrams instead of connections
+func (l ListenConfig) datagrams() bool {
+	return strings.HasPrefix(l.Network, "udp")
+}
+
+// Starts receiving the datagrams sent to the address
+func (l ListenConfig) listenPacket() (net.PacketConn, error) {
+	packets, err := net.ListenPacket(l.Network, l.Address)
+	if err != nil {
+		return nil, fmt.Errorf("An error occurred when trying to create the connection: %w", err)
+	}
+	return packets, nil
+}
+
+// Starts listening to the address
+func (l ListenConfig) listen() (net.Listener, error) {
+	if l.Network == "unix" {
+		return listenUnix(l.Address, l.Mode)
+	}
+	listener, err := net.Listen(l.Network, l.Address)
+	if err != nil {
+		return nil, fmt.Errorf("An error occurred when trying to create the connection: %w", err)
+	}
+	return listener, nil
+}
+
+// Listens to the Unix socket at path, setting its permissions (unless
+// mode is 0). The socket is bound inside a new directory only accessible
+// by the user running the server, and moved to path once it has its
+// permissions, so it's never reachable by others in between.
+// A stale one left behind (e.g. after a crash) is removed
+func listenUnix(path string, mode os.FileMode) (net.Listener, error) {
+	if info, err := os.Lstat(path); err == nil && info.Mode()&os.ModeSocket != 0 {
+		os.Remove(path)
+	}
+	if mode == 0 {
+		listener, err := net.Listen("unix", path)
+		if err != nil {
+			return nil, fmt.Errorf("An error occurred when trying to create the socket %s: %w", path, err)
+		}
+		return listener, nil
+	}
+	fail := func(err error) (net.Listener, error) {
+		return nil, fmt.Errorf("An error occurred when trying to create the socket %s: %w", path, err)
+	}
+	// Not replacing anything else (as binding to path wouldn't)
+	if _, err := os.Lstat(path); err == nil {
+		return fail(os.ErrExist)
+	}
+	dir, err := ioutil.TempDir(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return fail(err)
+	}
+	defer os.RemoveAll(dir)
+	bound := filepath.Join(dir, "s")
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: bound, Net: "unix"})
+	if err != nil {
+		return fail(err)
+	}
+	// Removed from path instead (see unixListener)
+	listener.SetUnlinkOnClose(false)
+	if err := os.Chmod(bound, mode); err != nil {
+		listener.Close()
+		return fail(err)
+	}
+	if err := os.Rename(bound, path); err != nil {
+		listener.Close()
+		return fail(err)
+	}
+	return &unixListener{UnixListener: listener, path: path}, nil
+}
+
+// Unix socket listener moved to path after binding it (see listenUnix)
+type unixListener struct {
+	*net.UnixListener
+	path string
+}
+
+func (l *unixListener) Addr() net.Addr {
+	return &net.UnixAddr{Name: l.path, Net: "unix"}
+}
+
+// Removes the socket and stops listening (removing it first, so it's
+// gone by the time Accept fails)
+func (l *unixListener) Close() error {
+	os.Remove(l.path)
+	return l.UnixListener.Close()
+}
+
+// A listener of serve, along with the limiter of its connections
+// (serveOptions' Limiter if nil, see ListenConfig's MaxConn).
+// UDP ones receive packets instead, up to datagramSize bytes
+type servedListener struct {
+	listener     net.Listener
+	limiter      *connLimiter
+	packets      net.PacketConn
+	datagramSize int
+}
+
+func (l servedListener) addr() net.Addr {
+	if l.packets != nil {
+		return l.packets.LocalAddr()
+	}
+	return l.listener.Addr()
+}
+
+func (l servedListener) Close() error {
+	if l.packets != nil {
+		return l.packets.Close()
+	}
+	return l.listener.Close()
+}
+
+// Name of a connection's client: its address, or the socket's path
+// for Unix sockets (their clients are usually unnamed)
+func clientName(conn net.Conn) string {
+	if remote := conn.RemoteAddr(); remote != nil {
+		if client := remote.String(); client != "" && client != "@" {
+			return client
+		}
+	}
+	return conn.LocalAddr().Network() + ":" + conn.LocalAddr().String()
+}
@@ -0,0 +1,235 @@
+package numberserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type parseListenCase struct {
+	Name       string
+	Definition string
+	Expected   ListenConfig
+	Invalid    bool
+}
+
+func TestParseListen(t *testing.T) {
+	testCases := []parseListenCase{
+		{
+			Name:       "Host and port",
+			Definition: "127.0.0.1:4000",
+			Expected:   ListenConfig{Network: "tcp", Address: "127.0.0.1:4000"},
+		},
+		{
+			Name:       "IPv4 only",
+			Definition: "tcp4://0.0.0.0:4000,maxconn=10",
+			Expected:   ListenConfig{Network: "tcp4", Address: "0.0.0.0:4000", MaxConn: 10},
+		},
+		{
+			Name:       "IPv6 only",
+			Definition: "tcp6://[::1]:4000",
+			Expected:   ListenConfig{Network: "tcp6", Address: "[::1]:4000"},
+		},
+		{
+			Name:       "Unix socket",
+			Definition: "unix:///run/numberserver.sock,mode=0660,maxconn=2",
+			Expected:   ListenConfig{Network: "unix", Address: "/run/numberserver.sock", Mode: 0660, MaxConn: 2},
+		},
+		{
+			Name:       "UDP",
+			Definition: "udp://0.0.0.0:4000,size=1472",
+			Expected:   ListenConfig{Network: "udp", Address: "0.0.0.0:4000", DatagramSize: 1472},
+		},
+		{Name: "Missing port", Definition: "127.0.0.1", Invalid: true},
+		{Name: "Unknown network", Definition: "sctp://127.0.0.1:4000", Invalid: true},
+		{Name: "Maxconn of UDP", Definition: "udp://127.0.0.1:4000,maxconn=2", Invalid: true},
+		{Name: "Size of a TCP address", Definition: "127.0.0.1:4000,size=1472", Invalid: true},
+		{Name: "Missing socket path", Definition: "unix://", Invalid: true},
+		{Name: "Mode of a TCP address", Definition: "127.0.0.1:4000,mode=0660", Invalid: true},
+		{Name: "Invalid mode", Definition: "unix:///tmp/s.sock,mode=0999", Invalid: true},
+		{Name: "Invalid maxconn", Definition: "127.0.0.1:4000,maxconn=-1", Invalid: true},
+		{Name: "Unknown option", Definition: "127.0.0.1:4000,backlog=10", Invalid: true},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			listen, err := ParseListen(tc.Definition)
+			if tc.Invalid {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tc.Expected, listen)
+		})
+	}
+}
+
+func TestListeners(t *testing.T) {
+	// Sets up a server listening to TCP and to a Unix socket
+	setupListeners := func(t *testing.T, socket string) (Config, string, func()) {
+		config, cleanup := setupServer(t)
+		path := filepath.Join(filepath.Dir(config.Logfile), "numbers.sock")
+		listen, err := ParseListen("unix://" + path + socket)
+		require.NoError(t, err)
+		config.Listen = []ListenConfig{{Network: "tcp4", Address: "127.0.0.1:0"}, listen}
+		return config, path, cleanup
+	}
+
+	t.Run("Same tracker", func(t *testing.T) {
+		config, path, cleanup := setupListeners(t, ",mode=0660")
+		defer cleanup()
+		server := startServer(t, config)
+		addrs := server.Addrs()
+		require.Len(t, addrs, 2)
+		assert.Equal(t, addrs[0], server.Addr())
+		assert.Equal(t, path, addrs[1].String())
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0660), info.Mode().Perm())
+		sendLines(t, server, "000000001").Close()
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		fmt.Fprintln(conn, "000000002")
+		conn.Close()
+		require.Eventually(t, func() bool {
+			return server.Tracker().Seen(1) && server.Tracker().Seen(2)
+		}, 5*time.Second, time.Millisecond)
+		require.NoError(t, server.Shutdown(context.Background()))
+		// The socket is removed once closed
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Own maxconn", func(t *testing.T) {
+		config, path, cleanup := setupListeners(t, ",maxconn=1")
+		defer cleanup()
+		config.MaxConn = 5
+		config.Overload = OverloadReject
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		first, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		defer first.Close()
+		fmt.Fprintln(first, "000000001")
+		require.Eventually(t, func() bool { return server.Tracker().Seen(1) }, 5*time.Second, time.Millisecond)
+		// The socket's only connection is taken, but not the shared ones
+		second, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		defer second.Close()
+		second.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reply, _ := bufio.NewReader(second).ReadString('\n')
+		assert.Equal(t, SERVER_BUSY_REPLY, reply)
+		third := sendLines(t, server, "000000003")
+		defer third.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Seen(3) }, 5*time.Second, time.Millisecond)
+	})
+
+	t.Run("Shared maxconn", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		config.MaxConn = 1
+		config.Overload = OverloadBlock
+		config.Listen = []ListenConfig{
+			{Network: "tcp4", Address: "127.0.0.1:0"},
+			{Network: "tcp4", Address: "127.0.0.1:0"},
+			{Network: "tcp4", Address: "127.0.0.1:0"},
+		}
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		addrs := server.Addrs()
+		send := func(t *testing.T, addr net.Addr, number string) net.Conn {
+			conn, err := net.Dial("tcp4", addr.String())
+			require.NoError(t, err)
+			fmt.Fprintln(conn, number)
+			return conn
+		}
+		// Idle listeners hold no place
+		first := send(t, addrs[0], "000000001")
+		require.Eventually(t, func() bool { return server.Tracker().Seen(1) }, 5*time.Second, time.Millisecond)
+		// Waiting for the first one to leave
+		second := send(t, addrs[2], "000000002")
+		defer second.Close()
+		time.Sleep(50 * time.Millisecond)
+		assert.False(t, server.Tracker().Seen(2))
+		first.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Seen(2) }, 5*time.Second, time.Millisecond)
+		second.Close()
+		third := send(t, addrs[1], "000000003")
+		defer third.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Seen(3) }, 5*time.Second, time.Millisecond)
+	})
+
+	t.Run("Socket moved into place", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		dir := filepath.Dir(config.Logfile)
+		path := filepath.Join(dir, "numbers.sock")
+		listener, err := listenUnix(path, 0600)
+		require.NoError(t, err)
+		defer listener.Close()
+		assert.Equal(t, path, listener.Addr().String())
+		info, err := os.Stat(path)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		// Nothing is left of the directory it was bound in
+		entries, err := ioutil.ReadDir(dir)
+		require.NoError(t, err)
+		require.Len(t, entries, 1)
+		assert.Equal(t, "numbers.sock", entries[0].Name())
+		go func() {
+			if conn, err := listener.Accept(); err == nil {
+				conn.Close()
+			}
+		}()
+		conn, err := net.Dial("unix", path)
+		require.NoError(t, err)
+		conn.Close()
+		require.NoError(t, listener.Close())
+		_, err = os.Stat(path)
+		assert.True(t, os.IsNotExist(err), "The socket should be removed once closed")
+
+		// Other files aren't replaced
+		taken := filepath.Join(dir, "taken.sock")
+		require.NoError(t, ioutil.WriteFile(taken, []byte("data"), 0644))
+		_, err = listenUnix(taken, 0600)
+		assert.Error(t, err)
+		content, err := ioutil.ReadFile(taken)
+		require.NoError(t, err)
+		assert.Equal(t, "data", string(content))
+	})
+
+	t.Run("Address in use", func(t *testing.T) {
+		config, _, cleanup := setupListeners(t, "")
+		defer cleanup()
+		taken, err := net.Listen("tcp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		defer taken.Close()
+		config.Listen = append(config.Listen, ListenConfig{Network: "tcp4", Address: taken.Addr().String()})
+		server, err := NewServer(config)
+		require.NoError(t, err)
+		startErr := server.Start(context.Background())
+		assert.Error(t, startErr)
+		// Nothing is left listening
+		assert.Nil(t, server.Addr())
+		_, err = os.Stat(config.Listen[1].Address)
+		assert.True(t, os.IsNotExist(err))
+		// Waiting doesn't block, and starting again fails the same way
+		waited := make(chan error)
+		go func() { waited <- server.Wait() }()
+		select {
+		case err := <-waited:
+			assert.Equal(t, startErr, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Wait blocked after Start failed")
+		}
+		assert.Equal(t, startErr, server.Start(context.Background()))
+	})
+}
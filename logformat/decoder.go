@@ -0,0 +1,159 @@
+package logformat
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reads back the records written in a given format
+type Decoder struct {
+	reader *bufio.Reader
+	format Format
+	// Bytes consumed by the records decoded so far (corrupt ones included)
+	offset int64
+	// When set, an incomplete record at the end of the stream is reported
+	// as ErrTruncated (and not consumed). Otherwise, a final line without
+	// delimiter is decoded as any other one (like bufio.Scanner does)
+	Strict bool
+}
+
+// Creates a Decoder reading records in the passed format
+func NewDecoder(reader io.Reader, format Format) *Decoder {
+	return &Decoder{reader: bufio.NewReader(reader), format: format}
+}
+
+// Bytes of the stream consumed so far
+func (d *Decoder) Offset() int64 {
+	return d.offset
+}
+
+// Skips the first n bytes of the stream
+// (they're counted in the Offset, too)
+func (d *Decoder) Skip(n int64) error {
+	skipped, err := io.CopyN(ioutil.Discard, d.reader, n)
+	d.offset += skipped
+	if err == io.EOF {
+		return fmt.Errorf("%w: stream is shorter than %d bytes", ErrTruncated, n)
+	}
+	return err
+}
+
+// Decodes the next record. Returns io.EOF once the stream is over,
+// a wrapped ErrCorrupt for records that can't be decoded
+// and a wrapped ErrTruncated (see Strict)
+func (d *Decoder) Decode() (Record, error) {
+	if d.format == Binary {
+		return d.decodeBinary()
+	}
+	line, err := d.reader.ReadBytes('\n')
+	if err == io.EOF {
+		if len(line) == 0 {
+			return Record{}, io.EOF
+		}
+		if d.Strict {
+			return Record{}, fmt.Errorf("%w: %q", ErrTruncated, line)
+		}
+	} else if err != nil {
+		return Record{}, err
+	}
+	d.offset += int64(len(line))
+	text := strings.TrimSuffix(string(line), "\n")
+	switch d.format {
+	case JSONLines:
+		return decodeJSON(text)
+	case CSV:
+		return decodeCSV(text)
+	}
+	return decodeText(text)
+}
+
+func (d *Decoder) decodeBinary() (Record, error) {
+	encoded := make([]byte, 4)
+	read, err := io.ReadFull(d.reader, encoded)
+	if err == io.EOF {
+		return Record{}, io.EOF
+	}
+	if err == io.ErrUnexpectedEOF {
+		if !d.Strict {
+			d.offset += int64(read)
+		}
+		return Record{}, fmt.Errorf("%w: %d trailing bytes", ErrTruncated, read)
+	}
+	if err != nil {
+		return Record{}, err
+	}
+	d.offset += 4
+	return Record{Number: binary.LittleEndian.Uint32(encoded)}, nil
+}
+
+func decodeText(text string) (Record, error) {
+	number, err := parseNumber(text)
+	if err != nil {
+		return Record{}, err
+	}
+	return Record{Number: number}, nil
+}
+
+func decodeJSON(text string) (Record, error) {
+	var decoded jsonRecord
+	if err := json.Unmarshal([]byte(text), &decoded); err != nil || decoded.Number == nil {
+		return Record{}, fmt.Errorf("%w: %q", ErrCorrupt, text)
+	}
+	receivedAt, err := parseTime(decoded.ReceivedAt)
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: %q", ErrCorrupt, text)
+	}
+	return Record{
+		Number:     *decoded.Number,
+		ReceivedAt: receivedAt,
+		Client:     decoded.Client,
+		ConnID:     decoded.ConnID,
+	}, nil
+}
+
+func decodeCSV(text string) (Record, error) {
+	fields, err := csv.NewReader(strings.NewReader(text)).Read()
+	if err != nil || len(fields) != 4 {
+		return Record{}, fmt.Errorf("%w: %q", ErrCorrupt, text)
+	}
+	number, err := parseNumber(fields[0])
+	if err != nil {
+		return Record{}, err
+	}
+	receivedAt, err := parseTime(fields[1])
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: %q", ErrCorrupt, text)
+	}
+	connID, err := strconv.ParseUint(fields[3], 10, 64)
+	if err != nil {
+		return Record{}, fmt.Errorf("%w: %q", ErrCorrupt, text)
+	}
+	return Record{Number: number, ReceivedAt: receivedAt, Client: fields[2], ConnID: connID}, nil
+}
+
+// Parses a decimal number (digits only, leading zeros allowed)
+func parseNumber(text string) (uint32, error) {
+	if text == "" || strings.TrimLeft(text, "0123456789") != "" {
+		return 0, fmt.Errorf("%w: %q", ErrCorrupt, text)
+	}
+	number, err := strconv.ParseUint(text, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %q", ErrCorrupt, text)
+	}
+	return uint32(number), nil
+}
+
+func parseTime(text string) (time.Time, error) {
+	if text == "" {
+		return time.Time{}, nil
+	}
+	return time.Parse(time.RFC3339Nano, text)
+}
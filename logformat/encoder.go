@@ -0,0 +1,95 @@
+package logformat
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Encodes records, each of them including its delimiter (if any)
+type Encoder interface {
+	Encode(Record) []byte
+}
+
+// Creates an Encoder for the passed format. Text numbers are
+// zero-padded up to digits (no padding if digits <= 0)
+func NewEncoder(format Format, digits int) Encoder {
+	switch format {
+	case JSONLines:
+		return jsonEncoder{}
+	case CSV:
+		return csvEncoder{}
+	case Binary:
+		return binaryEncoder{}
+	}
+	return textEncoder{digits: digits}
+}
+
+type textEncoder struct {
+	digits int
+}
+
+func (t textEncoder) Encode(record Record) []byte {
+	number := strconv.FormatUint(uint64(record.Number), 10)
+	if missing := t.digits - len(number); missing > 0 {
+		number = strings.Repeat("0", missing) + number
+	}
+	return []byte(number + "\n")
+}
+
+// JSON Lines representation of a Record
+type jsonRecord struct {
+	Number     *uint32 `json:"number"`
+	ReceivedAt string  `json:"received_at,omitempty"`
+	Client     string  `json:"client,omitempty"`
+	ConnID     uint64  `json:"conn_id,omitempty"`
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) Encode(record Record) []byte {
+	encoded, _ := json.Marshal(jsonRecord{
+		Number:     &record.Number,
+		ReceivedAt: formatTime(record.ReceivedAt),
+		Client:     record.Client,
+		ConnID:     record.ConnID,
+	})
+	return append(encoded, '\n')
+}
+
+type csvEncoder struct{}
+
+func (csvEncoder) Encode(record Record) []byte {
+	fields := []string{
+		strconv.FormatUint(uint64(record.Number), 10),
+		formatTime(record.ReceivedAt),
+		csvQuote(record.Client),
+		strconv.FormatUint(record.ConnID, 10),
+	}
+	return []byte(strings.Join(fields, ",") + "\n")
+}
+
+type binaryEncoder struct{}
+
+func (binaryEncoder) Encode(record Record) []byte {
+	encoded := make([]byte, 4)
+	binary.LittleEndian.PutUint32(encoded, record.Number)
+	return encoded
+}
+
+func formatTime(moment time.Time) string {
+	if moment.IsZero() {
+		return ""
+	}
+	return moment.UTC().Format(time.RFC3339Nano)
+}
+
+// Quotes a CSV field, if needed
+func csvQuote(field string) string {
+	if !strings.ContainsAny(field, ",\"\r\n") {
+		return field
+	}
+	return `"` + strings.Replace(field, `"`, `""`, -1) + `"`
+}
@@ -0,0 +1,82 @@
+// Package logformat holds the encodings the number server can write its
+// log in, along with the decoder needed to read them back.
+package logformat
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// A unique number received by the server, along with its metadata
+type Record struct {
+	Number uint32
+	// When the number was read from the client
+	ReceivedAt time.Time
+	// Client's address and the server's id for its connection
+	Client string
+	ConnID uint64
+}
+
+// Encoding of the records in the log
+type Format int
+
+const (
+	// One zero-padded number per line (metadata is not kept)
+	Text Format = iota
+	// One JSON object per line:
+	// {"number":42,"received_at":"...","client":"127.0.0.1:5000","conn_id":1}
+	JSONLines
+	// One record per line: number,received_at,client,conn_id (no header)
+	CSV
+	// Fixed 4 bytes little-endian numbers, no delimiters (metadata is not kept)
+	Binary
+)
+
+// Returned (wrapped) when a record can't be decoded.
+// The decoder moves on past the corrupt record
+var ErrCorrupt = errors.New("corrupt record")
+
+// Returned (wrapped) by a strict decoder when the stream ends
+// in the middle of a record
+var ErrTruncated = errors.New("truncated record")
+
+// Parses a format's name: text, jsonl, csv or binary
+func ParseFormat(name string) (Format, error) {
+	switch name {
+	case "text", "":
+		return Text, nil
+	case "jsonl", "json":
+		return JSONLines, nil
+	case "csv":
+		return CSV, nil
+	case "binary":
+		return Binary, nil
+	}
+	return Text, fmt.Errorf("Unknown log format: %s (expected text, jsonl, csv or binary)", name)
+}
+
+func (f Format) String() string {
+	switch f {
+	case JSONLines:
+		return "jsonl"
+	case CSV:
+		return "csv"
+	case Binary:
+		return "binary"
+	}
+	return "text"
+}
+
+// MIME type of the encoded records
+func (f Format) ContentType() string {
+	switch f {
+	case JSONLines:
+		return "application/x-ndjson"
+	case CSV:
+		return "text/csv"
+	case Binary:
+		return "application/octet-stream"
+	}
+	return "text/plain"
+}
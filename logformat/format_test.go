@@ -0,0 +1,163 @@
+package logformat
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type encodeCase struct {
+	Name     string
+	Format   Format
+	Digits   int
+	Expected string
+}
+
+type decodeCase struct {
+	Name     string
+	Format   Format
+	Input    string
+	Numbers  []uint32
+	Corrupt  int
+	Strict   bool
+	Trailing bool
+}
+
+// Decodes every record of input, counting the corrupt ones
+func decodeAll(t *testing.T, decoder *Decoder) ([]Record, int, error) {
+	var records []Record
+	corrupt := 0
+	for {
+		record, err := decoder.Decode()
+		switch {
+		case err == io.EOF:
+			return records, corrupt, nil
+		case errors.Is(err, ErrCorrupt):
+			corrupt++
+		case err != nil:
+			return records, corrupt, err
+		default:
+			records = append(records, record)
+		}
+	}
+}
+
+func TestLogFormat(t *testing.T) {
+	receivedAt := time.Date(2020, 7, 1, 12, 30, 0, 5000, time.UTC)
+	record := Record{Number: 4207, ReceivedAt: receivedAt, Client: "127.0.0.1:5555", ConnID: 3}
+
+	t.Run("Parse Format", func(t *testing.T) {
+		for name, expected := range map[string]Format{
+			"text": Text, "": Text, "jsonl": JSONLines, "csv": CSV, "binary": Binary,
+		} {
+			format, err := ParseFormat(name)
+			require.NoError(t, err)
+			assert.Equal(t, expected, format)
+			if name != "" {
+				assert.Equal(t, name, format.String())
+			}
+		}
+		_, err := ParseFormat("xml")
+		assert.Error(t, err)
+	})
+
+	t.Run("Encode", func(t *testing.T) {
+		testCases := []encodeCase{
+			{Name: "Text", Format: Text, Digits: 9, Expected: "000004207\n"},
+			{Name: "Text without padding", Format: Text, Expected: "4207\n"},
+			{Name: "JSON Lines", Format: JSONLines, Expected: `{"number":4207,` +
+				`"received_at":"2020-07-01T12:30:00.000005Z","client":"127.0.0.1:5555","conn_id":3}` + "\n"},
+			{Name: "CSV", Format: CSV, Expected: "4207,2020-07-01T12:30:00.000005Z,127.0.0.1:5555,3\n"},
+			{Name: "Binary", Format: Binary, Expected: "\x6f\x10\x00\x00"},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				encoded := NewEncoder(tc.Format, tc.Digits).Encode(record)
+				assert.Equal(t, tc.Expected, string(encoded))
+			})
+		}
+	})
+
+	t.Run("Round trip", func(t *testing.T) {
+		for _, format := range []Format{Text, JSONLines, CSV, Binary} {
+			t.Run(format.String(), func(t *testing.T) {
+				var buffer bytes.Buffer
+				encoder := NewEncoder(format, 9)
+				records := []Record{record, {Number: 0, ReceivedAt: receivedAt, Client: "[::1]:80", ConnID: 1},
+					{Number: 999999999, Client: `odd,"client"`}}
+				for _, r := range records {
+					buffer.Write(encoder.Encode(r))
+				}
+				decoder := NewDecoder(&buffer, format)
+				decoded, corrupt, err := decodeAll(t, decoder)
+				require.NoError(t, err)
+				assert.Equal(t, 0, corrupt)
+				require.Len(t, decoded, len(records))
+				for i, r := range records {
+					assert.Equal(t, r.Number, decoded[i].Number)
+					// Only JSON Lines and CSV keep the metadata
+					if format == JSONLines || format == CSV {
+						assert.True(t, r.ReceivedAt.Equal(decoded[i].ReceivedAt))
+						assert.Equal(t, r.Client, decoded[i].Client)
+						assert.Equal(t, r.ConnID, decoded[i].ConnID)
+					}
+				}
+			})
+		}
+	})
+
+	t.Run("Decode", func(t *testing.T) {
+		testCases := []decodeCase{
+			{Name: "Unpadded text", Format: Text, Input: "42\n000000043\n", Numbers: []uint32{42, 43}},
+			{Name: "Corrupt text", Format: Text, Input: "42\nterminate\n\n12a\n99999999999\n43\n",
+				Numbers: []uint32{42, 43}, Corrupt: 4},
+			{Name: "Unterminated text", Format: Text, Input: "42\n43", Numbers: []uint32{42, 43}},
+			{Name: "Unterminated text (strict)", Format: Text, Input: "42\n43", Numbers: []uint32{42},
+				Strict: true, Trailing: true},
+			{Name: "Corrupt JSON Lines", Format: JSONLines, Input: "{\"number\":1}\n{}\n{\"number\":\"2\"}\nnope\n",
+				Numbers: []uint32{1}, Corrupt: 3},
+			{Name: "Corrupt CSV", Format: CSV, Input: "1,,,0\n2,yesterday,,0\n3\n4,,,x\n",
+				Numbers: []uint32{1}, Corrupt: 3},
+			{Name: "Truncated binary", Format: Binary, Input: "\x01\x00\x00\x00\x02\x00", Numbers: []uint32{1},
+				Trailing: true},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				decoder := NewDecoder(strings.NewReader(tc.Input), tc.Format)
+				decoder.Strict = tc.Strict
+				records, corrupt, err := decodeAll(t, decoder)
+				if tc.Trailing {
+					assert.True(t, errors.Is(err, ErrTruncated), "Expected a truncated record, got: %v", err)
+				} else {
+					require.NoError(t, err)
+				}
+				numbers := make([]uint32, 0, len(records))
+				for _, r := range records {
+					numbers = append(numbers, r.Number)
+				}
+				assert.Equal(t, tc.Numbers, numbers)
+				assert.Equal(t, tc.Corrupt, corrupt)
+			})
+		}
+	})
+
+	t.Run("Offset", func(t *testing.T) {
+		decoder := NewDecoder(strings.NewReader("1\n22\n333"), Text)
+		decoder.Strict = true
+		require.NoError(t, decoder.Skip(2))
+		_, err := decoder.Decode()
+		require.NoError(t, err)
+		assert.Equal(t, int64(5), decoder.Offset())
+		_, err = decoder.Decode()
+		assert.True(t, errors.Is(err, ErrTruncated))
+		assert.Equal(t, int64(5), decoder.Offset(), "A truncated record shouldn't be consumed")
+
+		assert.True(t, errors.Is(NewDecoder(strings.NewReader("1\n"), Text).Skip(3), ErrTruncated))
+	})
+}
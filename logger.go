@@ -1,18 +1,87 @@
-package main
+package numberserver
 
 import (
+	"bufio"
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
 )
 
 const DEFAULT_LOG_FILE = "./numbers.log"
 
+// Indicates when the log file is fsynced while writing
+// (it's always fsynced when a StreamWrite finishes)
+type FsyncPolicy int
+
+const (
+	// Leaves it to the OS
+	SyncNever FsyncPolicy = iota
+	// Every sync interval (see SyncInterval)
+	SyncPeriodically
+	// After every flush of the buffer
+	SyncOnFlush
+)
+
+// Parses a fsync policy's name: never, interval or flush
+func ParseFsyncPolicy(name string) (FsyncPolicy, error) {
+	switch name {
+	case "never":
+		return SyncNever, nil
+	case "interval":
+		return SyncPeriodically, nil
+	case "flush":
+		return SyncOnFlush, nil
+	}
+	return SyncNever, fmt.Errorf("Unknown fsync policy: %s (expected never, interval or flush)", name)
+}
+
 // Handler for streamed logging
 type Logger struct {
+	// Errors found while writing (see WriteErrors). First field,
+	// to keep it 64-bit aligned for atomic ops
+	writeErrors uint64
+
 	filename string
 	appender bool
+	// Buffering (a bufferSize of 0 means a write per line)
+	bufferSize    int
+	flushInterval time.Duration
+	syncPolicy    FsyncPolicy
+	syncInterval  time.Duration
+	// Rotation (see RotateSize, RotateAge and KeepSegments)
+	maxSize     int64
+	maxAge      time.Duration
+	maxSegments int
+	compression Compression
+	// Encoding of the records (see LogFormat)
+	format  logformat.Format
+	encoder logformat.Encoder
+	// Compression and pruning of rotated segments (see rotation.go)
+	archiveMu sync.Mutex
+	archiving sync.WaitGroup
+	// Other destinations for the lines written (see WithSink)
+	sinks []*sinkRunner
+	// Notified of the records flushed (see OnFlushed), along with
+	// the records still in the buffer and their bytes
+	flushHook      func([]logformat.Record, error)
+	unflushed      []unflushedRecord
+	unflushedBytes int
+	// Active segment, shared by the running StreamWrite routines,
+	// and how a new one is opened to append to it (see openSegment)
+	outMu      sync.Mutex
+	out        *lineWriter
+	users      int
+	openAppend func(name string) (*os.File, error)
+	// Tracks the running StreamWrite routines (see Wait)
+	writers sync.WaitGroup
+	errMu   sync.Mutex
+	err     error
 }
 
 // Creates a new Logger. If no option is passed, creates it
@@ -22,7 +91,8 @@ type Logger struct {
 //                 NewLogger(Appender(true))
 func NewLogger(options ...func(*Logger)) *Logger {
 	// (using options allows us to avoid creating several New* functions)
-	defaultLogger := &Logger{filename: DEFAULT_LOG_FILE, appender: false}
+	defaultLogger := &Logger{filename: DEFAULT_LOG_FILE, appender: false,
+		encoder: logformat.NewEncoder(logformat.Text, 0)}
 	for _, option := range options {
 		option(defaultLogger)
 	}
@@ -44,45 +114,443 @@ func Appender(appender bool) func(*Logger) {
 	}
 }
 
-// Writes streamed input to the configured log file, line by line
+// Option for buffering the writes to the log file: the buffer is flushed
+// when the next line doesn't fit in it (and when StreamWrite finishes)
+func BufferSize(size int) func(*Logger) {
+	return func(logger *Logger) {
+		logger.bufferSize = size
+	}
+}
+
+// Option for flushing the buffer periodically
+// (only meaningful along with BufferSize)
+func FlushInterval(interval time.Duration) func(*Logger) {
+	return func(logger *Logger) {
+		logger.flushInterval = interval
+	}
+}
+
+// Option for setting when the log file is fsynced while writing
+func SyncPolicy(policy FsyncPolicy) func(*Logger) {
+	return func(logger *Logger) {
+		logger.syncPolicy = policy
+	}
+}
+
+// Option for setting the interval used by the SyncPeriodically policy
+func SyncInterval(interval time.Duration) func(*Logger) {
+	return func(logger *Logger) {
+		logger.syncInterval = interval
+	}
+}
+
+// Option for rotating the log file once it reaches the passed size in bytes
+// (0 disables it). See rotation.go for the segments' layout
+func RotateSize(size int64) func(*Logger) {
+	return func(logger *Logger) {
+		logger.maxSize = size
+	}
+}
+
+// Option for rotating the log file once it's been written for
+// the passed duration (0 disables it). It's checked on every write and
+// on every flush interval (see FlushInterval)
+func RotateAge(age time.Duration) func(*Logger) {
+	return func(logger *Logger) {
+		logger.maxAge = age
+	}
+}
+
+// Option for keeping only the last k rotated segments (0 keeps all of them)
+func KeepSegments(k int) func(*Logger) {
+	return func(logger *Logger) {
+		logger.maxSegments = k
+	}
+}
+
+// Option for compressing the rotated segments of the log file
+// (only meaningful along with RotateSize or RotateAge)
+func Compress(compression Compression) func(*Logger) {
+	return func(logger *Logger) {
+		logger.compression = compression
+	}
+}
+
+// Option for setting the encoding of the records written by StreamRecords.
+// Text numbers are zero-padded up to digits.
+// Lines written by StreamWrite are written as they are, no matter the format
+func LogFormat(format logformat.Format, digits int) func(*Logger) {
+	return func(logger *Logger) {
+		logger.format = format
+		logger.encoder = logformat.NewEncoder(format, digits)
+	}
+}
+
+// Option for fanning out every line written to a sink, besides the log file.
+// A failing sink doesn't stop the logger, it's handled by its policy
+// (see SinkPolicy) and reported in SinkStats
+func WithSink(config SinkConfig) func(*Logger) {
+	return func(logger *Logger) {
+		logger.sinks = append(logger.sinks, newSinkRunner(config))
+	}
+}
+
+// Option for being notified of the records written by StreamRecords once
+// they're flushed into the log file (in the same order they were written).
+// Records that couldn't be written are notified along with the error.
+// The hook is called holding the logger's lock, so it shouldn't block
+func OnFlushed(hook func(records []logformat.Record, err error)) func(*Logger) {
+	return func(logger *Logger) {
+		logger.flushHook = hook
+	}
+}
+
+// Writes streamed input to the configured log file, line by line,
+// until the stream is closed (or the context is canceled).
+// Then the file is fsynced and closed (see Wait)
 // throws error if file doesn't exist
 func (l *Logger) StreamWrite(ctx context.Context, streamLines <-chan string) error {
-	var file *os.File
-	var err error
+	return l.stream(ctx, streamLines, nil)
+}
+
+// Same as StreamWrite, but encoding the streamed records
+// in the logger's format (see LogFormat)
+func (l *Logger) StreamRecords(ctx context.Context, streamRecords <-chan logformat.Record) error {
+	return l.stream(ctx, nil, streamRecords)
+}
+
+// Format of the records written by StreamRecords
+func (l *Logger) Format() logformat.Format {
+	return l.format
+}
+
+// Consumes either stream (the other one is nil) in the background
+func (l *Logger) stream(ctx context.Context, streamLines <-chan string,
+	streamRecords <-chan logformat.Record) error {
 	// Checking context before opening file
 	select {
 	case <-ctx.Done():
 		return fmt.Errorf("Context passed to StreamWriter is canceled: %v", ctx.Err())
 	default:
-		if l.appender {
-			// Appending existing file, creating if it doesn't exist
-			file, err = os.OpenFile(l.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
-		} else {
-			file, err = os.Create(l.filename)
-		}
-		if err != nil {
-			return fmt.Errorf("An error occurred while retrieving/creating the logfile: %w", err)
+		if err := l.acquire(); err != nil {
+			return err
 		}
 	}
-	// Creating logger (second parameter stands for prefix
-	// and third parameter for custom flags)
-	logUtil := log.New(file, "", 0)
 	// Start consuming input
+	l.writers.Add(1)
 	go func() {
-		defer file.Close()
-		for line := range streamLines {
+		defer l.writers.Done()
+		defer l.release()
+		// Periodic flushes and syncs (nil channels block forever)
+		var flushTick, syncTick <-chan time.Time
+		if (l.bufferSize > 0 || l.maxAge > 0) && l.flushInterval > 0 {
+			flushTicker := time.NewTicker(l.flushInterval)
+			defer flushTicker.Stop()
+			flushTick = flushTicker.C
+		}
+		if l.syncPolicy == SyncPeriodically && l.syncInterval > 0 {
+			syncTicker := time.NewTicker(l.syncInterval)
+			defer syncTicker.Stop()
+			syncTick = syncTicker.C
+		}
+		for {
+			var entry []byte
+			var record *logformat.Record
+			select {
+			case line, ok := <-streamLines:
+				if !ok {
+					return
+				}
+				entry = []byte(line + "\n")
+				record = nil
+			case received, ok := <-streamRecords:
+				if !ok {
+					return
+				}
+				entry = l.encoder.Encode(received)
+				record = &received
+			case <-flushTick:
+				l.flush()
+				continue
+			case <-syncTick:
+				l.sync()
+				continue
+			}
 			select {
 			case <-ctx.Done():
 				fmt.Printf("Canceled writing: %v \n", ctx.Err())
+				l.setErr(fmt.Errorf("Writing to the logfile was canceled: %w", ctx.Err()))
 				return
 			default:
-				logUtil.Println(line)
+				l.writeEntry(entry, record)
 			}
 		}
 	}()
 	return nil
 }
 
+// Blocks until every StreamWrite routine of this logger is done
+// (that is, its stream was drained and the file fsynced and closed)
+// and every rotated segment was archived (compressed and pruned).
+// Returns the first error found while writing, if any
+func (l *Logger) Wait() error {
+	l.writers.Wait()
+	l.archiving.Wait()
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+	return l.err
+}
+
+// Opens the active segment, if no other StreamWrite routine did it already
+func (l *Logger) acquire() error {
+	l.outMu.Lock()
+	defer l.outMu.Unlock()
+	if l.out == nil {
+		var file *os.File
+		var err error
+		if l.appender {
+			// Appending existing file, creating if it doesn't exist
+			file, err = os.OpenFile(l.filename, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		} else {
+			file, err = os.Create(l.filename)
+			if err == nil {
+				// Segments of the previous run go away along with it
+				err = removeSegments(l.filename)
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("An error occurred while retrieving/creating the logfile: %w", err)
+		}
+		l.out, err = newLineWriter(file, l.bufferSize, l.syncPolicy)
+		if err != nil {
+			file.Close()
+			return err
+		}
+		for _, sink := range l.sinks {
+			sink.Start()
+		}
+	}
+	l.users++
+	return nil
+}
+
+// Closes the active segment once the last StreamWrite routine is done
+// (flushing the buffer and syncing the file to disk)
+func (l *Logger) release() {
+	l.outMu.Lock()
+	defer l.outMu.Unlock()
+	l.users--
+	if l.users > 0 {
+		return
+	}
+	if err := l.closeOut(); err != nil {
+		l.setErr(err)
+	}
+	l.out = nil
+	// Draining the sinks
+	for _, sink := range l.sinks {
+		sink.Stop()
+	}
+}
+
+// Reopens the log file, so an external tool (e.g. logrotate) can move it
+// away: the active segment is closed (flushing the buffer) and writing
+// goes on into a new file with the same name. If the new one can't be
+// opened, the active segment is kept. Does nothing if it isn't open
+func (l *Logger) Reopen() error {
+	l.outMu.Lock()
+	defer l.outMu.Unlock()
+	if l.out == nil {
+		return nil
+	}
+	out, err := l.openSegment()
+	if err != nil {
+		return fmt.Errorf("An error occurred while reopening the logfile: %w", err)
+	}
+	closeErr := l.closeOut()
+	l.out = out
+	if closeErr != nil {
+		l.setErr(closeErr)
+	}
+	return nil
+}
+
+// Closes the active segment, notifying the flush hook of whatever was
+// still buffered: it's only lost if flushing it failed (once in the file,
+// failing to sync or close it doesn't lose it). Must be called holding outMu
+func (l *Logger) closeOut() error {
+	var lost error
+	if err := l.out.buffer.Flush(); err != nil {
+		lost = fmt.Errorf("An error occurred while writing to the logfile: %w", err)
+	}
+	err := l.out.Close()
+	l.notifyUnflushed(lost)
+	return err
+}
+
+// Opens the log file (creating it if it doesn't exist) to append to it
+func (l *Logger) openSegment() (*lineWriter, error) {
+	open := l.openAppend
+	if open == nil {
+		open = func(name string) (*os.File, error) {
+			return os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		}
+	}
+	file, err := open(l.filename)
+	if err != nil {
+		return nil, err
+	}
+	out, err := newLineWriter(file, l.bufferSize, l.syncPolicy)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return out, nil
+}
+
+// Counters of every sink of the logger
+func (l *Logger) SinkStats() []SinkStats {
+	stats := make([]SinkStats, 0, len(l.sinks))
+	for _, sink := range l.sinks {
+		stats = append(stats, sink.Stats())
+	}
+	return stats
+}
+
+// Writes an encoded entry into the active segment, rotating it if needed.
+// The record is the entry's source, if it's been encoded by StreamRecords
+func (l *Logger) writeEntry(entry []byte, record *logformat.Record) {
+	l.outMu.Lock()
+	if err := l.out.Write(entry); err != nil {
+		l.setErr(err)
+		if l.flushHook != nil && record != nil {
+			l.flushHook([]logformat.Record{*record}, err)
+		}
+	} else if l.flushHook != nil && record != nil {
+		l.unflushed = append(l.unflushed, unflushedRecord{record: *record, size: len(entry)})
+		l.unflushedBytes += len(entry)
+	}
+	l.rotateIfNeeded()
+	l.notifyFlushed()
+	l.outMu.Unlock()
+	// Out of the lock, so that a sink blocking (see SinkBlock)
+	// doesn't stall flushing and rotating the log file
+	for _, sink := range l.sinks {
+		sink.Enqueue(entry)
+	}
+}
+
+func (l *Logger) flush() {
+	l.outMu.Lock()
+	defer l.outMu.Unlock()
+	if err := l.out.Flush(); err != nil {
+		l.setErr(err)
+	}
+	l.rotateIfNeeded()
+	l.notifyFlushed()
+}
+
+func (l *Logger) sync() {
+	l.outMu.Lock()
+	defer l.outMu.Unlock()
+	if err := l.out.Sync(); err != nil {
+		l.setErr(err)
+	}
+	l.notifyFlushed()
+}
+
+// A record written into the buffer, along with its encoded size
+type unflushedRecord struct {
+	record logformat.Record
+	size   int
+}
+
+// Notifies the flush hook of the records that left the buffer
+// (the oldest ones, beyond what's still buffered).
+// Must be called holding outMu
+func (l *Logger) notifyFlushed() {
+	if l.flushHook == nil || len(l.unflushed) == 0 {
+		return
+	}
+	buffered := 0
+	if l.out != nil {
+		buffered = l.out.buffer.Buffered()
+	}
+	var flushed []logformat.Record
+	for len(l.unflushed) > 0 && l.unflushedBytes > buffered {
+		flushed = append(flushed, l.unflushed[0].record)
+		l.unflushedBytes -= l.unflushed[0].size
+		l.unflushed = l.unflushed[1:]
+	}
+	if len(flushed) > 0 {
+		l.flushHook(flushed, nil)
+	}
+}
+
+// Notifies the flush hook of every record still in the buffer,
+// once it was closed (err is why they're lost, if they were).
+// Must be called holding outMu
+func (l *Logger) notifyUnflushed(err error) {
+	if l.flushHook == nil || len(l.unflushed) == 0 {
+		return
+	}
+	records := make([]logformat.Record, 0, len(l.unflushed))
+	for _, pending := range l.unflushed {
+		records = append(records, pending.record)
+	}
+	l.unflushed, l.unflushedBytes = nil, 0
+	l.flushHook(records, err)
+}
+
+// First error found so far while writing (nil if none), without waiting
+// for the StreamWrite routines, unlike Wait
+func (l *Logger) Err() error {
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+	return l.err
+}
+
+// Checks whether the logger is writing into its log file: the file is
+// open, no error was found and it wasn't removed or replaced meanwhile
+func (l *Logger) Writable() error {
+	if err := l.Err(); err != nil {
+		return err
+	}
+	l.outMu.Lock()
+	defer l.outMu.Unlock()
+	if l.out == nil {
+		return errors.New("The log file isn't open")
+	}
+	opened, err := l.out.file.Stat()
+	if err != nil {
+		return fmt.Errorf("An error occurred while checking the logfile: %w", err)
+	}
+	current, err := os.Stat(l.filename)
+	if err != nil {
+		return fmt.Errorf("An error occurred while checking the logfile: %w", err)
+	}
+	if !os.SameFile(opened, current) {
+		return errors.New("The log file was replaced")
+	}
+	return nil
+}
+
+// Number of errors found so far while writing, rotating or archiving
+// (unlike Wait's error, which is only the first one)
+func (l *Logger) WriteErrors() uint64 {
+	return atomic.LoadUint64(&l.writeErrors)
+}
+
+// Keeps the first error found (counting every one of them)
+func (l *Logger) setErr(err error) {
+	atomic.AddUint64(&l.writeErrors, 1)
+	l.errMu.Lock()
+	defer l.errMu.Unlock()
+	if l.err == nil {
+		l.err = err
+	}
+}
+
 // Sets new filename to be written by the logger
 func (l *Logger) setFilename(name string) {
 	l.filename = name
@@ -93,3 +561,90 @@ func (l *Logger) setFilename(name string) {
 func (l *Logger) setAppender(appender bool) {
 	l.appender = appender
 }
+
+// Buffered writer of entries over the log file, applying the fsync policy
+type lineWriter struct {
+	file   *os.File
+	buffer *bufio.Writer
+	// Unbuffered writers flush after every line
+	buffered bool
+	policy   FsyncPolicy
+	// Bytes written into the file (buffered included) and when it was opened
+	size   int64
+	opened time.Time
+}
+
+func newLineWriter(file *os.File, bufferSize int, policy FsyncPolicy) (*lineWriter, error) {
+	info, err := file.Stat()
+	if err != nil {
+		return nil, fmt.Errorf("An error occurred while retrieving the logfile: %w", err)
+	}
+	size := bufferSize
+	if size <= 0 {
+		size = 4096
+	}
+	return &lineWriter{
+		file:     file,
+		buffer:   bufio.NewWriterSize(file, size),
+		buffered: bufferSize > 0,
+		policy:   policy,
+		size:     info.Size(),
+		opened:   time.Now(),
+	}, nil
+}
+
+// Writes the entry (delimiter included), flushing before if it doesn't fit,
+// so that an entry is never split across writes
+func (w *lineWriter) Write(entry []byte) error {
+	if w.buffered && w.buffer.Available() < len(entry) && w.buffer.Buffered() > 0 {
+		if err := w.Flush(); err != nil {
+			return err
+		}
+	}
+	if _, err := w.buffer.Write(entry); err != nil {
+		return fmt.Errorf("An error occurred while writing to the logfile: %w", err)
+	}
+	w.size += int64(len(entry))
+	if !w.buffered {
+		return w.Flush()
+	}
+	return nil
+}
+
+// Writes the buffer to the file (syncing it, if the policy says so)
+func (w *lineWriter) Flush() error {
+	if w.buffer.Buffered() == 0 {
+		return nil
+	}
+	if err := w.buffer.Flush(); err != nil {
+		return fmt.Errorf("An error occurred while writing to the logfile: %w", err)
+	}
+	if w.policy == SyncOnFlush {
+		return w.syncFile()
+	}
+	return nil
+}
+
+// Flushes the buffer and syncs the file, no matter the policy
+func (w *lineWriter) Sync() error {
+	if err := w.buffer.Flush(); err != nil {
+		return fmt.Errorf("An error occurred while writing to the logfile: %w", err)
+	}
+	return w.syncFile()
+}
+
+// Syncs and closes the file
+func (w *lineWriter) Close() error {
+	err := w.Sync()
+	if closeErr := w.file.Close(); closeErr != nil && err == nil {
+		err = fmt.Errorf("An error occurred while closing the logfile: %w", closeErr)
+	}
+	return err
+}
+
+func (w *lineWriter) syncFile() error {
+	if err := w.file.Sync(); err != nil {
+		return fmt.Errorf("An error occurred while syncing the logfile: %w", err)
+	}
+	return nil
+}
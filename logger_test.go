@@ -1,12 +1,20 @@
-package main
+package numberserver
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/mountolive/numberserver/logformat"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -198,4 +206,297 @@ func TestLogger(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("Wait", func(t *testing.T) {
+		logger := NewLogger(Filename("./wait.log"))
+		defer os.Remove(logger.filename)
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		lines := []string{"one", "two", "three"}
+		for _, line := range lines {
+			readStream <- line
+		}
+		close(readStream)
+		require.NoError(t, logger.Wait())
+		// Every line should be there once Wait returns
+		file, err := os.Open(logger.filename)
+		require.NoError(t, err)
+		defer file.Close()
+		var written []string
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			written = append(written, scanner.Text())
+		}
+		assert.Equal(t, lines, written)
+	})
+
+	t.Run("Stream Records", func(t *testing.T) {
+		records := []logformat.Record{
+			{Number: 42, ReceivedAt: time.Now(), Client: "127.0.0.1:5000", ConnID: 1},
+			{Number: 7, ReceivedAt: time.Now(), Client: "127.0.0.1:5001", ConnID: 2},
+		}
+		for _, format := range []logformat.Format{logformat.Text, logformat.JSONLines,
+			logformat.CSV, logformat.Binary} {
+			t.Run(format.String(), func(t *testing.T) {
+				var sinkBuffer bytes.Buffer
+				logger := NewLogger(Filename("./records.log"), LogFormat(format, 9),
+					WithSink(SinkConfig{Sink: NewWriterSink("buffer", &sinkBuffer)}))
+				defer os.Remove(logger.filename)
+				assert.Equal(t, format, logger.Format())
+				readStream := make(chan logformat.Record)
+				require.NoError(t, logger.StreamRecords(context.Background(), readStream))
+				for _, record := range records {
+					readStream <- record
+				}
+				close(readStream)
+				require.NoError(t, logger.Wait())
+
+				content, err := ioutil.ReadFile(logger.filename)
+				require.NoError(t, err)
+				assert.Equal(t, string(content), sinkBuffer.String(), "Sinks get the same encoding")
+				decoder := logformat.NewDecoder(bytes.NewReader(content), format)
+				for _, record := range records {
+					decoded, err := decoder.Decode()
+					require.NoError(t, err)
+					assert.Equal(t, record.Number, decoded.Number)
+				}
+				_, err = decoder.Decode()
+				assert.Equal(t, io.EOF, err)
+			})
+		}
+	})
+
+	t.Run("On Flushed", func(t *testing.T) {
+		var mu sync.Mutex
+		var flushed []uint32
+		flushedNumbers := func() []uint32 {
+			mu.Lock()
+			defer mu.Unlock()
+			return append([]uint32(nil), flushed...)
+		}
+		// Two records fit in the buffer
+		logger := NewLogger(Filename("./flushed.log"), BufferSize(25), LogFormat(logformat.Text, 9),
+			OnFlushed(func(records []logformat.Record, err error) {
+				assert.NoError(t, err)
+				mu.Lock()
+				defer mu.Unlock()
+				for _, record := range records {
+					flushed = append(flushed, record.Number)
+				}
+			}))
+		defer os.Remove(logger.filename)
+		readStream := make(chan logformat.Record)
+		require.NoError(t, logger.StreamRecords(context.Background(), readStream))
+		readStream <- logformat.Record{Number: 1}
+		readStream <- logformat.Record{Number: 2}
+		assert.Empty(t, flushedNumbers(), "Nothing was flushed yet")
+		// The third one doesn't fit: the first two are flushed
+		readStream <- logformat.Record{Number: 3}
+		assert.Eventually(t, func() bool { return len(flushedNumbers()) == 2 }, time.Second, time.Millisecond)
+		close(readStream)
+		require.NoError(t, logger.Wait())
+		assert.Equal(t, []uint32{1, 2, 3}, flushedNumbers(), "The rest is flushed on close")
+	})
+
+	t.Run("Failed fsync loses nothing", func(t *testing.T) {
+		var flushed []uint32
+		var flushErrs []error
+		logger := NewLogger(Filename("./fsynced.log"), BufferSize(1<<20), FlushInterval(time.Hour),
+			LogFormat(logformat.Text, 9), OnFlushed(func(records []logformat.Record, err error) {
+				for _, record := range records {
+					flushed = append(flushed, record.Number)
+				}
+				flushErrs = append(flushErrs, err)
+			}))
+		defer os.Remove(logger.filename)
+		// Writing into a pipe, which can't be fsynced
+		reader, writer, err := os.Pipe()
+		require.NoError(t, err)
+		defer reader.Close()
+		written := make(chan []byte)
+		go func() {
+			content, _ := ioutil.ReadAll(reader)
+			written <- content
+		}()
+		logger.openAppend = func(name string) (*os.File, error) {
+			return writer, nil
+		}
+		readStream := make(chan logformat.Record)
+		require.NoError(t, logger.StreamRecords(context.Background(), readStream))
+		require.NoError(t, logger.Reopen())
+		readStream <- logformat.Record{Number: 1}
+		readStream <- logformat.Record{Number: 2}
+		close(readStream)
+		assert.Error(t, logger.Wait())
+		assert.Equal(t, "000000001\n000000002\n", string(<-written))
+		// Flushed into the file: they aren't reported lost
+		assert.Equal(t, []uint32{1, 2}, flushed)
+		assert.Equal(t, []error{nil}, flushErrs)
+	})
+
+	t.Run("Writable", func(t *testing.T) {
+		logger := NewLogger(Filename("./writable.log"))
+		defer os.Remove(logger.filename)
+		assert.Error(t, logger.Writable(), "The log file isn't open yet")
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		assert.NoError(t, logger.Writable())
+		// Replaced behind the logger's back
+		require.NoError(t, os.Remove(logger.filename))
+		require.NoError(t, ioutil.WriteFile(logger.filename, nil, 0644))
+		assert.Error(t, logger.Writable())
+		close(readStream)
+		require.NoError(t, logger.Wait())
+	})
+
+	t.Run("Wait after cancel", func(t *testing.T) {
+		logger := NewLogger(Filename("./canceled.log"))
+		defer os.Remove(logger.filename)
+		readStream := make(chan string)
+		ctx, cancel := context.WithCancel(context.Background())
+		require.NoError(t, logger.StreamWrite(ctx, readStream))
+		cancel()
+		readStream <- "one"
+		assert.Error(t, logger.Wait(), "Wait should report the cancellation")
+	})
+
+	t.Run("Buffered options", func(t *testing.T) {
+		logger := NewLogger(BufferSize(1024), FlushInterval(time.Second),
+			SyncPolicy(SyncPeriodically), SyncInterval(time.Minute))
+		assert.Equal(t, 1024, logger.bufferSize)
+		assert.Equal(t, time.Second, logger.flushInterval)
+		assert.Equal(t, SyncPeriodically, logger.syncPolicy)
+		assert.Equal(t, time.Minute, logger.syncInterval)
+	})
+
+	t.Run("Parse Fsync Policy", func(t *testing.T) {
+		for name, expected := range map[string]FsyncPolicy{
+			"never": SyncNever, "interval": SyncPeriodically, "flush": SyncOnFlush,
+		} {
+			policy, err := ParseFsyncPolicy(name)
+			require.NoError(t, err)
+			assert.Equal(t, expected, policy)
+		}
+		_, err := ParseFsyncPolicy("sometimes")
+		assert.Error(t, err)
+	})
+
+	// Reads the whole log file
+	readLog := func(t *testing.T, path string) string {
+		content, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		return string(content)
+	}
+
+	t.Run("Buffered flushed on shutdown", func(t *testing.T) {
+		for _, policy := range []FsyncPolicy{SyncNever, SyncPeriodically, SyncOnFlush} {
+			logger := NewLogger(Filename("./buffered.log"), BufferSize(1<<20),
+				FlushInterval(time.Hour), SyncPolicy(policy), SyncInterval(time.Hour))
+			readStream := make(chan string)
+			require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+			var expected strings.Builder
+			for i := 0; i < 1000; i++ {
+				line := fmt.Sprintf("%d", i)
+				readStream <- line
+				expected.WriteString(line + "\n")
+			}
+			// Nothing flushed yet, the buffer is big enough
+			assert.Equal(t, "", readLog(t, logger.filename))
+			close(readStream)
+			require.NoError(t, logger.Wait())
+			assert.Equal(t, expected.String(), readLog(t, logger.filename))
+			os.Remove(logger.filename)
+		}
+	})
+
+	t.Run("Buffered flush on size", func(t *testing.T) {
+		logger := NewLogger(Filename("./flushsize.log"), BufferSize(16))
+		defer os.Remove(logger.filename)
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		defer close(readStream)
+		// 3 lines of 5 bytes fit, the fourth one flushes them
+		for _, line := range []string{"0001", "0002", "0003", "0004"} {
+			readStream <- line
+		}
+		// Next line makes sure the previous one was processed
+		readStream <- "0005"
+		assert.Equal(t, "0001\n0002\n0003\n", readLog(t, logger.filename))
+	})
+
+	t.Run("Buffered flush on interval", func(t *testing.T) {
+		logger := NewLogger(Filename("./flushinterval.log"), BufferSize(1<<20),
+			FlushInterval(10*time.Millisecond))
+		defer os.Remove(logger.filename)
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		defer close(readStream)
+		readStream <- "one"
+		assert.Eventually(t, func() bool {
+			return readLog(t, logger.filename) == "one\n"
+		}, time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Reopen", func(t *testing.T) {
+		logger := NewLogger(Filename("./reopen.log"), BufferSize(1<<20), FlushInterval(time.Hour))
+		defer os.Remove(logger.filename)
+		defer os.Remove("./reopen.log.1")
+		// Not open yet
+		require.NoError(t, logger.Reopen())
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		readStream <- "one"
+		// Next line makes sure the previous one was processed
+		readStream <- "two"
+		// Moved away, as logrotate does
+		require.NoError(t, os.Rename(logger.filename, "./reopen.log.1"))
+		require.NoError(t, logger.Reopen())
+		// Buffered lines were flushed into the moved file
+		rotated := readLog(t, "./reopen.log.1")
+		assert.True(t, strings.HasPrefix(rotated, "one\n"))
+		require.NoError(t, logger.Writable())
+		readStream <- "three"
+		close(readStream)
+		require.NoError(t, logger.Wait())
+		assert.Equal(t, "one\ntwo\nthree\n", rotated+readLog(t, logger.filename))
+	})
+}
+
+// Throughput of StreamWrite for each buffering/fsync policy
+func BenchmarkStreamWrite(b *testing.B) {
+	benchmarks := []struct {
+		Name    string
+		Options []func(*Logger)
+	}{
+		{Name: "Unbuffered", Options: nil},
+		{Name: "Unbuffered fsync every line", Options: []func(*Logger){SyncPolicy(SyncOnFlush)}},
+		{Name: "Buffered fsync never", Options: []func(*Logger){BufferSize(64 << 10)}},
+		{Name: "Buffered fsync every 10ms", Options: []func(*Logger){BufferSize(64 << 10),
+			SyncPolicy(SyncPeriodically), SyncInterval(10 * time.Millisecond)}},
+		{Name: "Buffered fsync every flush", Options: []func(*Logger){BufferSize(64 << 10),
+			SyncPolicy(SyncOnFlush)}},
+	}
+	for _, bm := range benchmarks {
+		b.Run(bm.Name, func(b *testing.B) {
+			dir, err := ioutil.TempDir("", "bench")
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			options := append([]func(*Logger){Filename(filepath.Join(dir, "numbers.log"))}, bm.Options...)
+			logger := NewLogger(options...)
+			readStream := make(chan string)
+			if err := logger.StreamWrite(context.Background(), readStream); err != nil {
+				b.Fatal(err)
+			}
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				readStream <- "123456789"
+			}
+			close(readStream)
+			if err := logger.Wait(); err != nil {
+				b.Fatal(err)
+			}
+		})
+	}
 }
@@ -0,0 +1,256 @@
+package numberserver
+
+import (
+	"fmt"
+	"io"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
+)
+
+// Upper bounds (in seconds) of the pipeline latency histogram's buckets.
+// The latency goes from a number being read to it being flushed
+// into the log file, so it's mostly bound by the flush interval
+var LATENCY_BUCKETS = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// Monotonic counters of a server's activity. Unlike Statistics,
+// they're never reset, so they can be scraped (see WritePrometheus)
+type Metrics struct {
+	// First fields, to keep them 64-bit aligned for atomic ops
+	unique     uint64
+	lost       uint64
+	duplicates uint64
+	invalid    uint64
+	accepted   uint64
+	rejected   uint64
+	timedOut   uint64
+	bytesRead  uint64
+	queries    uint64
+	// UDP datagrams received, and dropped for being invalid or truncated
+	datagrams          uint64
+	invalidDatagrams   uint64
+	truncatedDatagrams uint64
+	active             int64
+	latency            *histogram
+}
+
+// Current values of a server's Metrics
+type MetricsSnapshot struct {
+	// Unique numbers received, and those of them that couldn't be logged
+	// (forgotten, see AckLost): Unique - Lost were logged
+	Unique     uint64
+	Lost       uint64
+	Duplicates uint64
+	Invalid    uint64
+	// Connections accepted (including the rejected ones),
+	// turned away, timed out and currently being served
+	Accepted  uint64
+	Rejected  uint64
+	TimedOut  uint64
+	Active    int64
+	BytesRead uint64
+	// Lookups of numbers (see QUERY_PREFIX and the admin API)
+	Queries uint64
+	// UDP datagrams received (including the dropped ones),
+	// and dropped for having invalid lines or being truncated
+	Datagrams          uint64
+	InvalidDatagrams   uint64
+	TruncatedDatagrams uint64
+}
+
+// Creates a Metrics with every counter at 0
+func NewMetrics() *Metrics {
+	return &Metrics{latency: newHistogram(LATENCY_BUCKETS)}
+}
+
+// Current values of the counters
+func (m *Metrics) Snapshot() MetricsSnapshot {
+	return MetricsSnapshot{
+		Unique:             atomic.LoadUint64(&m.unique),
+		Lost:               atomic.LoadUint64(&m.lost),
+		Duplicates:         atomic.LoadUint64(&m.duplicates),
+		Invalid:            atomic.LoadUint64(&m.invalid),
+		Accepted:           atomic.LoadUint64(&m.accepted),
+		Rejected:           atomic.LoadUint64(&m.rejected),
+		TimedOut:           atomic.LoadUint64(&m.timedOut),
+		Active:             atomic.LoadInt64(&m.active),
+		BytesRead:          atomic.LoadUint64(&m.bytesRead),
+		Queries:            atomic.LoadUint64(&m.queries),
+		Datagrams:          atomic.LoadUint64(&m.datagrams),
+		InvalidDatagrams:   atomic.LoadUint64(&m.invalidDatagrams),
+		TruncatedDatagrams: atomic.LoadUint64(&m.truncatedDatagrams),
+	}
+}
+
+// Counts a number read, either unique or duplicate
+func (m *Metrics) received(unique bool) {
+	if unique {
+		atomic.AddUint64(&m.unique, 1)
+	} else {
+		atomic.AddUint64(&m.duplicates, 1)
+	}
+}
+
+// Counts the unique numbers that couldn't be logged
+func (m *Metrics) forgot(numbers int) {
+	atomic.AddUint64(&m.lost, uint64(numbers))
+}
+
+// Observes how long the numbers flushed took since they were read
+func (m *Metrics) flushed(records []logformat.Record) {
+	now := time.Now()
+	for _, record := range records {
+		m.latency.observe(now.Sub(record.ReceivedAt).Seconds())
+	}
+}
+
+// Reader counting the bytes read into the metrics
+type countingReader struct {
+	reader  io.Reader
+	metrics *Metrics
+}
+
+func (r countingReader) Read(buffer []byte) (int, error) {
+	read, err := r.reader.Read(buffer)
+	atomic.AddUint64(&r.metrics.bytesRead, uint64(read))
+	return read, err
+}
+
+// Writes the metrics in Prometheus' text exposition format, along with
+// the tracker's size, the logger's write errors and the sinks' counters
+func (m *Metrics) WritePrometheus(writer io.Writer, tracker *NumberTracker, logger *Logger) error {
+	snapshot := m.Snapshot()
+	exposition := &promWriter{writer: writer}
+	exposition.counter("numberserver_unique_numbers_total", "Unique numbers received.", snapshot.Unique)
+	exposition.counter("numberserver_lost_numbers_total",
+		"Unique numbers received that couldn't be logged.", snapshot.Lost)
+	exposition.counter("numberserver_duplicate_numbers_total", "Duplicate numbers received.", snapshot.Duplicates)
+	exposition.counter("numberserver_invalid_inputs_total", "Invalid lines received.", snapshot.Invalid)
+	exposition.counter("numberserver_connections_accepted_total", "Connections accepted.", snapshot.Accepted)
+	exposition.counter("numberserver_connections_rejected_total",
+		"Connections turned away because the server was busy.", snapshot.Rejected)
+	exposition.counter("numberserver_connections_timed_out_total",
+		"Connections closed for exceeding their timeouts.", snapshot.TimedOut)
+	exposition.gauge("numberserver_connections_active", "Connections being served.", float64(snapshot.Active))
+	exposition.counter("numberserver_read_bytes_total", "Bytes read from the clients.", snapshot.BytesRead)
+	exposition.counter("numberserver_queries_total", "Numbers looked up.", snapshot.Queries)
+	exposition.counter("numberserver_datagrams_received_total", "UDP datagrams received.", snapshot.Datagrams)
+	exposition.counter("numberserver_datagrams_invalid_total",
+		"UDP datagrams dropped for having invalid lines.", snapshot.InvalidDatagrams)
+	exposition.counter("numberserver_datagrams_truncated_total",
+		"UDP datagrams dropped for exceeding the max size.", snapshot.TruncatedDatagrams)
+	if tracker != nil {
+		exposition.gauge("numberserver_tracked_numbers", "Unique numbers known by the tracker.",
+			float64(tracker.KnownNumbers.Len()))
+	}
+	if logger != nil {
+		exposition.counter("numberserver_log_write_errors_total", "Errors writing the log file.",
+			logger.WriteErrors())
+		sinks := logger.SinkStats()
+		if len(sinks) > 0 {
+			exposition.header("numberserver_sink_written_total", "counter", "Entries written to the sink.")
+			for _, sink := range sinks {
+				exposition.sample("numberserver_sink_written_total", sinkLabel(sink), float64(sink.Written))
+			}
+			exposition.header("numberserver_sink_dropped_total", "counter", "Entries dropped by the sink.")
+			for _, sink := range sinks {
+				exposition.sample("numberserver_sink_dropped_total", sinkLabel(sink), float64(sink.Dropped))
+			}
+			exposition.header("numberserver_sink_failures_total", "counter", "Failed writes to the sink.")
+			for _, sink := range sinks {
+				exposition.sample("numberserver_sink_failures_total", sinkLabel(sink), float64(sink.Failures))
+			}
+		}
+	}
+	m.latency.write(exposition, "numberserver_pipeline_latency_seconds",
+		"Time from a number being read to it being flushed into the log file.")
+	return exposition.err
+}
+
+func sinkLabel(sink SinkStats) string {
+	return "sink=" + strconv.Quote(sink.Name)
+}
+
+// Histogram of observations into fixed buckets
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	// Observations per bucket (not cumulative), the last one is +Inf
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (h *histogram) observe(value float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	bucket := len(h.bounds)
+	for index, bound := range h.bounds {
+		if value <= bound {
+			bucket = index
+			break
+		}
+	}
+	h.counts[bucket]++
+	h.sum += value
+	h.count++
+}
+
+func (h *histogram) write(exposition *promWriter, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	exposition.header(name, "histogram", help)
+	var cumulative uint64
+	for index, bound := range h.bounds {
+		cumulative += h.counts[index]
+		exposition.sample(name+"_bucket", "le="+strconv.Quote(formatFloat(bound)), float64(cumulative))
+	}
+	exposition.sample(name+"_bucket", `le="+Inf"`, float64(h.count))
+	exposition.sample(name+"_sum", "", h.sum)
+	exposition.sample(name+"_count", "", float64(h.count))
+}
+
+// Writer of Prometheus' text format, keeping the first error
+type promWriter struct {
+	writer io.Writer
+	err    error
+}
+
+func (p *promWriter) header(name, kind, help string) {
+	p.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+func (p *promWriter) sample(name, labels string, value float64) {
+	if labels != "" {
+		name += "{" + labels + "}"
+	}
+	p.printf("%s %s\n", name, formatFloat(value))
+}
+
+func (p *promWriter) counter(name, help string, value uint64) {
+	p.header(name, "counter", help)
+	p.printf("%s %d\n", name, value)
+}
+
+func (p *promWriter) gauge(name, help string, value float64) {
+	p.header(name, "gauge", help)
+	p.sample(name, "", value)
+}
+
+func (p *promWriter) printf(format string, args ...interface{}) {
+	if p.err != nil {
+		return
+	}
+	_, p.err = fmt.Fprintf(p.writer, format, args...)
+}
+
+func formatFloat(value float64) string {
+	return strconv.FormatFloat(value, 'g', -1, 64)
+}
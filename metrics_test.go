@@ -0,0 +1,71 @@
+package numberserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMetrics(t *testing.T) {
+	t.Run("Snapshot", func(t *testing.T) {
+		metrics := NewMetrics()
+		metrics.received(true)
+		metrics.received(true)
+		metrics.received(false)
+		read, err := ioutil.ReadAll(countingReader{reader: strings.NewReader("000000001\n"), metrics: metrics})
+		require.NoError(t, err)
+		snapshot := metrics.Snapshot()
+		assert.Equal(t, uint64(2), snapshot.Unique)
+		assert.Equal(t, uint64(1), snapshot.Duplicates)
+		assert.Equal(t, uint64(len(read)), snapshot.BytesRead)
+	})
+
+	t.Run("Histogram", func(t *testing.T) {
+		histogram := newHistogram([]float64{0.1, 1})
+		for _, value := range []float64{0.05, 0.1, 0.5, 3} {
+			histogram.observe(value)
+		}
+		var buffer bytes.Buffer
+		exposition := &promWriter{writer: &buffer}
+		histogram.write(exposition, "latency_seconds", "Latency.")
+		require.NoError(t, exposition.err)
+		expected := `# HELP latency_seconds Latency.
+# TYPE latency_seconds histogram
+latency_seconds_bucket{le="0.1"} 2
+latency_seconds_bucket{le="1"} 3
+latency_seconds_bucket{le="+Inf"} 4
+latency_seconds_sum 3.65
+latency_seconds_count 4
+`
+		assert.Equal(t, expected, buffer.String())
+	})
+
+	t.Run("Write Prometheus", func(t *testing.T) {
+		metrics := NewMetrics()
+		metrics.received(true)
+		metrics.flushed([]logformat.Record{{Number: 1, ReceivedAt: time.Now()}})
+		tracker := NewNumberTracker()
+		tracker.Register(1)
+		var buffer bytes.Buffer
+		require.NoError(t, metrics.WritePrometheus(&buffer, tracker, NewLogger()))
+		exposition := buffer.String()
+		for _, sample := range []string{
+			"# TYPE numberserver_unique_numbers_total counter\nnumberserver_unique_numbers_total 1\n",
+			"numberserver_duplicate_numbers_total 0\n",
+			"# TYPE numberserver_connections_active gauge\nnumberserver_connections_active 0\n",
+			"numberserver_datagrams_truncated_total 0\n",
+			"numberserver_tracked_numbers 1\n",
+			"numberserver_log_write_errors_total 0\n",
+			"numberserver_pipeline_latency_seconds_bucket{le=\"0.001\"} 1\n",
+			"numberserver_pipeline_latency_seconds_count 1\n",
+		} {
+			assert.Contains(t, exposition, sample)
+		}
+	})
+}
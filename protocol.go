@@ -0,0 +1,123 @@
+package numberserver
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+// Max characters of an offending input echoed back in an error line
+const MAX_ECHOED_INPUT = 32
+
+// Line replied to the connections turned away (see OverloadPolicy)
+const SERVER_BUSY_REPLY = "ERR 3 server_busy\n"
+
+// Line replied to a refused termination request on the admin socket
+// (see terminationGuard)
+const TERMINATION_REFUSED_REPLY = "ERR 4 termination_refused\n"
+
+// Prefix of the lines querying whether a number was seen, e.g. ?000000042
+// (replied with SEEN <number> or UNSEEN <number>, see queryStatus)
+const QUERY_PREFIX = "?"
+
+// Default time a connection can wait for a place with OverloadQueue
+const DEFAULT_OVERLOAD_TIMEOUT = 5 * time.Second
+
+// What to do with a connection sending an invalid line
+type InvalidPolicy int
+
+const (
+	// Closes the connection right away, without replying
+	InvalidClose InvalidPolicy = iota
+	// Replies with an error line (see errorLine), then closes the connection
+	InvalidReplyClose
+	// Replies with an error line and keeps reading from the connection
+	InvalidReplyContinue
+)
+
+// Parses an invalid policy's name: close, reply-close or reply-continue
+func ParseInvalidPolicy(name string) (InvalidPolicy, error) {
+	switch name {
+	case "close":
+		return InvalidClose, nil
+	case "reply-close":
+		return InvalidReplyClose, nil
+	case "reply-continue":
+		return InvalidReplyContinue, nil
+	}
+	return InvalidClose, fmt.Errorf("Unknown invalid input policy: %s (expected close, reply-close or reply-continue)", name)
+}
+
+func (p InvalidPolicy) String() string {
+	switch p {
+	case InvalidReplyClose:
+		return "reply-close"
+	case InvalidReplyContinue:
+		return "reply-continue"
+	}
+	return "close"
+}
+
+// What to do with new connections once maxconn clients are connected
+type OverloadPolicy int
+
+const (
+	// Stops accepting connections until a place is free
+	// (new ones wait in the kernel's backlog)
+	OverloadBlock OverloadPolicy = iota
+	// Accepts the connection, replies SERVER_BUSY_REPLY and closes it
+	OverloadReject
+	// Accepts the connection and waits for a place up to a timeout,
+	// then rejects it (as OverloadReject)
+	OverloadQueue
+)
+
+// Parses an overload policy's name: block, reject or queue
+func ParseOverloadPolicy(name string) (OverloadPolicy, error) {
+	switch name {
+	case "block":
+		return OverloadBlock, nil
+	case "reject":
+		return OverloadReject, nil
+	case "queue":
+		return OverloadQueue, nil
+	}
+	return OverloadBlock, fmt.Errorf("Unknown overload policy: %s (expected block, reject or queue)", name)
+}
+
+func (p OverloadPolicy) String() string {
+	switch p {
+	case OverloadReject:
+		return "reject"
+	case OverloadQueue:
+		return "queue"
+	}
+	return "block"
+}
+
+// Line replied to a client sending an invalid input:
+//
+//	ERR <code> <reason> <quoted input>
+//
+// e.g. ERR 1 wrong_length "12". Inputs longer than MAX_ECHOED_INPUT
+// are truncated (with a trailing ... out of the quotes)
+func errorLine(err error) string {
+	var inputErr *InputError
+	if !errors.As(err, &inputErr) {
+		return fmt.Sprintf("ERR 0 unknown %q\n", err.Error())
+	}
+	input, truncated := inputErr.Input, ""
+	if len(input) > MAX_ECHOED_INPUT {
+		input, truncated = input[:MAX_ECHOED_INPUT], "..."
+	}
+	return fmt.Sprintf("ERR %d %s %s%s\n", inputErr.Code, inputErr.Reason, strconv.Quote(input), truncated)
+}
+
+// Reply to a query (see QUERY_PREFIX) for a number seen, or not
+func queryStatus(seen bool) AckStatus {
+	if seen {
+		return AckSeen
+	}
+	return AckUnseen
+}
@@ -0,0 +1,74 @@
+package numberserver
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type errorLineCase struct {
+	Name     string
+	Err      error
+	Expected string
+}
+
+func TestProtocol(t *testing.T) {
+	t.Run("Parse Invalid Policy", func(t *testing.T) {
+		for name, expected := range map[string]InvalidPolicy{
+			"close": InvalidClose, "reply-close": InvalidReplyClose, "reply-continue": InvalidReplyContinue,
+		} {
+			policy, err := ParseInvalidPolicy(name)
+			require.NoError(t, err)
+			assert.Equal(t, expected, policy)
+			assert.Equal(t, name, policy.String())
+		}
+		_, err := ParseInvalidPolicy("ignore")
+		assert.Error(t, err)
+	})
+
+	t.Run("Parse Overload Policy", func(t *testing.T) {
+		for name, expected := range map[string]OverloadPolicy{
+			"block": OverloadBlock, "reject": OverloadReject, "queue": OverloadQueue,
+		} {
+			policy, err := ParseOverloadPolicy(name)
+			require.NoError(t, err)
+			assert.Equal(t, expected, policy)
+			assert.Equal(t, name, policy.String())
+		}
+		_, err := ParseOverloadPolicy("drop")
+		assert.Error(t, err)
+	})
+
+	t.Run("Error Line", func(t *testing.T) {
+		testCases := []errorLineCase{
+			{
+				Name:     "Wrong length",
+				Err:      &InputError{Code: ERR_WRONG_LENGTH, Reason: "wrong_length", Input: "12"},
+				Expected: "ERR 1 wrong_length \"12\"\n",
+			},
+			{
+				Name:     "Non digit, quoted",
+				Err:      &InputError{Code: ERR_NON_DIGIT, Reason: "non_digit", Input: "12\"4 5\t78"},
+				Expected: "ERR 2 non_digit \"12\\\"4 5\\t78\"\n",
+			},
+			{
+				Name:     "Truncated input",
+				Err:      &InputError{Code: ERR_WRONG_LENGTH, Reason: "wrong_length", Input: strings.Repeat("1", 40)},
+				Expected: "ERR 1 wrong_length \"" + strings.Repeat("1", MAX_ECHOED_INPUT) + "\"...\n",
+			},
+			{
+				Name:     "Unknown error",
+				Err:      errors.New("boom"),
+				Expected: "ERR 0 unknown \"boom\"\n",
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				assert.Equal(t, tc.Expected, errorLine(tc.Err))
+			})
+		}
+	})
+}
@@ -0,0 +1,79 @@
+package numberserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/mountolive/numberserver/logformat"
+)
+
+// Summary of the state rebuilt from an existing log
+type RecoveryReport struct {
+	// Unique numbers loaded into the tracker
+	Recovered int
+	// Valid records that were already known
+	Duplicates int
+	// Records that couldn't be decoded or didn't pass the checker's validation
+	Corrupt int
+	// Unique numbers loaded from a snapshot (see Snapshotter)
+	Snapshot int
+	// Reason why an existing snapshot was discarded, if any
+	SnapshotError error
+}
+
+// Rebuilds the tracker's state from a log stream written in the passed
+// format: every record is decoded and, if its number is within the
+// checker's NumLimit digits, registered in the tracker
+// (Statistics' Total is increased accordingly, Received isn't)
+func (n *NumberTracker) Recover(reader io.Reader, format logformat.Format,
+	checker *NumberChecker) (RecoveryReport, error) {
+	var report RecoveryReport
+	decoder := logformat.NewDecoder(reader, format)
+	for {
+		record, err := decoder.Decode()
+		if err == io.EOF {
+			break
+		}
+		if errors.Is(err, logformat.ErrCorrupt) || errors.Is(err, logformat.ErrTruncated) {
+			report.Corrupt++
+			continue
+		}
+		if err != nil {
+			n.Stats.IncreaseTotal(report.Recovered)
+			return report, fmt.Errorf("An error occurred while reading the log: %w", err)
+		}
+		if !validLogged(record, checker) {
+			report.Corrupt++
+		} else if n.Register(int(record.Number)) {
+			report.Recovered++
+		} else {
+			report.Duplicates++
+		}
+	}
+	n.Stats.IncreaseTotal(report.Recovered)
+	return report, nil
+}
+
+// Whether a logged number fits in the checker's NumLimit digits
+// (numbers may be logged without leading zeros)
+func validLogged(record logformat.Record, checker *NumberChecker) bool {
+	limit := uint64(1)
+	for i := 0; i < checker.GetNumLimit(); i++ {
+		limit *= 10
+	}
+	return uint64(record.Number) < limit
+}
+
+// Same as Recover, but reading from the log file in the passed path
+// (along with its rotated segments, oldest first).
+// A missing file is not an error (there's nothing to recover)
+func (n *NumberTracker) RecoverFile(path string, format logformat.Format,
+	checker *NumberChecker) (RecoveryReport, error) {
+	log, err := OpenLog(path)
+	if err != nil {
+		return RecoveryReport{}, fmt.Errorf("An error occurred while opening the logfile: %w", err)
+	}
+	defer log.Close()
+	return n.Recover(log, format, checker)
+}
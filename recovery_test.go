@@ -0,0 +1,105 @@
+package numberserver
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/mountolive/numberserver/logformat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type recoverCase struct {
+	Name     string
+	Log      string
+	Expected RecoveryReport
+	Seen     []int
+}
+
+func TestRecovery(t *testing.T) {
+	t.Run("Recover", func(t *testing.T) {
+		genericError := "Got: %v, Expected: %v"
+		testCases := []recoverCase{
+			{
+				Name:     "Empty log",
+				Log:      "",
+				Expected: RecoveryReport{},
+			},
+			{
+				Name:     "Clean log",
+				Log:      "314159265\n7007009\n42\n",
+				Expected: RecoveryReport{Recovered: 3},
+				Seen:     []int{314159265, 7007009, 42},
+			},
+			{
+				Name:     "Duplicated lines",
+				Log:      "42\n42\n43\n",
+				Expected: RecoveryReport{Recovered: 2, Duplicates: 1},
+				Seen:     []int{42, 43},
+			},
+			{
+				Name:     "Corrupt lines",
+				Log:      "42\nterminate\n\n1234567890\n12a\n43",
+				Expected: RecoveryReport{Recovered: 2, Corrupt: 4},
+				Seen:     []int{42, 43},
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				tracker := NewNumberTracker()
+				report, err := tracker.Recover(strings.NewReader(tc.Log), logformat.Text, NewDefaultNumberChecker())
+				require.NoError(t, err)
+				assert.True(t, report == tc.Expected, genericError, report, tc.Expected)
+				assert.True(t, tracker.Stats.Total == tc.Expected.Recovered,
+					genericError, tracker.Stats.Total, tc.Expected.Recovered)
+				assert.True(t, tracker.Stats.Received == 0, genericError, tracker.Stats.Received, 0)
+				for _, value := range tc.Seen {
+					assert.True(t, tracker.Seen(value), "Number %d should have been recovered", value)
+				}
+			})
+		}
+	})
+
+	t.Run("Recover formats", func(t *testing.T) {
+		records := []logformat.Record{{Number: 42}, {Number: 7}, {Number: 42}}
+		for _, format := range []logformat.Format{logformat.JSONLines, logformat.CSV, logformat.Binary} {
+			t.Run(format.String(), func(t *testing.T) {
+				var log bytes.Buffer
+				encoder := logformat.NewEncoder(format, 9)
+				for _, record := range records {
+					log.Write(encoder.Encode(record))
+				}
+				// Out of the checker's digits
+				log.Write(encoder.Encode(logformat.Record{Number: 1234567890}))
+				tracker := NewNumberTracker()
+				report, err := tracker.Recover(&log, format, NewDefaultNumberChecker())
+				require.NoError(t, err)
+				assert.Equal(t, RecoveryReport{Recovered: 2, Duplicates: 1, Corrupt: 1}, report)
+				assert.True(t, tracker.Seen(42))
+				assert.True(t, tracker.Seen(7))
+			})
+		}
+	})
+
+	t.Run("Recover File", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "recovery")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		tracker := NewNumberTracker()
+		checker := NewDefaultNumberChecker()
+
+		report, err := tracker.RecoverFile(filepath.Join(dir, "missing.log"), logformat.Text, checker)
+		require.NoError(t, err, "A missing log file shouldn't be an error")
+		assert.Equal(t, RecoveryReport{}, report)
+
+		path := filepath.Join(dir, "numbers.log")
+		require.NoError(t, ioutil.WriteFile(path, []byte("1\n2\nbad\n"), 0644))
+		report, err = tracker.RecoverFile(path, logformat.Text, checker)
+		require.NoError(t, err)
+		assert.Equal(t, RecoveryReport{Recovered: 2, Corrupt: 1}, report)
+	})
+}
@@ -0,0 +1,124 @@
+package numberserver
+
+import (
+	"crypto/tls"
+	"fmt"
+	"reflect"
+	"strings"
+	"time"
+)
+
+// Outcome of a Reload
+type ReloadReport struct {
+	// Settings changed and applied, e.g. "MaxConn: 5 -> 10"
+	Applied []string
+	// Config's fields changed which only apply on restart
+	Ignored []string
+}
+
+// Summary of the reload, e.g:
+// Reloaded the config (log file reopened): MaxConn: 5 -> 10. Only applied on restart: Port
+func (r ReloadReport) String() string {
+	summary := "Reloaded the config (log file reopened)"
+	if len(r.Applied) == 0 {
+		summary += ": no changes"
+	} else {
+		summary += ": " + strings.Join(r.Applied, ", ")
+	}
+	if len(r.Ignored) > 0 {
+		summary += ". Only applied on restart: " + strings.Join(r.Ignored, ", ")
+	}
+	return summary
+}
+
+// Applies the settings of config that can change while running: MaxConn
+// (new connections wait if it shrinks, the active ones aren't closed),
+// Interval (0 pauses the statistics) and Termination. It also reopens
+// the log file (see Logger's Reopen) and, with TLS, loads the certificates
+// again for the new connections. The other settings changed are reported,
+// but they only apply on restart. An invalid config, failing to reopen
+// the log file or to load the certificates, doesn't change anything
+func (s *Server) Reload(config Config) (ReloadReport, error) {
+	var report ReloadReport
+	if err := config.Validate(); err != nil {
+		return report, err
+	}
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	// Loaded before changing anything (TLS can't be enabled nor disabled)
+	var reloadedTLS *tls.Config
+	if s.tls != nil && config.TLSCert != "" {
+		var err error
+		reloadedTLS, err = loadTLSConfig(config)
+		if err != nil {
+			return report, err
+		}
+	}
+	if err := s.logger.Reopen(); err != nil {
+		return report, err
+	}
+	if reloadedTLS != nil {
+		report.Applied = append(report.Applied, "TLS: certificates reloaded")
+		s.tls.store(reloadedTLS)
+		s.config.TLSCert, s.config.TLSKey, s.config.TLSClientCA = config.TLSCert, config.TLSKey, config.TLSClientCA
+	}
+	if config.MaxConn != s.config.MaxConn {
+		report.Applied = append(report.Applied, fmt.Sprintf("MaxConn: %d -> %d", s.config.MaxConn, config.MaxConn))
+		s.limiter.resize(config.MaxConn)
+		s.config.MaxConn = config.MaxConn
+	}
+	if config.Interval != s.config.Interval {
+		report.Applied = append(report.Applied, fmt.Sprintf("Interval: %v -> %v", s.config.Interval, config.Interval))
+		s.config.Interval = config.Interval
+		// Pending already, if full
+		select {
+		case s.retime <- struct{}{}:
+		default:
+		}
+	}
+	if config.Termination != s.config.Termination {
+		report.Applied = append(report.Applied, "Termination: changed")
+		s.checker.SetTermination(config.Termination)
+		s.config.Termination = config.Termination
+	}
+	report.Ignored = changedFields(s.config, config)
+	return report, nil
+}
+
+// Current statistics' interval (it can change, see Reload)
+func (s *Server) statsInterval() time.Duration {
+	s.reloadMu.Lock()
+	defer s.reloadMu.Unlock()
+	return s.config.Interval
+}
+
+// Names of the Config's fields that differ (but the Reporter's).
+// Sinks are compared by their names and how they're fed
+func changedFields(before, after Config) []string {
+	var changed []string
+	beforeValue, afterValue := reflect.ValueOf(before), reflect.ValueOf(after)
+	for i := 0; i < beforeValue.NumField(); i++ {
+		name := beforeValue.Type().Field(i).Name
+		switch name {
+		case "Reporter":
+			continue
+		case "Sinks":
+			if !reflect.DeepEqual(sinkKeys(before.Sinks), sinkKeys(after.Sinks)) {
+				changed = append(changed, name)
+			}
+			continue
+		}
+		if !reflect.DeepEqual(beforeValue.Field(i).Interface(), afterValue.Field(i).Interface()) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+func sinkKeys(sinks []SinkConfig) []string {
+	keys := make([]string, 0, len(sinks))
+	for _, sink := range sinks {
+		keys = append(keys, fmt.Sprintf("%s,policy=%s,batch=%d", sink.Sink.Name(), sink.Policy, sink.Batch))
+	}
+	return keys
+}
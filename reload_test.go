@@ -0,0 +1,142 @@
+package numberserver
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// Counts the reports received
+type countingReporter struct {
+	reports int64
+}
+
+func (r *countingReporter) Report(report StatsReport) error {
+	atomic.AddInt64(&r.reports, 1)
+	return nil
+}
+
+func TestReload(t *testing.T) {
+	// Whether the log file has the content, eventually
+	logged := func(t *testing.T, path, content string) func() bool {
+		return func() bool {
+			logged, err := ioutil.ReadFile(path)
+			return err == nil && string(logged) == content
+		}
+	}
+
+	t.Run("Invalid config", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		reloaded := config
+		reloaded.MaxConn = 10
+		reloaded.Termination = ""
+		_, err := server.Reload(reloaded)
+		var configErr *ConfigError
+		require.True(t, errors.As(err, &configErr))
+		assert.Equal(t, "Termination", configErr.Field)
+		// Nothing changed
+		assert.Equal(t, config.MaxConn, server.limiter.limit())
+		assert.Equal(t, config.Termination, server.checker.GetTermination())
+	})
+
+	t.Run("Live settings", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		server := startServer(t, config)
+		reloaded := config
+		reloaded.MaxConn = 10
+		reloaded.Termination = "stop"
+		reloaded.Port = 4000
+		reloaded.Digits = 5
+		report, err := server.Reload(reloaded)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"MaxConn: 5 -> 10", "Termination: changed"}, report.Applied)
+		assert.Equal(t, []string{"Port", "Digits"}, report.Ignored)
+		assert.Equal(t, 10, server.limiter.limit())
+		// The old keyword is just an invalid line now
+		sendLines(t, server, "terminate").Close()
+		sendLines(t, server, "stop").Close()
+		require.NoError(t, server.Wait())
+	})
+
+	t.Run("Statistics retimed", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		reporter := &countingReporter{}
+		config.Reporter = reporter
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		// Disabled until reloaded
+		time.Sleep(20 * time.Millisecond)
+		assert.Equal(t, int64(0), atomic.LoadInt64(&reporter.reports))
+		reloaded := config
+		reloaded.Interval = 10 * time.Millisecond
+		report, err := server.Reload(reloaded)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Interval: 0s -> 10ms"}, report.Applied)
+		require.Eventually(t, func() bool {
+			return atomic.LoadInt64(&reporter.reports) >= 2
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Log file reopened", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		config.FlushInterval = 10 * time.Millisecond
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		conn := sendLines(t, server, "000000001")
+		defer conn.Close()
+		require.Eventually(t, logged(t, config.Logfile, "000000001\n"), 5*time.Second, 10*time.Millisecond)
+		// Moved away, as logrotate does
+		rotated := config.Logfile + ".1"
+		require.NoError(t, os.Rename(config.Logfile, rotated))
+		report, err := server.Reload(config)
+		require.NoError(t, err)
+		assert.Empty(t, report.Applied)
+		assert.Empty(t, report.Ignored)
+		require.NoError(t, server.Ready())
+		sendLines(t, server, "000000002").Close()
+		require.Eventually(t, logged(t, config.Logfile, "000000002\n"), 5*time.Second, 10*time.Millisecond)
+		assert.True(t, logged(t, rotated, "000000001\n")())
+	})
+
+	t.Run("Snapshots across a reopen", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		config.SnapshotDir = filepath.Dir(config.Logfile)
+		config.SnapshotInterval = time.Hour
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		sendLines(t, server, "000000001", "000000002", "000000003").Close()
+		require.Eventually(t, logged(t, config.Logfile, "000000001\n000000002\n000000003\n"),
+			5*time.Second, 10*time.Millisecond)
+		require.NoError(t, server.snapshotter.Snapshot())
+		// Moved away under a name that isn't a segment (logrotate's dateext)
+		require.NoError(t, os.Rename(config.Logfile, config.Logfile+"-20261017"))
+		_, err := server.Reload(config)
+		require.NoError(t, err)
+		// The new log file is shorter than the offset covered of the old one
+		sendLines(t, server, "000000004").Close()
+		require.Eventually(t, logged(t, config.Logfile, "000000004\n"), 5*time.Second, 10*time.Millisecond)
+		require.NoError(t, server.snapshotter.Snapshot())
+		segment, offset := server.snapshotter.Position()
+		assert.Equal(t, 0, segment)
+		assert.Equal(t, int64(10), offset)
+		snapshot := NewMapDeduplicator()
+		_, _, _, err = readSnapshot(server.snapshotter.Path(), snapshot)
+		require.NoError(t, err)
+		assert.True(t, snapshot.Contains(4), "The new log file should be covered from its start")
+	})
+}
@@ -0,0 +1,166 @@
+package numberserver
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+)
+
+// Statistics of an interval, passed on to a StatsReporter
+type StatsReport struct {
+	// When it was taken, and the interval it covers
+	Time     time.Time
+	Interval time.Duration
+	// Numbers received during the interval (see Statistics)
+	Received   int
+	Duplicates int
+	// Unique totals, and connections rejected and timed out so far
+	Total    int
+	Rejected int
+	TimedOut int
+	// Connections being served when it was taken
+	Active int64
+	// Counters of the logger's sinks (if any)
+	Sinks []SinkStats
+}
+
+// Numbers processed per second during the interval
+// (both unique and duplicates)
+func (r StatsReport) Rate() float64 {
+	if r.Interval <= 0 {
+		return 0
+	}
+	return float64(r.Received+r.Duplicates) / r.Interval.Seconds()
+}
+
+// Destination of the periodic statistics
+type StatsReporter interface {
+	Report(report StatsReport) error
+}
+
+// Encoding of the periodic statistics
+type StatsFormat int
+
+const (
+	// Sentences in English (see TextReporter)
+	StatsText StatsFormat = iota
+	// A JSON object per line (see JSONReporter)
+	StatsJSON
+)
+
+// Parses a statistics format's name: text or json
+func ParseStatsFormat(name string) (StatsFormat, error) {
+	switch name {
+	case "text", "":
+		return StatsText, nil
+	case "json", "jsonl":
+		return StatsJSON, nil
+	}
+	return StatsText, fmt.Errorf("Unknown statistics format: %s (expected text or json)", name)
+}
+
+func (f StatsFormat) String() string {
+	if f == StatsJSON {
+		return "json"
+	}
+	return "text"
+}
+
+// Creates the reporter writing in the passed format
+func NewStatsReporter(format StatsFormat, writer io.Writer) StatsReporter {
+	if format == StatsJSON {
+		return NewJSONReporter(writer)
+	}
+	return NewTextReporter(writer)
+}
+
+// Reports the statistics as sentences, e.g:
+// Received 5 unique numbers, 2 duplicates (Total processed: 7). Unique totals: 5
+type TextReporter struct {
+	writer io.Writer
+}
+
+// Creates a TextReporter writing into the passed writer (e.g. os.Stdout)
+func NewTextReporter(writer io.Writer) *TextReporter {
+	return &TextReporter{writer: writer}
+}
+
+func (r *TextReporter) Report(report StatsReport) error {
+	_, err := fmt.Fprintf(r.writer, "Received %d unique numbers, %d duplicates (Total processed: %d). "+
+		"Unique totals: %d \n", report.Received, report.Duplicates, report.Received+report.Duplicates, report.Total)
+	if err == nil && report.Rejected > 0 {
+		_, err = fmt.Fprintf(r.writer, "Rejected %d connections so far (server busy)\n", report.Rejected)
+	}
+	if err == nil && report.TimedOut > 0 {
+		_, err = fmt.Fprintf(r.writer, "Timed out %d connections so far\n", report.TimedOut)
+	}
+	for _, sink := range report.Sinks {
+		if err != nil {
+			break
+		}
+		_, err = fmt.Fprintf(r.writer, "Sink %s: %d written, %d dropped, %d failures\n",
+			sink.Name, sink.Written, sink.Dropped, sink.Failures)
+	}
+	return err
+}
+
+// Reports the statistics as JSON Lines, e.g:
+// {"timestamp":"...","interval_seconds":10,"received":5,"duplicates":2,"total":5,...}
+type JSONReporter struct {
+	writer io.Writer
+}
+
+// Creates a JSONReporter writing into the passed writer
+func NewJSONReporter(writer io.Writer) *JSONReporter {
+	return &JSONReporter{writer: writer}
+}
+
+// A StatsReport, as encoded by JSONReporter
+type jsonReport struct {
+	Timestamp         string     `json:"timestamp"`
+	IntervalSeconds   float64    `json:"interval_seconds"`
+	Received          int        `json:"received"`
+	Duplicates        int        `json:"duplicates"`
+	Total             int        `json:"total"`
+	RatePerSecond     float64    `json:"rate_per_second"`
+	ActiveConnections int64      `json:"active_connections"`
+	Rejected          int        `json:"rejected"`
+	TimedOut          int        `json:"timed_out"`
+	Sinks             []jsonSink `json:"sinks,omitempty"`
+}
+
+type jsonSink struct {
+	Name     string `json:"name"`
+	Written  int    `json:"written"`
+	Dropped  int    `json:"dropped"`
+	Failures int    `json:"failures"`
+}
+
+func (r *JSONReporter) Report(report StatsReport) error {
+	encoded := jsonReport{
+		Timestamp:         report.Time.UTC().Format(time.RFC3339Nano),
+		IntervalSeconds:   report.Interval.Seconds(),
+		Received:          report.Received,
+		Duplicates:        report.Duplicates,
+		Total:             report.Total,
+		RatePerSecond:     report.Rate(),
+		ActiveConnections: report.Active,
+		Rejected:          report.Rejected,
+		TimedOut:          report.TimedOut,
+	}
+	for _, sink := range report.Sinks {
+		encoded.Sinks = append(encoded.Sinks, jsonSink{
+			Name:     sink.Name,
+			Written:  sink.Written,
+			Dropped:  sink.Dropped,
+			Failures: sink.Failures,
+		})
+	}
+	line, err := json.Marshal(encoded)
+	if err != nil {
+		return fmt.Errorf("An error occurred while encoding the statistics: %w", err)
+	}
+	_, err = r.writer.Write(append(line, '\n'))
+	return err
+}
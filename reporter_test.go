@@ -0,0 +1,87 @@
+package numberserver
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type parseStatsFormatCase struct {
+	Name     string
+	Input    string
+	Expected StatsFormat
+	Errored  bool
+}
+
+func TestStatsReporter(t *testing.T) {
+	report := StatsReport{
+		Time:       time.Date(2020, 5, 17, 10, 0, 0, 0, time.UTC),
+		Interval:   10 * time.Second,
+		Received:   5,
+		Duplicates: 15,
+		Total:      105,
+		Rejected:   2,
+		Active:     3,
+		Sinks:      []SinkStats{{Name: "stdout", Written: 5}},
+	}
+
+	t.Run("Parse Stats Format", func(t *testing.T) {
+		testCases := []parseStatsFormatCase{
+			{Name: "Text", Input: "text", Expected: StatsText},
+			{Name: "Default", Input: "", Expected: StatsText},
+			{Name: "JSON", Input: "json", Expected: StatsJSON},
+			{Name: "Unknown", Input: "xml", Errored: true},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				format, err := ParseStatsFormat(tc.Input)
+				if tc.Errored {
+					assert.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tc.Expected, format)
+			})
+		}
+	})
+
+	t.Run("Rate", func(t *testing.T) {
+		assert.Equal(t, 2.0, report.Rate())
+		assert.Equal(t, 0.0, StatsReport{Received: 5}.Rate(), "No interval, no rate")
+	})
+
+	t.Run("Text", func(t *testing.T) {
+		var buffer bytes.Buffer
+		require.NoError(t, NewStatsReporter(StatsText, &buffer).Report(report))
+		expected := "Received 5 unique numbers, 15 duplicates (Total processed: 20). Unique totals: 105 \n" +
+			"Rejected 2 connections so far (server busy)\n" +
+			"Sink stdout: 5 written, 0 dropped, 0 failures\n"
+		assert.Equal(t, expected, buffer.String())
+	})
+
+	t.Run("JSON", func(t *testing.T) {
+		var buffer bytes.Buffer
+		reporter := NewStatsReporter(StatsJSON, &buffer)
+		require.NoError(t, reporter.Report(report))
+		require.NoError(t, reporter.Report(StatsReport{Time: report.Time}))
+		lines := bytes.Split(bytes.TrimSuffix(buffer.Bytes(), []byte("\n")), []byte("\n"))
+		require.Len(t, lines, 2, "A JSON object per line")
+		var decoded map[string]interface{}
+		require.NoError(t, json.Unmarshal(lines[0], &decoded))
+		assert.Equal(t, "2020-05-17T10:00:00Z", decoded["timestamp"])
+		assert.Equal(t, 10.0, decoded["interval_seconds"])
+		assert.Equal(t, 5.0, decoded["received"])
+		assert.Equal(t, 15.0, decoded["duplicates"])
+		assert.Equal(t, 105.0, decoded["total"])
+		assert.Equal(t, 2.0, decoded["rate_per_second"])
+		assert.Equal(t, 3.0, decoded["active_connections"])
+		assert.Len(t, decoded["sinks"], 1)
+		decoded = nil
+		require.NoError(t, json.Unmarshal(lines[1], &decoded))
+		assert.NotContains(t, decoded, "sinks")
+	})
+}
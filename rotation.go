@@ -0,0 +1,249 @@
+package numberserver
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Rotated segments are named after the log file plus a sequence number:
+// numbers.log.000001, numbers.log.000002, ... while the log file itself
+// (numbers.log) is always the active segment. Reading every segment
+// in sequence order, and then the active one, gives the whole log.
+// Rotated segments may be compressed (numbers.log.000001.gz)
+const SEGMENT_DIGITS = 6
+
+// A rotated segment of the log
+type logSegment struct {
+	Path       string
+	Seq        int
+	Compressed bool
+}
+
+// Path of the rotated segment with the passed sequence number
+func segmentPath(logfile string, seq int) string {
+	return fmt.Sprintf("%s.%0*d", logfile, SEGMENT_DIGITS, seq)
+}
+
+// Lists the rotated segments of the log file, sorted by sequence.
+// While a segment is being compressed, the plain one is listed
+func rotatedSegments(logfile string) ([]logSegment, error) {
+	entries, err := ioutil.ReadDir(filepath.Dir(logfile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("An error occurred while listing the log segments: %w", err)
+	}
+	prefix := filepath.Base(logfile) + "."
+	bySeq := make(map[int]logSegment)
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		suffix := strings.TrimPrefix(name, prefix)
+		compressed := isCompressed(suffix)
+		seq, err := strconv.Atoi(strings.TrimSuffix(suffix, CompressGzip.Extension()))
+		if err != nil || seq < 0 {
+			continue
+		}
+		if previous, ok := bySeq[seq]; ok && !previous.Compressed {
+			continue
+		}
+		bySeq[seq] = logSegment{
+			Path:       filepath.Join(filepath.Dir(logfile), name),
+			Seq:        seq,
+			Compressed: compressed,
+		}
+	}
+	segments := make([]logSegment, 0, len(bySeq))
+	for _, segment := range bySeq {
+		segments = append(segments, segment)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i].Seq < segments[j].Seq })
+	return segments, nil
+}
+
+// Paths of every existing part of the log, in writing order
+// (rotated segments, then the active one)
+func LogSegments(logfile string) ([]string, error) {
+	segments, err := rotatedSegments(logfile)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(segments)+1)
+	for _, segment := range segments {
+		paths = append(paths, segment.Path)
+	}
+	if _, err := os.Stat(logfile); err == nil {
+		paths = append(paths, logfile)
+	}
+	return paths, nil
+}
+
+// Opens the whole (segmented) log for reading, one segment at a time
+// (decompressing them, if needed)
+func OpenLog(logfile string) (io.ReadCloser, error) {
+	paths, err := LogSegments(logfile)
+	if err != nil {
+		return nil, err
+	}
+	return &segmentsReader{paths: paths}, nil
+}
+
+// Reads several files, one after the other
+type segmentsReader struct {
+	paths   []string
+	current io.ReadCloser
+}
+
+func (r *segmentsReader) Read(buffer []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.paths) == 0 {
+				return 0, io.EOF
+			}
+			file, err := openSegment(r.paths[0])
+			r.paths = r.paths[1:]
+			// Pruned in the meantime
+			if os.IsNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return 0, fmt.Errorf("An error occurred while opening a log segment: %w", err)
+			}
+			r.current = file
+		}
+		read, err := r.current.Read(buffer)
+		if err == io.EOF {
+			r.current.Close()
+			r.current = nil
+			if read == 0 {
+				continue
+			}
+			err = nil
+		}
+		return read, err
+	}
+}
+
+func (r *segmentsReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
+
+// Removes every rotated segment of the log file
+func removeSegments(logfile string) error {
+	segments, err := rotatedSegments(logfile)
+	if err != nil {
+		return err
+	}
+	for _, segment := range segments {
+		if err := removeSegment(logfile, segment.Seq); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Removes a rotated segment, both its plain and compressed files
+func removeSegment(logfile string, seq int) error {
+	path := segmentPath(logfile, seq)
+	for _, file := range []string{path, path + CompressGzip.Extension()} {
+		if err := os.Remove(file); err != nil && !os.IsNotExist(err) {
+			return fmt.Errorf("An error occurred while removing a log segment: %w", err)
+		}
+	}
+	return nil
+}
+
+// Rotates the active segment if it reached its max size or age.
+// Must be called holding outMu (so it's safe against every StreamWrite
+// routine of the logger, which share the active segment)
+func (l *Logger) rotateIfNeeded() {
+	if l.out == nil || l.out.size == 0 {
+		return
+	}
+	bySize := l.maxSize > 0 && l.out.size >= l.maxSize
+	byAge := l.maxAge > 0 && time.Since(l.out.opened) >= l.maxAge
+	if !bySize && !byAge {
+		return
+	}
+	if err := l.rotate(); err != nil {
+		l.setErr(err)
+	}
+}
+
+// Renames the active segment as the next rotated segment, and opens
+// a new active one. The old one is only closed (flushing its buffer into
+// the rotated segment) once the new one is open: if it can't be opened,
+// the rename is undone and writing goes on into the active segment.
+// The rotated segment is compressed and the oldest segments pruned in
+// the background (see Wait)
+func (l *Logger) rotate() error {
+	segments, err := rotatedSegments(l.filename)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(segments) > 0 {
+		next = segments[len(segments)-1].Seq + 1
+	}
+	segment := segmentPath(l.filename, next)
+	if err := os.Rename(l.filename, segment); err != nil {
+		return fmt.Errorf("An error occurred while rotating the logfile: %w", err)
+	}
+	out, err := l.openSegment()
+	if err != nil {
+		if renameErr := os.Rename(segment, l.filename); renameErr != nil {
+			fmt.Printf("An error occurred while restoring the logfile from %s: %v\n", segment, renameErr)
+		}
+		return fmt.Errorf("An error occurred while creating the logfile: %w", err)
+	}
+	closeErr := l.closeOut()
+	l.out = out
+	// Compressing and pruning in the background, one rotation at a time
+	l.archiving.Add(1)
+	go func() {
+		defer l.archiving.Done()
+		l.archiveMu.Lock()
+		defer l.archiveMu.Unlock()
+		if err := l.archive(segment); err != nil {
+			l.setErr(err)
+		}
+	}()
+	return closeErr
+}
+
+// Compresses the just rotated segment (if enabled) and
+// removes the oldest segments beyond maxSegments. Archives can run
+// out of order, so the segment may have been pruned already
+func (l *Logger) archive(path string) error {
+	if err := compressFile(path, l.compression); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if l.maxSegments <= 0 {
+		return nil
+	}
+	segments, err := rotatedSegments(l.filename)
+	if err != nil {
+		return err
+	}
+	for len(segments) > l.maxSegments {
+		if err := removeSegment(l.filename, segments[0].Seq); err != nil {
+			return err
+		}
+		segments = segments[1:]
+	}
+	return nil
+}
@@ -0,0 +1,195 @@
+package numberserver
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRotation(t *testing.T) {
+	setup := func(t *testing.T) (string, func()) {
+		dir, err := ioutil.TempDir("", "rotation")
+		require.NoError(t, err)
+		return filepath.Join(dir, "numbers.log"), func() { os.RemoveAll(dir) }
+	}
+	// Reads every line of the segmented log
+	readAll := func(t *testing.T, logfile string) []string {
+		log, err := OpenLog(logfile)
+		require.NoError(t, err)
+		defer log.Close()
+		var lines []string
+		scanner := bufio.NewScanner(log)
+		for scanner.Scan() {
+			lines = append(lines, scanner.Text())
+		}
+		require.NoError(t, scanner.Err())
+		return lines
+	}
+
+	t.Run("Log Segments", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		for path, content := range map[string]string{
+			segmentPath(logfile, 10): "3\n",
+			segmentPath(logfile, 2):  "1\n2\n",
+			logfile:                  "4\n",
+			// Not segments
+			logfile + ".snapshot":      "",
+			logfile + ".old":           "",
+			logfile + "2.000001":       "",
+			logfile + ".000003.gz.tmp": "",
+		} {
+			require.NoError(t, ioutil.WriteFile(path, []byte(content), 0644))
+		}
+		paths, err := LogSegments(logfile)
+		require.NoError(t, err)
+		assert.Equal(t, []string{segmentPath(logfile, 2), segmentPath(logfile, 10), logfile}, paths)
+		assert.Equal(t, []string{"1", "2", "3", "4"}, readAll(t, logfile))
+	})
+
+	t.Run("Missing log", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		assert.Empty(t, readAll(t, logfile))
+	})
+
+	t.Run("Rotate by size", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		// Every segment holds 4 lines of 10 bytes
+		logger := NewLogger(Filename(logfile), RotateSize(40), KeepSegments(2))
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		for i := 0; i < 18; i++ {
+			readStream <- fmt.Sprintf("%09d", i)
+		}
+		close(readStream)
+		require.NoError(t, logger.Wait())
+
+		paths, err := LogSegments(logfile)
+		require.NoError(t, err)
+		// 4 segments were rotated, only the last 2 were kept
+		assert.Equal(t, []string{segmentPath(logfile, 3), segmentPath(logfile, 4), logfile}, paths)
+		lines := readAll(t, logfile)
+		require.Len(t, lines, 10)
+		assert.Equal(t, "000000008", lines[0])
+		assert.Equal(t, "000000017", lines[9])
+	})
+
+	t.Run("Failed rotation", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		logger := NewLogger(Filename(logfile), RotateSize(20))
+		// The first new segment can't be opened
+		failures := 1
+		logger.openAppend = func(name string) (*os.File, error) {
+			if failures > 0 {
+				failures--
+				return nil, os.ErrPermission
+			}
+			return os.OpenFile(name, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		}
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		for i := 0; i < 5; i++ {
+			readStream <- fmt.Sprintf("%09d", i)
+		}
+		close(readStream)
+		assert.Error(t, logger.Wait())
+		// Writing went on into the active segment, then rotated again
+		assert.Equal(t, []string{"000000000", "000000001", "000000002", "000000003", "000000004"},
+			readAll(t, logfile))
+		paths, err := LogSegments(logfile)
+		require.NoError(t, err)
+		assert.Equal(t, []string{segmentPath(logfile, 1), segmentPath(logfile, 2), logfile}, paths)
+	})
+
+	t.Run("Rotate by age", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		logger := NewLogger(Filename(logfile), RotateAge(20*time.Millisecond),
+			FlushInterval(5*time.Millisecond))
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		readStream <- "1"
+		// Rotated on the flush interval, even if nothing else is written
+		assert.Eventually(t, func() bool {
+			_, err := os.Stat(segmentPath(logfile, 1))
+			return err == nil
+		}, time.Second, 5*time.Millisecond)
+		readStream <- "2"
+		close(readStream)
+		require.NoError(t, logger.Wait())
+		assert.Equal(t, []string{"1", "2"}, readAll(t, logfile))
+	})
+
+	t.Run("Fresh start removes segments", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		require.NoError(t, ioutil.WriteFile(segmentPath(logfile, 1), []byte("1\n"), 0644))
+		logger := NewLogger(Filename(logfile))
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		readStream <- "2"
+		close(readStream)
+		require.NoError(t, logger.Wait())
+		assert.Equal(t, []string{"2"}, readAll(t, logfile))
+	})
+
+	t.Run("Concurrent StreamWrite", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		logger := NewLogger(Filename(logfile), RotateSize(100), BufferSize(64))
+		writers := 4
+		perWriter := 250
+		var wg sync.WaitGroup
+		for i := 0; i < writers; i++ {
+			readStream := make(chan string)
+			require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+			wg.Add(1)
+			go func(writer int) {
+				defer wg.Done()
+				for j := 0; j < perWriter; j++ {
+					readStream <- fmt.Sprintf("%d-%d", writer, j)
+				}
+				close(readStream)
+			}(i)
+		}
+		wg.Wait()
+		require.NoError(t, logger.Wait())
+
+		lines := readAll(t, logfile)
+		assert.Len(t, lines, writers*perWriter)
+		seen := make(map[string]bool)
+		for _, line := range lines {
+			assert.False(t, seen[line], "Line %s written twice", line)
+			seen[line] = true
+		}
+		segments, err := rotatedSegments(logfile)
+		require.NoError(t, err)
+		assert.True(t, len(segments) > 1, "The log should have been rotated")
+	})
+
+	t.Run("Recover segmented log", func(t *testing.T) {
+		logfile, cleanup := setup(t)
+		defer cleanup()
+		require.NoError(t, ioutil.WriteFile(segmentPath(logfile, 1), []byte("1\n2\n"), 0644))
+		require.NoError(t, ioutil.WriteFile(segmentPath(logfile, 2), []byte("2\n3\n"), 0644))
+		require.NoError(t, ioutil.WriteFile(logfile, []byte("4\n"), 0644))
+		tracker := NewNumberTracker()
+		report, err := tracker.RecoverFile(logfile, logformat.Text, NewDefaultNumberChecker())
+		require.NoError(t, err)
+		assert.Equal(t, 4, report.Recovered)
+		assert.Equal(t, 1, report.Duplicates)
+	})
+}
@@ -0,0 +1,867 @@
+package numberserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
+)
+
+// Settings of a number Server (see DefaultConfig)
+type Config struct {
+	// Address to listen to. A Port of 0 picks an ephemeral one (see Addr).
+	// They're ignored if there are Listen addresses, which can be several
+	// (TCP or Unix sockets), all of them feeding the same tracker
+	Host   string
+	Port   int
+	Listen []ListenConfig
+	// TLS certificate and key files (TLS is disabled if empty), and the
+	// CA bundle verifying the clients' certificates (not required if empty)
+	TLSCert     string
+	TLSKey      string
+	TLSClientCA string
+	// Log file's path, and whether to append to it or recreate it on start
+	Logfile string
+	Append  bool
+	// Keyword shutting down the server, who can send it on the numbers'
+	// port, and the token required after it, e.g. "terminate s3cret"
+	// (none if empty). The AdminSocket (a Unix socket, disabled if empty)
+	// only accepts the keyword, from any local user with access to it
+	Termination       string
+	TerminationAccess TerminationAccess
+	TerminationToken  string
+	AdminSocket       string
+	// Max number of digits of the numbers received (max: 9)
+	Digits int
+	// Statistics are reported every interval (0 disables them), in the
+	// StatsFormat, into StatsFile (STDOUT if empty), or to a custom Reporter
+	Interval    time.Duration
+	StatsFormat StatsFormat
+	StatsFile   string
+	Reporter    StatsReporter
+	// Max number of concurrent connections, and what to do with
+	// the ones beyond it (OverloadTimeout is used by OverloadQueue)
+	MaxConn         int
+	Overload        OverloadPolicy
+	OverloadTimeout time.Duration
+	// What to do with connections sending invalid lines
+	OnInvalid InvalidPolicy
+	// Connections are closed once they wait longer than IdleTimeout for
+	// a new line, take longer than ReadTimeout to send a line, or are
+	// open longer than MaxLifetime (0 disables each of them)
+	IdleTimeout time.Duration
+	ReadTimeout time.Duration
+	MaxLifetime time.Duration
+	// Log file's encoding, buffering and fsync policy (see Logger)
+	Format        logformat.Format
+	BufferSize    int
+	FlushInterval time.Duration
+	Fsync         FsyncPolicy
+	FsyncInterval time.Duration
+	// Rotation and compression of the log file (0 disables them)
+	RotateSize   int64
+	RotateAge    time.Duration
+	KeepSegments int
+	Compression  Compression
+	// Other destinations for the unique numbers (see Sink)
+	Sinks []SinkConfig
+	// Snapshots of the unique numbers (disabled if SnapshotDir is empty)
+	SnapshotDir      string
+	SnapshotInterval time.Duration
+	// Address of the admin HTTP API (disabled if empty, see adminHandler)
+	AdminAddr string
+}
+
+// Config with the same defaults as the command line
+func DefaultConfig() Config {
+	return Config{
+		Port:             4000,
+		Logfile:          DEFAULT_LOG_FILE,
+		Termination:      "terminate",
+		Digits:           9,
+		Interval:         10 * time.Second,
+		MaxConn:          5,
+		OverloadTimeout:  DEFAULT_OVERLOAD_TIMEOUT,
+		Format:           logformat.Text,
+		BufferSize:       0,
+		FlushInterval:    time.Second,
+		Fsync:            SyncNever,
+		FsyncInterval:    time.Second,
+		SnapshotInterval: time.Minute,
+	}
+}
+
+// An invalid value of a Config's field
+type ConfigError struct {
+	// Name of the Config's field, e.g. Port
+	Field  string
+	Reason string
+}
+
+func (e *ConfigError) Error() string {
+	return e.Reason
+}
+
+func invalidField(field, reason string) error {
+	return &ConfigError{Field: field, Reason: reason}
+}
+
+// Checks the config's values. The error is a *ConfigError,
+// naming the first invalid field
+func (c Config) Validate() error {
+	if c.Port < 0 || c.Port > 65535 {
+		return invalidField("Port", "Port can't be a negative number, nor greater than 65535")
+	}
+	for _, listen := range c.Listen {
+		if listen.Address == "" || listen.MaxConn < 0 || listen.DatagramSize < 0 {
+			return invalidField("Listen", fmt.Sprintf("Invalid address to listen to: %s", listen))
+		}
+	}
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		return invalidField("TLSKey", "The TLS certificate and key must be set together")
+	}
+	if c.TLSClientCA != "" && c.TLSCert == "" {
+		return invalidField("TLSClientCA", "The TLS client CA requires a TLS certificate")
+	}
+	for _, listen := range c.Listen {
+		if c.TLSCert != "" && (listen.Network == "unix" || listen.datagrams()) {
+			return invalidField("TLSCert", fmt.Sprintf("TLS can't be used listening to %s (only tcp)", listen))
+		}
+	}
+	if c.Termination == "" {
+		return invalidField("Termination", "The termination keyword can't be empty")
+	}
+	if strings.ContainsAny(c.TerminationToken, " \t") {
+		return invalidField("TerminationToken", "The termination token can't have spaces")
+	}
+	if c.Digits < 0 || c.Digits > 9 {
+		return invalidField("Digits", "Digits can't be a negative number, nor greater than 9")
+	}
+	if c.Interval < 0 {
+		return invalidField("Interval", "Statistics' interval can't be negative")
+	}
+	if c.MaxConn < 0 {
+		return invalidField("MaxConn", "The number of max concurrent connections can't be negative")
+	}
+	if c.Overload == OverloadQueue && c.OverloadTimeout <= 0 {
+		return invalidField("OverloadTimeout", "The overload queue's timeout must be positive")
+	}
+	if c.IdleTimeout < 0 {
+		return invalidField("IdleTimeout", "Connections' idle timeout can't be negative")
+	}
+	if c.ReadTimeout < 0 {
+		return invalidField("ReadTimeout", "Connections' read timeout can't be negative")
+	}
+	if c.MaxLifetime < 0 {
+		return invalidField("MaxLifetime", "Connections' max lifetime can't be negative")
+	}
+	if c.BufferSize < 0 {
+		return invalidField("BufferSize", "The log buffer's size can't be negative")
+	}
+	if c.FlushInterval < 0 {
+		return invalidField("FlushInterval", "The log buffer's flush interval can't be negative")
+	}
+	if c.Fsync == SyncPeriodically && c.FsyncInterval <= 0 {
+		return invalidField("FsyncInterval", "The fsync interval must be positive")
+	}
+	if c.RotateSize < 0 {
+		return invalidField("RotateSize", "Rotation's size can't be negative")
+	}
+	if c.RotateAge < 0 {
+		return invalidField("RotateAge", "Rotation's age can't be negative")
+	}
+	if c.Compression != CompressNone && c.RotateSize == 0 && c.RotateAge == 0 {
+		return invalidField("Compression", "Compressing the log's segments requires rotating it (by size or age)")
+	}
+	if c.KeepSegments < 0 {
+		return invalidField("KeepSegments", "The number of rotated segments kept can't be negative")
+	}
+	if c.SnapshotDir != "" && c.SnapshotInterval <= 0 {
+		return invalidField("SnapshotInterval", "Snapshots' interval must be positive")
+	}
+	return nil
+}
+
+// Addresses to listen to: Listen, or else Host and Port
+func (c Config) listens() []ListenConfig {
+	if len(c.Listen) > 0 {
+		return c.Listen
+	}
+	return []ListenConfig{{Network: "tcp", Address: net.JoinHostPort(c.Host, strconv.Itoa(c.Port))}}
+}
+
+// Number server: accepts connections, logging the unique numbers received
+// until it's shut down (termination keyword, Shutdown or Start's context)
+// example usage:
+//
+//	server, err := NewServer(DefaultConfig())
+//	err = server.Start(ctx)
+//	err = server.Wait()
+type Server struct {
+	config      Config
+	listeners   []servedListener
+	checker     *NumberChecker
+	tracker     *NumberTracker
+	logger      *Logger
+	snapshotter *Snapshotter
+	metrics     *Metrics
+	connections *connRegistry
+	limiter     *connLimiter
+	guard       terminationGuard
+	// TLS of the clients' connections (nil if disabled)
+	tls *tlsLoader
+	// Serializes reloads (see Reload), which signal retime
+	// when the statistics' interval changed
+	reloadMu sync.Mutex
+	retime   chan struct{}
+	// Admin HTTP API and socket (nil if disabled, see AdminAddr and AdminSocket)
+	admin         *http.Server
+	adminListener net.Listener
+	adminSocket   net.Listener
+	// Canceled on shutdown (stopping is closed then)
+	cancel   context.CancelFunc
+	stopping <-chan struct{}
+	// Closed once the log file is complete (see Wait)
+	done chan struct{}
+	err  error
+}
+
+// Creates a Server for the passed config (not started yet, see Start)
+func NewServer(config Config) (*Server, error) {
+	if err := config.Validate(); err != nil {
+		return nil, err
+	}
+	tlsConfig, err := newTLSLoader(config)
+	if err != nil {
+		return nil, err
+	}
+	// Creating Logger
+	logger := NewLogger(Filename(config.Logfile), Appender(config.Append),
+		BufferSize(config.BufferSize), FlushInterval(config.FlushInterval),
+		SyncPolicy(config.Fsync), SyncInterval(config.FsyncInterval),
+		RotateSize(config.RotateSize), RotateAge(config.RotateAge), KeepSegments(config.KeepSegments),
+		Compress(config.Compression), LogFormat(config.Format, config.Digits))
+	for _, sink := range config.Sinks {
+		// HTTP batches are labeled with the log's format
+		if httpSink, ok := sink.Sink.(*HTTPSink); ok {
+			httpSink.SetContentType(config.Format.ContentType())
+		}
+		WithSink(sink)(logger)
+	}
+	// Creating Number Checker
+	checker := NewDefaultNumberChecker()
+	checker.SetTermination(config.Termination)
+	checker.SetNumLimit(config.Digits)
+	server := &Server{
+		config:  config,
+		tls:     tlsConfig,
+		checker: checker,
+		// Creating Number Tracker (dedup bitset sized from the max digits)
+		tracker:     NewNumberTracker(Backend(NewBitsetDeduplicatorForDigits(config.Digits))),
+		logger:      logger,
+		metrics:     NewMetrics(),
+		connections: newConnRegistry(),
+		limiter:     newConnLimiter(config.MaxConn),
+		guard:       terminationGuard{access: config.TerminationAccess, token: config.TerminationToken},
+		retime:      make(chan struct{}, 1),
+		done:        make(chan struct{}),
+	}
+	// Snapshots of the unique numbers logged (if enabled)
+	if config.SnapshotDir != "" {
+		server.snapshotter = NewSnapshotter(config.SnapshotDir, config.Logfile, config.Format, checker,
+			NewBitsetDeduplicatorForDigits(config.Digits))
+	}
+	return server, nil
+}
+
+// Starts listening and serving in the background. With Append, the state
+// is rebuilt from the existing log file before accepting any connection.
+// Canceling ctx shuts the server down (same as Shutdown)
+func (s *Server) Start(ctx context.Context) error {
+	if s.listeners != nil {
+		return errors.New("The server was already started")
+	}
+	select {
+	case <-s.done:
+		// Starting already failed
+		return s.err
+	default:
+	}
+	// Closed if starting fails
+	var closers []io.Closer
+	abort := func(err error) error {
+		for _, closer := range closers {
+			closer.Close()
+		}
+		// Nothing will be logged: Wait returns the error right away
+		s.err = err
+		close(s.done)
+		return err
+	}
+	var served []servedListener
+	for _, listen := range s.config.listens() {
+		if listen.datagrams() {
+			packets, err := listen.listenPacket()
+			if err != nil {
+				return abort(err)
+			}
+			closers = append(closers, packets)
+			served = append(served, servedListener{packets: packets, datagramSize: listen.DatagramSize})
+			continue
+		}
+		listener, err := listen.listen()
+		if err != nil {
+			return abort(err)
+		}
+		closers = append(closers, listener)
+		if s.tls != nil {
+			listener = tls.NewListener(listener, s.tls.listenerConfig())
+		}
+		current := servedListener{listener: listener}
+		if listen.MaxConn > 0 {
+			current.limiter = newConnLimiter(listen.MaxConn)
+		}
+		served = append(served, current)
+	}
+	var err error
+	if s.config.AdminAddr != "" {
+		s.adminListener, err = net.Listen("tcp", s.config.AdminAddr)
+		if err != nil {
+			return abort(fmt.Errorf("An error occurred when trying to create the admin connection: %w", err))
+		}
+		closers = append(closers, s.adminListener)
+	}
+	if s.config.AdminSocket != "" {
+		// Only accessible by the user running the server
+		s.adminSocket, err = listenUnix(s.config.AdminSocket, 0600)
+		if err != nil {
+			return abort(err)
+		}
+		closers = append(closers, s.adminSocket)
+	}
+	// Destination of the statistics (even if disabled, as reloading
+	// the config can enable them, see Reload)
+	reporter := s.config.Reporter
+	var statsFile *os.File
+	if reporter == nil {
+		output := os.Stdout
+		if s.config.StatsFile != "" {
+			statsFile, err = os.OpenFile(s.config.StatsFile, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+			if err != nil {
+				return abort(fmt.Errorf("An error occurred while opening the statistics file: %w", err))
+			}
+			closers = append(closers, statsFile)
+			output = statsFile
+		}
+		reporter = NewStatsReporter(s.config.StatsFormat, output)
+	}
+	if err := s.recover(); err != nil {
+		return abort(err)
+	}
+	s.listeners = served
+	fmt.Println("Starting number server. Welcome!")
+	ctx, s.cancel = context.WithCancel(ctx)
+	s.stopping = ctx.Done()
+	// Report statistics every interval
+	go func() {
+		if statsFile != nil {
+			defer statsFile.Close()
+		}
+		s.reportStatistics(ctx, reporter)
+	}()
+	if s.snapshotter != nil {
+		go s.snapshotter.Run(ctx, s.config.SnapshotInterval)
+	}
+	// Serving the admin API until the log file is complete
+	if s.adminListener != nil {
+		s.admin = &http.Server{Handler: s.adminHandler()}
+		go s.admin.Serve(s.adminListener)
+	}
+	if s.adminSocket != nil {
+		go s.serveAdminSocket(ctx, s.adminSocket)
+	}
+	go func() {
+		defer close(s.done)
+		if s.admin != nil {
+			defer s.admin.Close()
+		}
+		if s.adminSocket != nil {
+			defer s.adminSocket.Close()
+		}
+		// Blocks until the listeners are closed and every number accepted is logged
+		s.err = serve(ctx, s.cancel, served, s.checker, s.tracker, s.logger, serveOptions{
+			Limiter:         s.limiter,
+			Guard:           s.guard,
+			Overload:        s.config.Overload,
+			OverloadTimeout: s.config.OverloadTimeout,
+			OnInvalid:       s.config.OnInvalid,
+			Metrics:         s.metrics,
+			Connections:     s.connections,
+			Timeouts: connTimeouts{
+				Idle:     s.config.IdleTimeout,
+				Line:     s.config.ReadTimeout,
+				Lifetime: s.config.MaxLifetime,
+			},
+		})
+		s.cancel()
+		if s.err != nil {
+			s.err = fmt.Errorf("An error occurred while writing the log file: %w", s.err)
+			return
+		}
+		if s.snapshotter != nil {
+			if err := s.snapshotter.Snapshot(); err != nil {
+				fmt.Printf("An error occurred while taking a snapshot: %v\n", err)
+			}
+		}
+		fmt.Printf("Log file %s is complete. Bye!\n", s.config.Logfile)
+	}()
+	return nil
+}
+
+// Address the server is listening to (nil if not started),
+// the first one if there are several (see Addrs)
+func (s *Server) Addr() net.Addr {
+	if s.listeners == nil {
+		return nil
+	}
+	return s.listeners[0].addr()
+}
+
+// Addresses the server is listening to, in the order of Config's Listen
+// (nil if not started)
+func (s *Server) Addrs() []net.Addr {
+	var addrs []net.Addr
+	for _, listener := range s.listeners {
+		addrs = append(addrs, listener.addr())
+	}
+	return addrs
+}
+
+// Stops accepting connections and reading from the clients, then waits
+// until every number already read is logged (see Wait),
+// or ctx is done (returning its error)
+func (s *Server) Shutdown(ctx context.Context) error {
+	if s.cancel == nil {
+		return errors.New("The server wasn't started")
+	}
+	s.cancel()
+	select {
+	case <-s.done:
+		return s.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Blocks until the server is shut down and its log file is complete.
+// Returns the error found while writing the log, if any
+// (or Start's error, if starting failed)
+func (s *Server) Wait() error {
+	<-s.done
+	return s.err
+}
+
+// Tracker of the unique numbers (and statistics)
+func (s *Server) Tracker() *NumberTracker {
+	return s.tracker
+}
+
+// Monotonic counters of the server's activity
+func (s *Server) Metrics() *Metrics {
+	return s.metrics
+}
+
+// Active client connections, in order of arrival
+func (s *Server) Connections() []ConnectionInfo {
+	return s.connections.list()
+}
+
+// Address the admin API is listening to (nil if disabled or not started)
+func (s *Server) AdminAddr() net.Addr {
+	if s.adminListener == nil {
+		return nil
+	}
+	return s.adminListener.Addr()
+}
+
+// Logger writing the log file (and feeding the sinks)
+func (s *Server) Logger() *Logger {
+	return s.logger
+}
+
+// Rebuilds the tracker's state from the existing log (with Append),
+// or discards a previous snapshot (otherwise)
+func (s *Server) recover() error {
+	if !s.config.Append {
+		// A fresh log file makes any previous snapshot stale
+		if s.snapshotter != nil {
+			if err := s.snapshotter.Reset(); err != nil {
+				fmt.Printf("%v\n", err)
+			}
+		}
+		return nil
+	}
+	var report RecoveryReport
+	var err error
+	if s.snapshotter != nil {
+		report, err = s.snapshotter.Restore(s.tracker)
+	} else {
+		report, err = s.tracker.RecoverFile(s.config.Logfile, s.config.Format, s.checker)
+	}
+	if err != nil {
+		return fmt.Errorf("An error occurred when trying to recover the log file: %w", err)
+	}
+	if report.SnapshotError != nil {
+		fmt.Printf("Discarded snapshot, replaying the whole log: %v\n", report.SnapshotError)
+	}
+	fmt.Printf("Recovered %d unique numbers from %s (%d from snapshot, %d duplicates, %d corrupt records)\n",
+		report.Recovered, s.config.Logfile, report.Snapshot, report.Duplicates, report.Corrupt)
+	return nil
+}
+
+// Reports the statistics (along with the active connections and
+// sinks' counters) every interval, until ctx is canceled.
+// The interval can change meanwhile (see Reload), 0 pauses the reports
+func (s *Server) reportStatistics(ctx context.Context, reporter StatsReporter) {
+	var ticker *time.Ticker
+	// Never fires while paused
+	var ticks <-chan time.Time
+	restart := func() {
+		if ticker != nil {
+			ticker.Stop()
+			ticker, ticks = nil, nil
+		}
+		if interval := s.statsInterval(); interval > 0 {
+			ticker = time.NewTicker(interval)
+			ticks = ticker.C
+		}
+	}
+	restart()
+	defer func() {
+		if ticker != nil {
+			ticker.Stop()
+		}
+	}()
+	last := time.Now()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-s.retime:
+			restart()
+		case now := <-ticks:
+			report := s.tracker.Stats.Report(now.Sub(last))
+			last = now
+			report.Active = s.metrics.Snapshot().Active
+			report.Sinks = s.logger.SinkStats()
+			if err := reporter.Report(report); err != nil {
+				fmt.Printf("An error occurred while reporting the statistics: %v\n", err)
+			}
+		}
+	}
+}
+
+// Per connection behavior of serve (see Config)
+type serveOptions struct {
+	MaxConn         int
+	Overload        OverloadPolicy
+	OverloadTimeout time.Duration
+	OnInvalid       InvalidPolicy
+	Timeouts        connTimeouts
+	// Counters of the activity, registry of the active connections and
+	// limiter of the concurrent ones, sized MaxConn (new ones are used if nil)
+	Metrics     *Metrics
+	Connections *connRegistry
+	Limiter     *connLimiter
+	// Who can send the termination keyword (anyone, without a token, if zero)
+	Guard terminationGuard
+}
+
+// Accepts connections until the listeners are closed (or ctx is canceled,
+// any of them failing cancels it), logging the unique numbers received (see handleConnection).
+// On shutdown, it stops reading new input, but every number already read
+// is drained through the pipeline: it only returns once the logger has
+// written (and fsynced) all of them, and every acknowledgement was sent.
+// It takes over the logger's flush hook (see OnFlushed)
+func serve(ctx context.Context, cancel context.CancelFunc, listeners []servedListener,
+	checker Checker, tracker *NumberTracker, logger *Logger, options serveOptions) error {
+	if options.Metrics == nil {
+		options.Metrics = NewMetrics()
+	}
+	if options.Connections == nil {
+		options.Connections = newConnRegistry()
+	}
+	if options.Limiter == nil {
+		options.Limiter = newConnLimiter(options.MaxConn)
+	}
+	metrics := options.Metrics
+	// Acknowledgements of the clients asking for them
+	// (and latency of the numbers logged). The numbers that
+	// couldn't be logged are forgotten, so they can be retried
+	acks := newAckRouter()
+	OnFlushed(func(records []logformat.Record, err error) {
+		acks.flushed(records, err)
+		if err == nil {
+			metrics.flushed(records)
+			return
+		}
+		for _, record := range records {
+			tracker.forget(int(record.Number))
+		}
+		metrics.forgot(len(records))
+	})(logger)
+	// Coordination channels
+	// (the pipeline isn't bound to ctx, it's drained by closing recordInput)
+	recordInput := make(chan logformat.Record)
+	// Writing to logfile
+	if err := logger.StreamRecords(context.Background(), recordInput); err != nil {
+		close(recordInput)
+		return err
+	}
+	// Stop accepting on cancellation
+	go func() {
+		<-ctx.Done()
+		for _, served := range listeners {
+			served.Close()
+		}
+	}()
+	// Handlers in flight, waited for before draining
+	var handlers sync.WaitGroup
+	// Ids of the connections (logged along with their numbers)
+	var lastConnID uint64
+	// Turns away a connection (see OverloadPolicy)
+	reject := func(conn net.Conn) {
+		tracker.Stats.IncreaseRejected()
+		atomic.AddUint64(&metrics.rejected, 1)
+		// (reading too, for the TLS handshake)
+		conn.SetDeadline(time.Now().Add(time.Second))
+		conn.Write([]byte(SERVER_BUSY_REPLY))
+		conn.Close()
+	}
+	// Accepting connections from every listener (a failing one stops them all)
+	var accepting sync.WaitGroup
+	for _, served := range listeners {
+		if served.packets != nil {
+			accepting.Add(1)
+			go func(served servedListener) {
+				defer accepting.Done()
+				connID := atomic.AddUint64(&lastConnID, 1)
+				serveDatagrams(ctx, cancel, served.packets, served.datagramSize, connID, checker, tracker,
+					metrics, recordInput)
+			}(served)
+			continue
+		}
+		// Rate limitting
+		limiter := served.limiter
+		if limiter == nil {
+			limiter = options.Limiter
+		}
+		listener := served.listener
+		accepting.Add(1)
+		go func() {
+			defer accepting.Done()
+			for {
+				// Blocking: new clients wait in the backlog until a place is free.
+				// It isn't taken until accepting one, so that a listener waiting
+				// for clients holds no place
+				if options.Overload == OverloadBlock && !limiter.wait(ctx) {
+					return
+				}
+				// Accepting connections
+				conn, err := listener.Accept()
+				if err != nil {
+					fmt.Printf("The server stopped accepting connections (%v) \n", err)
+					cancel()
+					return
+				}
+				// Checking-in once accepted. Another listener sharing the limiter
+				// may have taken the place meanwhile: waiting for the next one
+				// (this one connection at most, the rest is left in the backlog)
+				if options.Overload == OverloadBlock && !limiter.acquire(ctx, nil) {
+					conn.Close()
+					return
+				}
+				// Handling connection
+				atomic.AddUint64(&metrics.accepted, 1)
+				connID := atomic.AddUint64(&lastConnID, 1)
+				handlers.Add(1)
+				go func() {
+					defer handlers.Done()
+					switch options.Overload {
+					case OverloadReject:
+						if !limiter.tryAcquire() {
+							reject(conn)
+							return
+						}
+					case OverloadQueue:
+						timeout := time.NewTimer(options.OverloadTimeout)
+						defer timeout.Stop()
+						if !limiter.acquire(ctx, timeout.C) {
+							if ctx.Err() != nil {
+								conn.Close()
+							} else {
+								reject(conn)
+							}
+							return
+						}
+					}
+					// Releasing connection's place in the queue
+					defer limiter.release()
+					atomic.AddInt64(&metrics.active, 1)
+					defer atomic.AddInt64(&metrics.active, -1)
+					handleConnection(ctx, cancel, conn, connID, checker, tracker, acks, options, recordInput)
+				}()
+			}
+		}()
+	}
+	accepting.Wait()
+	// Draining: no more senders, then closing the pipeline's input
+	handlers.Wait()
+	close(recordInput)
+	err := logger.Wait()
+	acks.close()
+	return err
+}
+
+// Reads each client's input, line by line, passing on the unique numbers
+// (along with when they were received and from which connection) to be
+// logged. Invalid lines are handled according to the options' InvalidPolicy.
+// Lines starting with QUERY_PREFIX are replied whether the number was seen
+// (malformed ones with an error line, without closing the connection).
+// A client sending a handshake as its first line gets its lines
+// acknowledged (see connAcker); invalid lines are then rejected in order,
+// closing the connection unless the policy is InvalidReplyContinue.
+// Connections exceeding the options' timeouts are closed (and counted).
+// Once ctx is canceled, the lines already read are still processed,
+// but nothing else is read from the connection
+func handleConnection(ctx context.Context, cancel context.CancelFunc, conn net.Conn, connID uint64,
+	checker Checker, tracker *NumberTracker, acks *ackRouter, options serveOptions,
+	recordInput chan<- logformat.Record) {
+	var acker *connAcker
+	defer func() {
+		// The acker closes the connection once everything is acknowledged
+		if acker != nil {
+			acker.finish()
+		} else {
+			conn.Close()
+		}
+	}()
+	reader := newDeadlineReader(conn, options.Timeouts)
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case <-ctx.Done():
+			// Unblocks the scanner
+			reader.stop()
+		case <-finished:
+		}
+	}()
+	client := clientName(conn)
+	metrics := options.Metrics
+	// Listed while active (see Server's Connections)
+	stats := options.Connections.add(connID, client)
+	defer options.Connections.remove(connID)
+	scanner := bufio.NewScanner(countingReader{reader: reader, metrics: metrics})
+	for first := true; scanner.Scan(); first = false {
+		input := scanner.Text()
+		if first {
+			if mode, ok := parseHandshake(input); ok {
+				acker = acks.start(connID, conn, mode, input)
+				continue
+			}
+		}
+		if strings.HasPrefix(input, QUERY_PREFIX) {
+			// Read-only, it's replied right away (in order, with acknowledgements)
+			query := strings.TrimPrefix(input, QUERY_PREFIX)
+			atomic.AddUint64(&metrics.queries, 1)
+			status := AckRejected
+			err := checker.CheckInput(query)
+			if err == nil {
+				value, _ := strconv.Atoi(query)
+				status = queryStatus(tracker.Seen(value))
+			}
+			if acker != nil {
+				acker.add(status, query, err)
+			} else if err := reader.reply(ackReplies([]ackEntry{{status: status, input: query, err: err}},
+				ackPerLine)); err != nil && ctx.Err() == nil {
+				// The client isn't reading its replies
+				return
+			}
+			continue
+		}
+		if requested, err := options.Guard.check(checker, input, conn.RemoteAddr()); requested {
+			if err == nil {
+				fmt.Printf("Shutdown requested by %s (connection %d)\n", client, connID)
+				// Cancelling global context (this closes the listener)
+				cancel()
+				return
+			}
+			// Handled as an invalid line (without replying why)
+			fmt.Printf("Refused shutdown request from %s (connection %d): %v\n", client, connID, err)
+		}
+		if err := checker.CheckInput(input); err != nil {
+			atomic.AddUint64(&metrics.invalid, 1)
+			stats.invalidReceived()
+			if acker != nil {
+				acker.add(AckRejected, input, err)
+			} else if options.OnInvalid != InvalidClose {
+				if err := reader.reply(errorLine(err)); err != nil && ctx.Err() == nil {
+					return
+				}
+			}
+			if options.OnInvalid == InvalidReplyContinue {
+				continue
+			}
+			// This will close connection on exit
+			// (see deferred at the beginning of the function)
+			return
+		}
+		value, err := strconv.Atoi(input)
+		// Should be unreachable (given the CheckInput)
+		if err != nil {
+			fmt.Printf("An error occurred while processing req: %s. Err: %v", input, err)
+			return
+		}
+		// Marking it as seen (only true the first time)
+		unique := tracker.track(value)
+		metrics.received(unique)
+		stats.numberReceived(unique)
+		if !unique {
+			if acker != nil {
+				acker.add(AckDuplicate, input, nil)
+			}
+			continue
+		}
+		// Acknowledged once flushed (queued before it can be flushed)
+		if acker != nil {
+			acker.add(AckNew, input, nil)
+		}
+		recordInput <- logformat.Record{
+			Number:     uint32(value),
+			ReceivedAt: time.Now(),
+			Client:     client,
+			ConnID:     connID,
+		}
+	}
+	// Deadlines are also used to stop reading on shutdown
+	if isTimeout(scanner.Err()) && ctx.Err() == nil {
+		tracker.Stats.IncreaseTimedOut()
+		atomic.AddUint64(&metrics.timedOut, 1)
+	} else if tlsConn, ok := conn.(*tls.Conn); ok && scanner.Err() != nil && ctx.Err() == nil &&
+		!tlsConn.ConnectionState().HandshakeComplete {
+		fmt.Printf("TLS handshake with %s failed (connection %d): %v\n", client, connID, scanner.Err())
+	}
+}
@@ -0,0 +1,697 @@
+package numberserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServe(t *testing.T) {
+	t.Run("Lossless shutdown", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "serve")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		logfile := filepath.Join(dir, "numbers.log")
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		tracker := NewNumberTracker()
+		served := make(chan error)
+		go func() {
+			served <- serve(ctx, cancel, []servedListener{{listener: listener}}, NewDefaultNumberChecker(),
+				tracker, NewLogger(Filename(logfile)), serveOptions{MaxConn: 3})
+		}()
+
+		// Numbers sent, with a duplicate every 10 of them
+		total := 5000
+		expected := make(map[string]bool)
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		writer := bufio.NewWriter(conn)
+		for i := 0; i < total; i++ {
+			value := i
+			if i%10 == 9 {
+				value = i - 1
+			}
+			expected[fmt.Sprintf("%d", value)] = true
+			fmt.Fprintf(writer, "%09d\n", value)
+		}
+		fmt.Fprintln(writer, "terminate")
+		require.NoError(t, writer.Flush())
+		defer conn.Close()
+
+		select {
+		case err := <-served:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("The server didn't shutdown")
+		}
+
+		file, err := os.Open(logfile)
+		require.NoError(t, err)
+		defer file.Close()
+		logged := make(map[string]int)
+		scanner := bufio.NewScanner(file)
+		for scanner.Scan() {
+			logged[scanner.Text()]++
+		}
+		assert.Equal(t, len(expected), len(logged), "Every unique number should have been logged")
+		for value := range expected {
+			assert.True(t, logged[value] == 1, "Number %s logged %d times", value, logged[value])
+		}
+		assert.Equal(t, len(expected), tracker.Stats.Received)
+		assert.Equal(t, total-len(expected), tracker.Stats.Duplicates)
+	})
+
+	t.Run("Lost numbers forgotten", func(t *testing.T) {
+		if _, err := os.Stat("/dev/full"); err != nil {
+			t.Skip("Writes can't be failed without /dev/full")
+		}
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		tracker := NewNumberTracker()
+		metrics := NewMetrics()
+		served := make(chan error)
+		go func() {
+			// Every write fails (no space left on device)
+			served <- serve(ctx, cancel, []servedListener{{listener: listener}}, NewDefaultNumberChecker(),
+				tracker, NewLogger(Filename("/dev/full"), BufferSize(0)), serveOptions{MaxConn: 1, Metrics: metrics})
+		}()
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		fmt.Fprintln(conn, "ack")
+		line, err := reader.ReadString('\n')
+		require.NoError(t, err)
+		require.Equal(t, "OK ack\n", line)
+		// Retried, it's still new (not a duplicate)
+		for i := 0; i < 2; i++ {
+			fmt.Fprintln(conn, "000000001")
+			line, err = reader.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, "LOST 000000001\n", line)
+			assert.False(t, tracker.Seen(1))
+		}
+		cancel()
+		assert.Error(t, <-served)
+		// Not counted as unique
+		assert.Equal(t, 0, tracker.Stats.Total)
+		assert.Equal(t, 0, tracker.Stats.Received)
+		snapshot := metrics.Snapshot()
+		assert.Equal(t, uint64(2), snapshot.Unique)
+		assert.Equal(t, uint64(2), snapshot.Lost)
+	})
+
+	t.Run("Records metadata", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "serve")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		logfile := filepath.Join(dir, "numbers.log")
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		tracker := NewNumberTracker()
+		served := make(chan error)
+		go func() {
+			served <- serve(ctx, cancel, []servedListener{{listener: listener}}, NewDefaultNumberChecker(), tracker,
+				NewLogger(Filename(logfile), LogFormat(logformat.JSONLines, 9)), serveOptions{MaxConn: 2})
+		}()
+
+		start := time.Now()
+		// Connection ids are given in order of arrival
+		clients := make(map[uint32]string)
+		var conns []net.Conn
+		for i := 1; i <= 2; i++ {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			require.NoError(t, err)
+			defer conn.Close()
+			conns = append(conns, conn)
+			clients[uint32(i)] = conn.LocalAddr().String()
+			fmt.Fprintf(conn, "%09d\n", i)
+			number := i
+			require.Eventually(t, func() bool { return tracker.Seen(number) }, 5*time.Second, time.Millisecond)
+		}
+		fmt.Fprintln(conns[0], "terminate")
+		select {
+		case err := <-served:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("The server didn't shutdown")
+		}
+
+		file, err := os.Open(logfile)
+		require.NoError(t, err)
+		defer file.Close()
+		decoder := logformat.NewDecoder(file, logformat.JSONLines)
+		for i := 1; i <= 2; i++ {
+			record, err := decoder.Decode()
+			require.NoError(t, err)
+			assert.Equal(t, uint32(i), record.Number)
+			assert.Equal(t, uint64(i), record.ConnID)
+			assert.Equal(t, clients[record.Number], record.Client)
+			assert.False(t, record.ReceivedAt.Before(start.Truncate(time.Microsecond)))
+		}
+	})
+
+	t.Run("Invalid input closes connection", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "serve")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		served := make(chan error)
+		go func() {
+			served <- serve(ctx, cancel, []servedListener{{listener: listener}}, NewDefaultNumberChecker(),
+				NewNumberTracker(), NewLogger(Filename(filepath.Join(dir, "numbers.log"))), serveOptions{MaxConn: 1})
+		}()
+
+		conn, err := net.Dial("tcp", listener.Addr().String())
+		require.NoError(t, err)
+		defer conn.Close()
+		fmt.Fprintln(conn, "12")
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = conn.Read(make([]byte, 1))
+		assert.Error(t, err, "The connection should have been closed")
+
+		// Cancelling from outside (i.e. signal)
+		cancel()
+		select {
+		case err := <-served:
+			require.NoError(t, err)
+		case <-time.After(10 * time.Second):
+			t.Fatal("The server didn't shutdown")
+		}
+	})
+}
+
+type invalidConfigCase struct {
+	Name   string
+	Config func(*Config)
+	// Field named by the error
+	Field string
+}
+
+type unreadRepliesCase struct {
+	Name      string
+	OnInvalid InvalidPolicy
+	// Line replied right away, repeated by the client
+	Line string
+}
+
+// Config listening to an ephemeral port, logging into a temporary directory
+func setupServer(t *testing.T) (Config, func()) {
+	dir, err := ioutil.TempDir("", "server")
+	require.NoError(t, err)
+	config := DefaultConfig()
+	config.Host = "127.0.0.1"
+	config.Port = 0
+	config.Logfile = filepath.Join(dir, "numbers.log")
+	config.Interval = 0
+	return config, func() { os.RemoveAll(dir) }
+}
+
+func startServer(t *testing.T, config Config) *Server {
+	server, err := NewServer(config)
+	require.NoError(t, err)
+	require.NoError(t, server.Start(context.Background()))
+	return server
+}
+
+// Connects to the server, sending the passed lines
+func sendLines(t *testing.T, server *Server, lines ...string) net.Conn {
+	conn, err := net.Dial("tcp", server.Addr().String())
+	require.NoError(t, err)
+	for _, line := range lines {
+		fmt.Fprintln(conn, line)
+	}
+	return conn
+}
+
+func TestServer(t *testing.T) {
+	readLog := func(t *testing.T, logfile string) []string {
+		content, err := ioutil.ReadFile(logfile)
+		require.NoError(t, err)
+		return strings.Fields(string(content))
+	}
+
+	t.Run("Invalid config", func(t *testing.T) {
+		testCases := []invalidConfigCase{
+			{Name: "Port", Config: func(c *Config) { c.Port = 70000 }, Field: "Port"},
+			{Name: "Digits", Config: func(c *Config) { c.Digits = 10 }, Field: "Digits"},
+			{Name: "Termination", Config: func(c *Config) { c.Termination = "" }, Field: "Termination"},
+			{Name: "Interval", Config: func(c *Config) { c.Interval = -time.Second }, Field: "Interval"},
+			{Name: "Timeouts", Config: func(c *Config) { c.IdleTimeout = -time.Second }, Field: "IdleTimeout"},
+			{
+				Name:   "Listen",
+				Config: func(c *Config) { c.Listen = []ListenConfig{{Network: "tcp", MaxConn: -1}} },
+				Field:  "Listen",
+			},
+			{
+				Name: "TLS over a unix socket",
+				Config: func(c *Config) {
+					c.TLSCert, c.TLSKey = "server.crt", "server.key"
+					c.Listen = []ListenConfig{{Network: "unix", Address: "/tmp/numbers.sock"}}
+				},
+				Field: "TLSCert",
+			},
+			{
+				Name:   "Fsync interval",
+				Config: func(c *Config) { c.Fsync, c.FsyncInterval = SyncPeriodically, 0 },
+				Field:  "FsyncInterval",
+			},
+			{
+				Name:   "Compression without rotation",
+				Config: func(c *Config) { c.Compression = CompressGzip },
+				Field:  "Compression",
+			},
+			{
+				Name:   "Snapshot interval",
+				Config: func(c *Config) { c.SnapshotDir, c.SnapshotInterval = "/tmp", 0 },
+				Field:  "SnapshotInterval",
+			},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				config := DefaultConfig()
+				tc.Config(&config)
+				_, err := NewServer(config)
+				var configErr *ConfigError
+				require.True(t, errors.As(err, &configErr), "Got: %v", err)
+				assert.Equal(t, tc.Field, configErr.Field)
+			})
+		}
+	})
+
+	t.Run("Terminate keyword", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		server := startServer(t, config)
+		assert.NotZero(t, server.Addr().(*net.TCPAddr).Port, "An ephemeral port should have been picked")
+		conn := sendLines(t, server, "000000001", "000000002", "000000001", "terminate")
+		defer conn.Close()
+		require.NoError(t, server.Wait())
+		assert.Equal(t, []string{"000000001", "000000002"}, readLog(t, config.Logfile))
+		assert.Equal(t, 1, server.Tracker().Stats.Duplicates)
+	})
+
+	t.Run("Shutdown", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		server := startServer(t, config)
+		conn := sendLines(t, server, "000000042")
+		defer conn.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Seen(42) }, 5*time.Second, time.Millisecond)
+		// The client is still connected
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		require.NoError(t, server.Shutdown(ctx))
+		require.NoError(t, server.Wait())
+		assert.Equal(t, []string{"000000042"}, readLog(t, config.Logfile))
+		assert.Error(t, server.Start(context.Background()), "A server can't be started twice")
+	})
+
+	t.Run("Canceled context", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		server, err := NewServer(config)
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		require.NoError(t, server.Start(ctx))
+		cancel()
+		require.NoError(t, server.Wait())
+	})
+
+	t.Run("Append restart", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		server := startServer(t, config)
+		conn := sendLines(t, server, "000000001", "terminate")
+		defer conn.Close()
+		require.NoError(t, server.Wait())
+
+		config.Append = true
+		server = startServer(t, config)
+		conn = sendLines(t, server, "000000001", "000000002", "terminate")
+		defer conn.Close()
+		require.NoError(t, server.Wait())
+		assert.Equal(t, []string{"000000001", "000000002"}, readLog(t, config.Logfile))
+		assert.Equal(t, 2, server.Tracker().Stats.Total)
+	})
+
+	t.Run("Invalid input replies", func(t *testing.T) {
+		for _, policy := range []InvalidPolicy{InvalidReplyClose, InvalidReplyContinue} {
+			t.Run(policy.String(), func(t *testing.T) {
+				config, cleanup := setupServer(t)
+				defer cleanup()
+				config.OnInvalid = policy
+				server := startServer(t, config)
+				defer server.Shutdown(context.Background())
+				conn := sendLines(t, server, "12", "000000001")
+				defer conn.Close()
+				conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+				reader := bufio.NewReader(conn)
+				line, err := reader.ReadString('\n')
+				require.NoError(t, err)
+				assert.Equal(t, "ERR 1 wrong_length \"12\"\n", line)
+				if policy == InvalidReplyClose {
+					_, err = reader.ReadString('\n')
+					assert.Error(t, err, "The connection should have been closed")
+					assert.False(t, server.Tracker().Seen(1))
+					return
+				}
+				// The connection stays open
+				require.Eventually(t, func() bool { return server.Tracker().Seen(1) }, 5*time.Second, time.Millisecond)
+				fmt.Fprintln(conn, "00000000x")
+				line, err = reader.ReadString('\n')
+				require.NoError(t, err)
+				assert.Equal(t, "ERR 2 non_digit \"00000000x\"\n", line)
+			})
+		}
+	})
+
+	t.Run("Acknowledgements", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		config.OnInvalid = InvalidReplyContinue
+		server := startServer(t, config)
+		conn := sendLines(t, server, "ack", "000000001", "000000001", "12", "000000002")
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		var replies []string
+		for len(replies) < 5 {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			replies = append(replies, line)
+		}
+		assert.Equal(t, []string{"OK ack\n", "NEW 000000001\n", "DUP 000000001\n",
+			"ERR 1 wrong_length \"12\"\n", "NEW 000000002\n"}, replies)
+		// Acknowledged numbers are already in the log file (buffered by default)
+		assert.Equal(t, []string{"000000001", "000000002"}, readLog(t, config.Logfile))
+
+		// Batches, acknowledged on shutdown at the latest
+		batch := sendLines(t, server, "ack batch", "000000003", "000000002")
+		defer batch.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Seen(3) }, 5*time.Second, time.Millisecond)
+		require.NoError(t, server.Shutdown(context.Background()))
+		batch.SetReadDeadline(time.Now().Add(5 * time.Second))
+		var acknowledged []string
+		scanner := bufio.NewScanner(batch)
+		for scanner.Scan() {
+			acknowledged = append(acknowledged, scanner.Text())
+		}
+		require.NotEmpty(t, acknowledged)
+		assert.Equal(t, "OK ack batch", acknowledged[0])
+		lines := 0
+		for _, ack := range acknowledged[1:] {
+			var count, fresh, dup, rejected, lost int
+			_, err := fmt.Sscanf(ack, "ACK %d new=%d dup=%d err=%d lost=%d", &count, &fresh, &dup, &rejected, &lost)
+			require.NoError(t, err)
+			assert.Equal(t, 0, lost)
+			lines += count
+		}
+		assert.Equal(t, 2, lines)
+	})
+
+	t.Run("Overload", func(t *testing.T) {
+		// Reads the reply to a connection beyond maxconn (empty if none)
+		readBusy := func(t *testing.T, conn net.Conn, wait time.Duration) string {
+			conn.SetReadDeadline(time.Now().Add(wait))
+			line, _ := bufio.NewReader(conn).ReadString('\n')
+			return line
+		}
+		rejected := func(server *Server) int {
+			stats := server.Tracker().Stats
+			stats.Lock()
+			defer stats.Unlock()
+			return stats.Rejected
+		}
+
+		t.Run("Block", func(t *testing.T) {
+			config, cleanup := setupServer(t)
+			defer cleanup()
+			config.MaxConn = 1
+			config.Overload = OverloadBlock
+			server := startServer(t, config)
+			defer server.Shutdown(context.Background())
+			first := sendLines(t, server, "000000001")
+			require.Eventually(t, func() bool { return server.Tracker().Seen(1) }, 5*time.Second, time.Millisecond)
+			// The rest are left in the backlog, not accepted
+			for i := 2; i <= 4; i++ {
+				conn := sendLines(t, server, fmt.Sprintf("%09d", i))
+				defer conn.Close()
+			}
+			time.Sleep(50 * time.Millisecond)
+			assert.Equal(t, uint64(1), server.Metrics().Snapshot().Accepted)
+			assert.False(t, server.Tracker().Seen(2))
+			// Accepted one at a time, as places are freed
+			first.Close()
+			require.Eventually(t, func() bool {
+				return server.Metrics().Snapshot().Accepted == 2
+			}, 5*time.Second, time.Millisecond)
+			time.Sleep(50 * time.Millisecond)
+			assert.Equal(t, uint64(2), server.Metrics().Snapshot().Accepted)
+			assert.Equal(t, 0, rejected(server))
+		})
+
+		t.Run("Reject", func(t *testing.T) {
+			config, cleanup := setupServer(t)
+			defer cleanup()
+			config.MaxConn = 1
+			config.Overload = OverloadReject
+			server := startServer(t, config)
+			defer server.Shutdown(context.Background())
+			first := sendLines(t, server, "000000001")
+			defer first.Close()
+			require.Eventually(t, func() bool { return server.Tracker().Seen(1) }, 5*time.Second, time.Millisecond)
+			second := sendLines(t, server)
+			defer second.Close()
+			assert.Equal(t, SERVER_BUSY_REPLY, readBusy(t, second, 5*time.Second))
+			assert.Equal(t, 1, rejected(server))
+		})
+
+		t.Run("Queue", func(t *testing.T) {
+			config, cleanup := setupServer(t)
+			defer cleanup()
+			config.MaxConn = 1
+			config.Overload = OverloadQueue
+			config.OverloadTimeout = 100 * time.Millisecond
+			server := startServer(t, config)
+			defer server.Shutdown(context.Background())
+			first := sendLines(t, server, "000000001")
+			require.Eventually(t, func() bool { return server.Tracker().Seen(1) }, 5*time.Second, time.Millisecond)
+			// Timed out while waiting
+			second := sendLines(t, server)
+			defer second.Close()
+			assert.Equal(t, SERVER_BUSY_REPLY, readBusy(t, second, 5*time.Second))
+			// Served once the first one leaves
+			third := sendLines(t, server, "000000003")
+			defer third.Close()
+			first.Close()
+			require.Eventually(t, func() bool { return server.Tracker().Seen(3) }, 5*time.Second, time.Millisecond)
+			assert.Equal(t, 1, rejected(server))
+		})
+	})
+
+	t.Run("Timeouts", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		config.MaxConn = 1
+		config.IdleTimeout = 100 * time.Millisecond
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		// A fake slow client, holding the only place without sending anything
+		idle, err := net.Dial("tcp", server.Addr().String())
+		require.NoError(t, err)
+		defer idle.Close()
+		idle.SetReadDeadline(time.Now().Add(5 * time.Second))
+		_, err = idle.Read(make([]byte, 1))
+		assert.Equal(t, io.EOF, err, "The idle connection should have been closed")
+		// Its place is free again
+		conn := sendLines(t, server, "000000001")
+		defer conn.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Seen(1) }, 5*time.Second, time.Millisecond)
+		stats := server.Tracker().Stats
+		stats.Lock()
+		defer stats.Unlock()
+		assert.Equal(t, 1, stats.TimedOut)
+	})
+
+	t.Run("Queries", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		conn := sendLines(t, server, "000000001")
+		defer conn.Close()
+		require.Eventually(t, func() bool { return server.Tracker().Seen(1) }, 5*time.Second, time.Millisecond)
+		// Malformed queries don't close the connection
+		fmt.Fprint(conn, "?000000001\n?000000002\n?12\n?000000001\n")
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		for _, expected := range []string{
+			"SEEN 000000001\n", "UNSEEN 000000002\n", "ERR 1 wrong_length \"12\"\n", "SEEN 000000001\n",
+		} {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, expected, line)
+		}
+		assert.False(t, server.Tracker().Seen(2), "Queries shouldn't register numbers")
+
+		// Replied in order, along with the acknowledgements
+		acked := sendLines(t, server, "ack", "000000003", "?000000003", "?000000004")
+		defer acked.Close()
+		acked.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader = bufio.NewReader(acked)
+		for _, expected := range []string{"OK ack\n", "NEW 000000003\n", "SEEN 000000003\n", "UNSEEN 000000004\n"} {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, expected, line)
+		}
+		assert.Equal(t, uint64(6), server.Metrics().Snapshot().Queries)
+	})
+
+	t.Run("Replies never read", func(t *testing.T) {
+		testCases := []unreadRepliesCase{
+			{Name: "Queries", OnInvalid: InvalidClose, Line: "?000000001"},
+			{Name: "Invalid lines", OnInvalid: InvalidReplyContinue, Line: "12"},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				config, cleanup := setupServer(t)
+				defer cleanup()
+				config.OnInvalid = tc.OnInvalid
+				server := startServer(t, config)
+				conn, err := net.Dial("tcp", server.Addr().String())
+				require.NoError(t, err)
+				defer conn.Close()
+				conn.(*net.TCPConn).SetReadBuffer(1024)
+				// Sending until the server stops reading (blocked replying)
+				lines := []byte(strings.Repeat(tc.Line+"\n", 1000))
+				require.Eventually(t, func() bool {
+					conn.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+					_, err := conn.Write(lines)
+					return isTimeout(err)
+				}, 30*time.Second, time.Millisecond)
+				ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+				defer cancel()
+				require.NoError(t, server.Shutdown(ctx))
+			})
+		}
+	})
+
+	t.Run("Termination token", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		config.TerminationToken = "s3cret"
+		config.OnInvalid = InvalidReplyContinue
+		server := startServer(t, config)
+		conn := sendLines(t, server, "terminate", "terminate wrong")
+		defer conn.Close()
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		reader := bufio.NewReader(conn)
+		// Refused, as invalid lines
+		for _, expected := range []string{
+			"ERR 2 non_digit \"terminate\"\n", "ERR 1 wrong_length \"terminate wrong\"\n",
+		} {
+			line, err := reader.ReadString('\n')
+			require.NoError(t, err)
+			assert.Equal(t, expected, line)
+		}
+		require.NoError(t, server.Ready())
+		fmt.Fprintln(conn, "terminate s3cret")
+		require.NoError(t, server.Wait())
+	})
+
+	t.Run("Admin socket", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		config.TerminationAccess = TerminationAccess{Disabled: true}
+		config.AdminSocket = filepath.Join(filepath.Dir(config.Logfile), "admin.sock")
+		server := startServer(t, config)
+		sendLines(t, server, "terminate").Close()
+		info, err := os.Stat(config.AdminSocket)
+		require.NoError(t, err)
+		assert.Equal(t, os.FileMode(0600), info.Mode().Perm())
+		admin, err := net.Dial("unix", config.AdminSocket)
+		require.NoError(t, err)
+		defer admin.Close()
+		fmt.Fprintln(admin, "000000001")
+		admin.SetReadDeadline(time.Now().Add(5 * time.Second))
+		line, err := bufio.NewReader(admin).ReadString('\n')
+		require.NoError(t, err)
+		assert.Equal(t, TERMINATION_REFUSED_REPLY, line)
+		require.NoError(t, server.Ready())
+		fmt.Fprintln(admin, "terminate")
+		require.NoError(t, server.Wait())
+		// Removed once closed
+		_, err = os.Stat(config.AdminSocket)
+		assert.True(t, os.IsNotExist(err))
+	})
+
+	t.Run("Statistics file", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		config.Interval = 20 * time.Millisecond
+		config.StatsFormat = StatsJSON
+		config.StatsFile = filepath.Join(filepath.Dir(config.Logfile), "stats.jsonl")
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		conn := sendLines(t, server, "000000001", "000000001")
+		defer conn.Close()
+		// Sums of the numbers reported so far
+		reported := func(t *testing.T) (float64, float64) {
+			content, err := ioutil.ReadFile(config.StatsFile)
+			require.NoError(t, err)
+			received, duplicates := 0.0, 0.0
+			scanner := bufio.NewScanner(bytes.NewReader(content))
+			for scanner.Scan() {
+				var report map[string]interface{}
+				require.NoError(t, json.Unmarshal(scanner.Bytes(), &report), "Got: %s", scanner.Text())
+				received += report["received"].(float64)
+				duplicates += report["duplicates"].(float64)
+			}
+			return received, duplicates
+		}
+		require.Eventually(t, func() bool {
+			received, duplicates := reported(t)
+			return received == 1 && duplicates == 1
+		}, 5*time.Second, 10*time.Millisecond)
+	})
+
+	t.Run("Port in use", func(t *testing.T) {
+		config, cleanup := setupServer(t)
+		defer cleanup()
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		config.Port = server.Addr().(*net.TCPAddr).Port
+		second, err := NewServer(config)
+		require.NoError(t, err)
+		assert.Error(t, second.Start(context.Background()))
+	})
+}
@@ -0,0 +1,446 @@
+package numberserver
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Destination for the unique numbers, besides the log file.
+// The Logger fans out every entry written to each of its sinks,
+// in batches (see WithSink)
+type Sink interface {
+	// Identifies the sink in reports
+	Name() string
+	// Writes a batch of entries, encoded in the log's format
+	// (delimiters included, see LogFormat)
+	Write(entries [][]byte) error
+	Close() error
+}
+
+// What to do when a sink fails (or can't keep up)
+type SinkPolicy int
+
+const (
+	// Retries the failed batch with backoff up to a max of attempts,
+	// then drops it; entries are dropped while the queue is full
+	SinkRetry SinkPolicy = iota
+	// Retries the failed batch until it succeeds; a full queue
+	// blocks the pipeline (backpressure)
+	SinkBlock
+	// Drops the failed batch; entries are dropped while the queue is full
+	SinkDrop
+)
+
+const (
+	DEFAULT_SINK_BATCH   = 100
+	DEFAULT_SINK_QUEUE   = 10000
+	DEFAULT_SINK_RETRIES = 5
+	SINK_MIN_BACKOFF     = 100 * time.Millisecond
+	SINK_MAX_BACKOFF     = 5 * time.Second
+	// Max time waiting for a sink to drain on shutdown, what's left is dropped
+	SINK_STOP_TIMEOUT = 10 * time.Second
+)
+
+// Parses a sink policy's name: retry, block or drop
+func ParseSinkPolicy(name string) (SinkPolicy, error) {
+	switch name {
+	case "retry":
+		return SinkRetry, nil
+	case "block":
+		return SinkBlock, nil
+	case "drop":
+		return SinkDrop, nil
+	}
+	return SinkRetry, fmt.Errorf("Unknown sink policy: %s (expected retry, block or drop)", name)
+}
+
+func (p SinkPolicy) String() string {
+	switch p {
+	case SinkBlock:
+		return "block"
+	case SinkDrop:
+		return "drop"
+	}
+	return "retry"
+}
+
+// A sink along with how it should be fed
+type SinkConfig struct {
+	Sink   Sink
+	Policy SinkPolicy
+	// Max entries per write
+	Batch int
+}
+
+// Parses a sink definition, as passed to the --sink flag:
+//
+//	<target>[,policy=retry|block|drop][,batch=<entries>]
+//
+// where target is one of: stdout, file:<path>, unix:<socket path>,
+// or an http(s):// URL (batches are POSTed to it)
+func ParseSink(definition string) (SinkConfig, error) {
+	parts := strings.Split(definition, ",")
+	config := SinkConfig{Policy: SinkRetry, Batch: DEFAULT_SINK_BATCH}
+	for _, option := range parts[1:] {
+		keyValue := strings.SplitN(option, "=", 2)
+		if len(keyValue) != 2 {
+			return config, fmt.Errorf("Invalid sink option: %s", option)
+		}
+		switch keyValue[0] {
+		case "policy":
+			policy, err := ParseSinkPolicy(keyValue[1])
+			if err != nil {
+				return config, err
+			}
+			config.Policy = policy
+		case "batch":
+			batch, err := strconv.Atoi(keyValue[1])
+			if err != nil || batch <= 0 {
+				return config, fmt.Errorf("Invalid sink batch: %s", keyValue[1])
+			}
+			config.Batch = batch
+		default:
+			return config, fmt.Errorf("Unknown sink option: %s", keyValue[0])
+		}
+	}
+	target := parts[0]
+	switch {
+	case target == "stdout":
+		config.Sink = NewWriterSink("stdout", os.Stdout)
+	case strings.HasPrefix(target, "file:"):
+		config.Sink = NewFileSink(strings.TrimPrefix(target, "file:"))
+	case strings.HasPrefix(target, "unix:"):
+		config.Sink = NewUnixSink(strings.TrimPrefix(target, "unix:"))
+	case strings.HasPrefix(target, "http://"), strings.HasPrefix(target, "https://"):
+		config.Sink = NewHTTPSink(target)
+	default:
+		return config, fmt.Errorf("Unknown sink: %s (expected stdout, file:, unix: or an http URL)", target)
+	}
+	return config, nil
+}
+
+// Sink writing into an io.Writer (e.g. os.Stdout)
+type WriterSink struct {
+	sync.Mutex
+	name   string
+	writer io.Writer
+}
+
+// Creates a WriterSink identified by the passed name
+func NewWriterSink(name string, writer io.Writer) *WriterSink {
+	return &WriterSink{name: name, writer: writer}
+}
+
+func (w *WriterSink) Name() string {
+	return w.name
+}
+
+func (w *WriterSink) Write(entries [][]byte) error {
+	w.Lock()
+	defer w.Unlock()
+	_, err := w.writer.Write(bytes.Join(entries, nil))
+	return err
+}
+
+func (w *WriterSink) Close() error {
+	return nil
+}
+
+// Sink appending to a file (opened on the first write)
+type FileSink struct {
+	path string
+	file *os.File
+}
+
+// Creates a FileSink appending to the file in path
+func NewFileSink(path string) *FileSink {
+	return &FileSink{path: path}
+}
+
+func (f *FileSink) Name() string {
+	return "file:" + f.path
+}
+
+func (f *FileSink) Write(entries [][]byte) error {
+	if f.file == nil {
+		file, err := os.OpenFile(f.path, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		f.file = file
+	}
+	_, err := f.file.Write(bytes.Join(entries, nil))
+	return err
+}
+
+func (f *FileSink) Close() error {
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
+
+// Sink writing entries into a Unix domain socket.
+// It (re)connects on the first write after a failure
+type UnixSink struct {
+	path string
+	conn net.Conn
+}
+
+// Creates a UnixSink for the socket in path
+func NewUnixSink(path string) *UnixSink {
+	return &UnixSink{path: path}
+}
+
+func (u *UnixSink) Name() string {
+	return "unix:" + u.path
+}
+
+func (u *UnixSink) Write(entries [][]byte) error {
+	if u.conn == nil {
+		conn, err := net.Dial("unix", u.path)
+		if err != nil {
+			return err
+		}
+		u.conn = conn
+	}
+	if _, err := u.conn.Write(bytes.Join(entries, nil)); err != nil {
+		u.conn.Close()
+		u.conn = nil
+		return err
+	}
+	return nil
+}
+
+func (u *UnixSink) Close() error {
+	if u.conn == nil {
+		return nil
+	}
+	err := u.conn.Close()
+	u.conn = nil
+	return err
+}
+
+// Sink POSTing batches of entries to an HTTP endpoint
+// (text/plain by default, see SetContentType).
+// Any non 2xx response is a failure
+type HTTPSink struct {
+	url         string
+	contentType string
+	client      *http.Client
+}
+
+// Creates an HTTPSink for the passed URL
+func NewHTTPSink(url string) *HTTPSink {
+	return &HTTPSink{url: url, contentType: "text/plain",
+		client: &http.Client{Timeout: 10 * time.Second}}
+}
+
+// Sets the content type of the batches POSTed
+// (it should match the log's format)
+func (h *HTTPSink) SetContentType(contentType string) {
+	h.contentType = contentType
+}
+
+func (h *HTTPSink) Name() string {
+	return h.url
+}
+
+func (h *HTTPSink) Write(entries [][]byte) error {
+	body := bytes.NewReader(bytes.Join(entries, nil))
+	response, err := h.client.Post(h.url, h.contentType, body)
+	if err != nil {
+		return err
+	}
+	io.Copy(ioutil.Discard, response.Body)
+	response.Body.Close()
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return fmt.Errorf("unexpected response: %s", response.Status)
+	}
+	return nil
+}
+
+func (h *HTTPSink) Close() error {
+	h.client.CloseIdleConnections()
+	return nil
+}
+
+// Per sink counters
+type SinkStats struct {
+	Name     string
+	Policy   SinkPolicy
+	Written  int
+	Dropped  int
+	Failures int
+	// Last failure, nil if the last write succeeded
+	LastError error
+}
+
+// Feeds a sink from its own queue and routine, applying its policy
+type sinkRunner struct {
+	config SinkConfig
+	queue  chan []byte
+	done   chan struct{}
+	// Closed once Stop gave up waiting: what's left is dropped
+	abandon chan struct{}
+	// Backoff between retries, and max time Stop waits
+	minBackoff  time.Duration
+	maxBackoff  time.Duration
+	stopTimeout time.Duration
+	statsMu     sync.Mutex
+	stats       SinkStats
+}
+
+func newSinkRunner(config SinkConfig) *sinkRunner {
+	if config.Batch <= 0 {
+		config.Batch = DEFAULT_SINK_BATCH
+	}
+	return &sinkRunner{
+		config:      config,
+		minBackoff:  SINK_MIN_BACKOFF,
+		maxBackoff:  SINK_MAX_BACKOFF,
+		stopTimeout: SINK_STOP_TIMEOUT,
+		stats:       SinkStats{Name: config.Sink.Name(), Policy: config.Policy},
+	}
+}
+
+// Queues an entry for the sink. With the block policy, it waits for
+// room in the queue; otherwise, the entry is dropped if the queue is full
+func (r *sinkRunner) Enqueue(entry []byte) {
+	if r.config.Policy == SinkBlock {
+		r.queue <- entry
+		return
+	}
+	select {
+	case r.queue <- entry:
+	default:
+		r.dropped(1)
+	}
+}
+
+func (r *sinkRunner) dropped(entries int) {
+	r.statsMu.Lock()
+	r.stats.Dropped += entries
+	r.statsMu.Unlock()
+}
+
+// Whether Stop gave up waiting for the sink
+func (r *sinkRunner) abandoned() bool {
+	select {
+	case <-r.abandon:
+		return true
+	default:
+		return false
+	}
+}
+
+// Starts feeding the sink in the background
+func (r *sinkRunner) Start() {
+	r.queue = make(chan []byte, DEFAULT_SINK_QUEUE)
+	r.done = make(chan struct{})
+	r.abandon = make(chan struct{})
+	go r.run(r.queue, r.done)
+}
+
+// Writes batches until the queue is closed (see Stop)
+func (r *sinkRunner) run(queue <-chan []byte, done chan<- struct{}) {
+	defer close(done)
+	batch := make([][]byte, 0, r.config.Batch)
+	for entry := range queue {
+		if r.abandoned() {
+			r.dropped(1)
+			continue
+		}
+		batch = append(batch[:0], entry)
+		// Taking whatever else is already queued
+	fill:
+		for len(batch) < r.config.Batch {
+			select {
+			case next, ok := <-queue:
+				if !ok {
+					break fill
+				}
+				batch = append(batch, next)
+			default:
+				break fill
+			}
+		}
+		r.write(batch)
+	}
+	if err := r.config.Sink.Close(); err != nil {
+		fmt.Printf("An error occurred while closing sink %s: %v\n", r.stats.Name, err)
+	}
+}
+
+// Closes the queue and waits for the remaining entries to be written,
+// up to the stop timeout: then, whatever is left is dropped (a write
+// in flight isn't waited for)
+func (r *sinkRunner) Stop() {
+	close(r.queue)
+	timeout := time.NewTimer(r.stopTimeout)
+	defer timeout.Stop()
+	select {
+	case <-r.done:
+	case <-timeout.C:
+		close(r.abandon)
+		fmt.Printf("Sink %s didn't drain in %v, dropping the entries left\n", r.stats.Name, r.stopTimeout)
+	}
+}
+
+// Current counters
+func (r *sinkRunner) Stats() SinkStats {
+	r.statsMu.Lock()
+	defer r.statsMu.Unlock()
+	return r.stats
+}
+
+// Writes a batch, retrying according to the policy
+func (r *sinkRunner) write(batch [][]byte) {
+	backoff := r.minBackoff
+	for attempt := 1; ; attempt++ {
+		err := r.config.Sink.Write(batch)
+		r.statsMu.Lock()
+		failing := r.stats.LastError != nil
+		r.stats.LastError = err
+		if err == nil {
+			r.stats.Written += len(batch)
+			r.statsMu.Unlock()
+			if failing {
+				fmt.Printf("Sink %s recovered\n", r.stats.Name)
+			}
+			return
+		}
+		r.stats.Failures++
+		giveUp := r.config.Policy == SinkDrop || r.abandoned() ||
+			(r.config.Policy == SinkRetry && attempt >= DEFAULT_SINK_RETRIES)
+		if giveUp {
+			r.stats.Dropped += len(batch)
+		}
+		r.statsMu.Unlock()
+		// Reporting only the first failure of a streak
+		if !failing {
+			fmt.Printf("Sink %s failed (policy: %s): %v\n", r.stats.Name, r.config.Policy, err)
+		}
+		if giveUp {
+			return
+		}
+		select {
+		case <-time.After(backoff):
+		case <-r.abandon:
+		}
+		if backoff *= 2; backoff > r.maxBackoff {
+			backoff = r.maxBackoff
+		}
+	}
+}
@@ -0,0 +1,280 @@
+package numberserver
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type parseSinkCase struct {
+	Name       string
+	Definition string
+	SinkName   string
+	Policy     SinkPolicy
+	Batch      int
+	Errored    bool
+}
+
+// Sink failing the first failures writes
+type flakySink struct {
+	sync.Mutex
+	failures int
+	lines    []string
+}
+
+func (f *flakySink) Name() string { return "flaky" }
+
+func (f *flakySink) Write(entries [][]byte) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.failures > 0 {
+		f.failures--
+		return errors.New("flaky failure")
+	}
+	for _, entry := range entries {
+		f.lines = append(f.lines, strings.TrimSuffix(string(entry), "\n"))
+	}
+	return nil
+}
+
+func (f *flakySink) Close() error { return nil }
+
+// Text entries (lines plus new-line)
+func entries(lines ...string) [][]byte {
+	encoded := make([][]byte, 0, len(lines))
+	for _, line := range lines {
+		encoded = append(encoded, []byte(line+"\n"))
+	}
+	return encoded
+}
+
+func (f *flakySink) Lines() []string {
+	f.Lock()
+	defer f.Unlock()
+	return f.lines
+}
+
+func TestSink(t *testing.T) {
+	t.Run("Canary test", func(t *testing.T) {
+		var _ Sink = &WriterSink{}
+		var _ Sink = &FileSink{}
+		var _ Sink = &UnixSink{}
+		var _ Sink = &HTTPSink{}
+	})
+
+	t.Run("Parse Sink", func(t *testing.T) {
+		testCases := []parseSinkCase{
+			{Name: "Stdout", Definition: "stdout", SinkName: "stdout", Policy: SinkRetry, Batch: DEFAULT_SINK_BATCH},
+			{Name: "File", Definition: "file:/tmp/x.log,policy=drop", SinkName: "file:/tmp/x.log", Policy: SinkDrop,
+				Batch: DEFAULT_SINK_BATCH},
+			{Name: "Unix", Definition: "unix:/tmp/x.sock,policy=retry,batch=10", SinkName: "unix:/tmp/x.sock",
+				Policy: SinkRetry, Batch: 10},
+			{Name: "HTTP", Definition: "http://localhost:8080/numbers,policy=block,batch=500",
+				SinkName: "http://localhost:8080/numbers", Policy: SinkBlock, Batch: 500},
+			{Name: "Unknown target", Definition: "ftp://x", Errored: true},
+			{Name: "Unknown policy", Definition: "stdout,policy=maybe", Errored: true},
+			{Name: "Invalid batch", Definition: "stdout,batch=0", Errored: true},
+			{Name: "Invalid option", Definition: "stdout,batch", Errored: true},
+		}
+		for _, tc := range testCases {
+			t.Run(tc.Name, func(t *testing.T) {
+				config, err := ParseSink(tc.Definition)
+				if tc.Errored {
+					assert.Error(t, err)
+					return
+				}
+				require.NoError(t, err)
+				assert.Equal(t, tc.SinkName, config.Sink.Name())
+				assert.Equal(t, tc.Policy, config.Policy)
+				assert.Equal(t, tc.Batch, config.Batch)
+			})
+		}
+	})
+
+	t.Run("Writer Sink", func(t *testing.T) {
+		var buffer bytes.Buffer
+		sink := NewWriterSink("buffer", &buffer)
+		require.NoError(t, sink.Write(entries("1", "2")))
+		require.NoError(t, sink.Write(entries("3")))
+		assert.Equal(t, "1\n2\n3\n", buffer.String())
+	})
+
+	t.Run("File Sink", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "sink")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "copy.log")
+		sink := NewFileSink(path)
+		require.NoError(t, sink.Write(entries("1", "2")))
+		require.NoError(t, sink.Close())
+		// Reopened on the next write
+		require.NoError(t, sink.Write(entries("3")))
+		require.NoError(t, sink.Close())
+		content, err := ioutil.ReadFile(path)
+		require.NoError(t, err)
+		assert.Equal(t, "1\n2\n3\n", string(content))
+	})
+
+	t.Run("Unix Sink", func(t *testing.T) {
+		dir, err := ioutil.TempDir("", "sink")
+		require.NoError(t, err)
+		defer os.RemoveAll(dir)
+		path := filepath.Join(dir, "numbers.sock")
+		sink := NewUnixSink(path)
+		assert.Error(t, sink.Write(entries("1")), "Nobody is listening yet")
+
+		listener, err := net.Listen("unix", path)
+		require.NoError(t, err)
+		defer listener.Close()
+		received := make(chan []string)
+		go func() {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			var lines []string
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() {
+				lines = append(lines, scanner.Text())
+			}
+			received <- lines
+		}()
+		require.NoError(t, sink.Write(entries("1", "2")))
+		require.NoError(t, sink.Write(entries("3")))
+		require.NoError(t, sink.Close())
+		assert.Equal(t, []string{"1", "2", "3"}, <-received)
+	})
+
+	t.Run("HTTP Sink", func(t *testing.T) {
+		var mu sync.Mutex
+		var bodies []string
+		fail := true
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if fail {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			body, _ := ioutil.ReadAll(r.Body)
+			assert.Equal(t, http.MethodPost, r.Method)
+			bodies = append(bodies, string(body))
+		}))
+		defer server.Close()
+		sink := NewHTTPSink(server.URL)
+		assert.Error(t, sink.Write(entries("1")), "Non 2xx responses are failures")
+		mu.Lock()
+		fail = false
+		mu.Unlock()
+		require.NoError(t, sink.Write(entries("1", "2")))
+		require.NoError(t, sink.Close())
+		assert.Equal(t, []string{"1\n2\n"}, bodies)
+	})
+
+	// Runs the lines through a runner with the passed policy
+	runLines := func(sink Sink, policy SinkPolicy, lines []string) SinkStats {
+		runner := newSinkRunner(SinkConfig{Sink: sink, Policy: policy, Batch: 1})
+		runner.minBackoff = time.Millisecond
+		runner.maxBackoff = time.Millisecond
+		runner.Start()
+		for _, line := range lines {
+			runner.Enqueue([]byte(line + "\n"))
+		}
+		runner.Stop()
+		return runner.Stats()
+	}
+
+	t.Run("Block policy", func(t *testing.T) {
+		sink := &flakySink{failures: 10}
+		stats := runLines(sink, SinkBlock, []string{"1", "2", "3"})
+		assert.Equal(t, []string{"1", "2", "3"}, sink.Lines(), "Every line should be eventually written")
+		assert.Equal(t, 3, stats.Written)
+		assert.Equal(t, 0, stats.Dropped)
+		assert.Equal(t, 10, stats.Failures)
+		assert.NoError(t, stats.LastError)
+	})
+
+	t.Run("Drop policy", func(t *testing.T) {
+		sink := &flakySink{failures: 2}
+		stats := runLines(sink, SinkDrop, []string{"1", "2", "3"})
+		assert.Equal(t, []string{"3"}, sink.Lines())
+		assert.Equal(t, 1, stats.Written)
+		assert.Equal(t, 2, stats.Dropped)
+		assert.Equal(t, 2, stats.Failures)
+	})
+
+	t.Run("Retry policy", func(t *testing.T) {
+		// The first line is dropped after DEFAULT_SINK_RETRIES attempts,
+		// the second one makes it after a retry
+		sink := &flakySink{failures: DEFAULT_SINK_RETRIES + 1}
+		stats := runLines(sink, SinkRetry, []string{"1", "2"})
+		assert.Equal(t, []string{"2"}, sink.Lines())
+		assert.Equal(t, 1, stats.Written)
+		assert.Equal(t, 1, stats.Dropped)
+		assert.Equal(t, DEFAULT_SINK_RETRIES+1, stats.Failures)
+	})
+
+	t.Run("Stop timeout", func(t *testing.T) {
+		// Never succeeds, so it would block forever
+		sink := &flakySink{failures: 1 << 30}
+		runner := newSinkRunner(SinkConfig{Sink: sink, Policy: SinkBlock, Batch: 1})
+		runner.minBackoff = time.Millisecond
+		runner.maxBackoff = time.Millisecond
+		runner.stopTimeout = 20 * time.Millisecond
+		runner.Start()
+		for _, line := range []string{"1", "2", "3"} {
+			runner.Enqueue([]byte(line + "\n"))
+		}
+		stopped := make(chan struct{})
+		go func() {
+			runner.Stop()
+			close(stopped)
+		}()
+		select {
+		case <-stopped:
+		case <-time.After(5 * time.Second):
+			t.Fatal("The sink wasn't stopped")
+		}
+		require.Eventually(t, func() bool { return runner.Stats().Dropped == 3 }, 5*time.Second, time.Millisecond)
+		assert.Equal(t, 0, runner.Stats().Written)
+	})
+
+	t.Run("Logger fan out", func(t *testing.T) {
+		var buffer bytes.Buffer
+		failing := &flakySink{failures: 1 << 30}
+		logger := NewLogger(Filename("./sinks.log"),
+			WithSink(SinkConfig{Sink: NewWriterSink("buffer", &buffer), Policy: SinkBlock}),
+			WithSink(SinkConfig{Sink: failing, Policy: SinkDrop}))
+		defer os.Remove(logger.filename)
+		readStream := make(chan string)
+		require.NoError(t, logger.StreamWrite(context.Background(), readStream))
+		for _, line := range []string{"1", "2", "3"} {
+			readStream <- line
+		}
+		close(readStream)
+		// A failing sink doesn't fail the logger
+		require.NoError(t, logger.Wait())
+		assert.Equal(t, []string{"1", "2", "3"}, strings.Fields(buffer.String()))
+		stats := logger.SinkStats()
+		require.Len(t, stats, 2)
+		assert.Equal(t, 3, stats[0].Written)
+		assert.Equal(t, 0, stats[1].Written)
+		assert.Equal(t, 3, stats[1].Dropped)
+		assert.Error(t, stats[1].LastError)
+	})
+}
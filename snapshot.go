@@ -0,0 +1,435 @@
+package numberserver
+
+import (
+	"bufio"
+	"compress/gzip"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/mountolive/numberserver/logformat"
+)
+
+// Snapshot format (all integers little-endian):
+//
+//	magic "NSNP" | version (1 byte) | log segment (8 bytes) | offset (8 bytes) |
+//	count (8 bytes) | count uvarint deltas of the sorted unique numbers |
+//	CRC32-IEEE (4 bytes)
+//
+// The checksum covers every preceding byte
+const (
+	SNAPSHOT_MAGIC   = "NSNP"
+	SNAPSHOT_VERSION = 2
+	SNAPSHOT_SUFFIX  = ".snapshot"
+)
+
+// Returned when a snapshot file is truncated, corrupt or of an unknown format
+var ErrInvalidSnapshot = errors.New("invalid snapshot")
+
+// Periodically writes a compact snapshot of the unique numbers logged
+// so far, together with the log position it covers, so that a restart only
+// needs to replay the log's tail.
+// The position is the last rotated segment fully covered (0 if none) plus
+// an offset into the part of the log after it: the next rotated segment,
+// if it exists, or the active one (see rotation.go).
+// The snapshot is built from the log itself (reading only what was written
+// since the last snapshot), so it never contains numbers that didn't make
+// it to the log file
+type Snapshotter struct {
+	sync.Mutex
+	dir     string
+	logfile string
+	format  logformat.Format
+	checker *NumberChecker
+	known   Deduplicator
+	// Position of the log already covered by known
+	segment int
+	offset  int64
+	// Active segment last opened (see openNext)
+	active os.FileInfo
+}
+
+// Creates a new Snapshotter writing into dir the snapshots of logfile
+// (written in the passed format).
+// The passed Deduplicator is used to hold the snapshot's state in memory
+func NewSnapshotter(dir, logfile string, format logformat.Format, checker *NumberChecker,
+	known Deduplicator) *Snapshotter {
+	return &Snapshotter{dir: dir, logfile: logfile, format: format, checker: checker, known: known}
+}
+
+// Path of the snapshot file
+func (s *Snapshotter) Path() string {
+	return filepath.Join(s.dir, filepath.Base(s.logfile)+SNAPSHOT_SUFFIX)
+}
+
+// Log position covered by the current state
+// (last rotated segment covered and offset into the next part)
+func (s *Snapshotter) Position() (int, int64) {
+	s.Lock()
+	defer s.Unlock()
+	return s.segment, s.offset
+}
+
+// Removes any existing snapshot (used when the log file is recreated)
+func (s *Snapshotter) Reset() error {
+	err := os.Remove(s.Path())
+	if err != nil && !os.IsNotExist(err) {
+		return fmt.Errorf("An error occurred while removing the snapshot: %w", err)
+	}
+	return nil
+}
+
+// Rebuilds the tracker's state: loads the snapshot (if any) and replays
+// only the log's tail. An invalid snapshot (or a tail that can't be read
+// from its position) isn't fatal, the whole log is replayed instead
+// (and the reason is kept in the report)
+func (s *Snapshotter) Restore(tracker *NumberTracker) (RecoveryReport, error) {
+	s.Lock()
+	defer s.Unlock()
+	var report RecoveryReport
+	fromSnapshot := false
+	segment, offset, loaded, err := readSnapshot(s.Path(), s.known)
+	if err != nil && !os.IsNotExist(err) {
+		report.SnapshotError = err
+	}
+	if err == nil {
+		s.segment, s.offset = segment, offset
+		// The log was recreated/truncated after the snapshot was taken
+		file, _, openErr := s.openNext()
+		// (compressed segments are checked while reading them)
+		if file != nil {
+			info, statErr := file.Stat()
+			file.Close()
+			if statErr != nil || (!isCompressed(file.Name()) && info.Size() < s.offset) {
+				openErr = errors.New("log is shorter than the offset covered")
+			}
+		} else if openErr == nil && (segment > 0 || offset > 0) {
+			openErr = errors.New("log is missing")
+		}
+		if openErr != nil {
+			report.SnapshotError = fmt.Errorf("%w: %v (segment %d, offset %d)",
+				ErrInvalidSnapshot, openErr, segment, offset)
+		} else {
+			report.Snapshot = loaded
+			fromSnapshot = true
+		}
+	}
+	if report.SnapshotError != nil {
+		s.segment, s.offset = 0, 0
+		s.known = clearedCopy(s.known)
+	}
+	tail, err := s.catchUp()
+	if err != nil && fromSnapshot {
+		// The log can't be read from the snapshot's position (e.g. a compressed
+		// segment is shorter than the offset covered, or unreadable)
+		if !errors.Is(err, ErrInvalidSnapshot) {
+			err = fmt.Errorf("%w: %v (segment %d, offset %d)", ErrInvalidSnapshot, err, segment, offset)
+		}
+		report.SnapshotError, report.Snapshot = err, 0
+		s.segment, s.offset = 0, 0
+		s.known = clearedCopy(s.known)
+		tail, err = s.catchUp()
+	}
+	if err != nil {
+		return report, err
+	}
+	report.Duplicates = tail.Duplicates
+	report.Corrupt = tail.Corrupt
+	s.known.Range(func(value uint32) bool {
+		if tracker.Register(int(value)) {
+			report.Recovered++
+		}
+		return true
+	})
+	tracker.Stats.IncreaseTotal(report.Recovered)
+	return report, nil
+}
+
+// Reads the log written since the last snapshot and writes a new one.
+// The snapshot is written into a temporary file and renamed afterwards,
+// so a crash in the middle of it leaves the previous snapshot untouched
+func (s *Snapshotter) Snapshot() error {
+	s.Lock()
+	defer s.Unlock()
+	if _, err := s.catchUp(); err != nil {
+		return err
+	}
+	return writeSnapshot(s.Path(), s.segment, s.offset, s.known)
+}
+
+// Takes a snapshot every interval, until ctx is canceled
+func (s *Snapshotter) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if err := s.Snapshot(); err != nil {
+				fmt.Printf("An error occurred while taking a snapshot: %v\n", err)
+			}
+		}
+	}
+}
+
+// Registers into known the complete records written to the log
+// after the current position, moving the position forward
+func (s *Snapshotter) catchUp() (RecoveryReport, error) {
+	var report RecoveryReport
+	for {
+		file, seq, err := s.openNext()
+		if err != nil || file == nil {
+			return report, err
+		}
+		err = s.consume(file, &report)
+		file.Close()
+		// The active segment (seq == 0) is read up to its last complete record
+		if err != nil || seq == 0 {
+			return report, err
+		}
+		// Rotated segments don't change anymore, moving on to the next part
+		s.segment, s.offset = seq, 0
+	}
+}
+
+// Opens the part of the log after the last rotated segment covered:
+// the next rotated segment (returning its sequence) or the active one
+// (returning 0). Returns a nil file if there's nothing to read.
+// An active segment replaced meanwhile (e.g. moved away by logrotate
+// and reopened, see Logger's Reopen) or truncated is read from its start
+func (s *Snapshotter) openNext() (*os.File, int, error) {
+	// Opening the active segment first: if it gets rotated right after,
+	// the rotated segment will be found below
+	active, err := os.Open(s.logfile)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, 0, fmt.Errorf("An error occurred while opening the logfile: %w", err)
+	}
+	segments, err := rotatedSegments(s.logfile)
+	if err != nil {
+		if active != nil {
+			active.Close()
+		}
+		return nil, 0, err
+	}
+	for _, segment := range segments {
+		if segment.Seq <= s.segment {
+			continue
+		}
+		if active != nil {
+			active.Close()
+		}
+		// Segments in between were pruned before being covered
+		if segment.Seq != s.segment+1 {
+			s.offset = 0
+		}
+		file, err := os.Open(segment.Path)
+		if err != nil {
+			return nil, 0, fmt.Errorf("An error occurred while opening a log segment: %w", err)
+		}
+		return file, segment.Seq, nil
+	}
+	if active == nil {
+		return nil, 0, nil
+	}
+	info, err := active.Stat()
+	if err != nil {
+		active.Close()
+		return nil, 0, fmt.Errorf("An error occurred while retrieving the logfile: %w", err)
+	}
+	if s.active != nil && (!os.SameFile(s.active, info) || info.Size() < s.offset) {
+		s.offset = 0
+	}
+	s.active = info
+	return active, 0, nil
+}
+
+// Registers the complete records of file after the current offset
+// (offsets of compressed segments refer to their decompressed content).
+// A compressed segment that can't be decompressed (e.g. truncated) is
+// read up to the damage, which is counted as a corrupt record (unless the
+// offset is beyond it, which invalidates the snapshot)
+func (s *Snapshotter) consume(file *os.File, report *RecoveryReport) error {
+	var decoder *logformat.Decoder
+	base := s.offset
+	compressed := isCompressed(file.Name())
+	if compressed {
+		decompressed, err := gzip.NewReader(file)
+		if err != nil && s.offset > 0 {
+			return fmt.Errorf("%w: %s can't be decompressed: %v", ErrInvalidSnapshot, file.Name(), err)
+		}
+		if err != nil {
+			report.Corrupt++
+			return nil
+		}
+		defer decompressed.Close()
+		decoder = logformat.NewDecoder(decompressed, s.format)
+		if err := decoder.Skip(s.offset); err != nil {
+			return fmt.Errorf("%w: %s is shorter than the offset covered", ErrInvalidSnapshot, file.Name())
+		}
+		base = 0
+	} else {
+		if _, err := file.Seek(s.offset, io.SeekStart); err != nil {
+			return fmt.Errorf("An error occurred while seeking the logfile: %w", err)
+		}
+		decoder = logformat.NewDecoder(file, s.format)
+	}
+	// A partial last record is left for the next catch up
+	decoder.Strict = true
+	for {
+		record, err := decoder.Decode()
+		if err == io.EOF || errors.Is(err, logformat.ErrTruncated) {
+			return nil
+		}
+		s.offset = base + decoder.Offset()
+		if errors.Is(err, logformat.ErrCorrupt) {
+			report.Corrupt++
+			continue
+		}
+		if err != nil && compressed {
+			report.Corrupt++
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("An error occurred while reading the logfile: %w", err)
+		}
+		if !validLogged(record, s.checker) {
+			report.Corrupt++
+		} else if s.known.Add(record.Number) {
+			report.Recovered++
+		} else {
+			report.Duplicates++
+		}
+	}
+}
+
+// Returns an empty Deduplicator of the same kind of the passed one
+func clearedCopy(known Deduplicator) Deduplicator {
+	if bitset, ok := known.(*BitsetDeduplicator); ok {
+		return NewBitsetDeduplicator(bitset.Size())
+	}
+	return NewMapDeduplicator()
+}
+
+// Writes the snapshot atomically: temporary file, fsync, rename
+func writeSnapshot(path string, segment int, offset int64, known Deduplicator) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".tmp-*")
+	if err != nil {
+		return fmt.Errorf("An error occurred while creating the snapshot: %w", err)
+	}
+	// No-op once renamed
+	defer os.Remove(tmp.Name())
+	checksum := crc32.NewIEEE()
+	writer := bufio.NewWriter(io.MultiWriter(tmp, checksum))
+	header := make([]byte, 0, len(SNAPSHOT_MAGIC)+25)
+	header = append(header, SNAPSHOT_MAGIC...)
+	header = append(header, SNAPSHOT_VERSION)
+	header = appendUint64(header, uint64(segment))
+	header = appendUint64(header, uint64(offset))
+	header = appendUint64(header, uint64(known.Len()))
+	writer.Write(header)
+	var previous uint32
+	varint := make([]byte, binary.MaxVarintLen32)
+	known.Range(func(value uint32) bool {
+		writer.Write(varint[:binary.PutUvarint(varint, uint64(value-previous))])
+		previous = value
+		return true
+	})
+	err = writer.Flush()
+	if err == nil {
+		trailer := make([]byte, 4)
+		binary.LittleEndian.PutUint32(trailer, checksum.Sum32())
+		_, err = tmp.Write(trailer)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return fmt.Errorf("An error occurred while writing the snapshot: %w", err)
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("An error occurred while renaming the snapshot: %w", err)
+	}
+	// Persisting the rename itself
+	if dir, err := os.Open(filepath.Dir(path)); err == nil {
+		dir.Sync()
+		dir.Close()
+	}
+	return nil
+}
+
+// Loads the snapshot in path into the passed Deduplicator, returning
+// the log position it covers and the number of entries loaded.
+// The checksum is verified before loading anything
+func readSnapshot(path string, into Deduplicator) (int, int64, int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	headerSize := int64(len(SNAPSHOT_MAGIC) + 25)
+	if info.Size() < headerSize+4 {
+		return 0, 0, 0, fmt.Errorf("%w: truncated file", ErrInvalidSnapshot)
+	}
+	// First pass: checksum
+	checksum := crc32.NewIEEE()
+	if _, err := io.CopyN(checksum, file, info.Size()-4); err != nil {
+		return 0, 0, 0, err
+	}
+	trailer := make([]byte, 4)
+	if _, err := io.ReadFull(file, trailer); err != nil {
+		return 0, 0, 0, err
+	}
+	if binary.LittleEndian.Uint32(trailer) != checksum.Sum32() {
+		return 0, 0, 0, fmt.Errorf("%w: checksum mismatch", ErrInvalidSnapshot)
+	}
+	// Second pass: decoding
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, 0, 0, err
+	}
+	reader := bufio.NewReader(io.LimitReader(file, info.Size()-4))
+	header := make([]byte, headerSize)
+	if _, err := io.ReadFull(reader, header); err != nil {
+		return 0, 0, 0, err
+	}
+	if string(header[:len(SNAPSHOT_MAGIC)]) != SNAPSHOT_MAGIC {
+		return 0, 0, 0, fmt.Errorf("%w: unknown format", ErrInvalidSnapshot)
+	}
+	if header[len(SNAPSHOT_MAGIC)] != SNAPSHOT_VERSION {
+		return 0, 0, 0, fmt.Errorf("%w: unsupported version %d", ErrInvalidSnapshot, header[len(SNAPSHOT_MAGIC)])
+	}
+	segment := int(binary.LittleEndian.Uint64(header[len(SNAPSHOT_MAGIC)+1:]))
+	offset := int64(binary.LittleEndian.Uint64(header[len(SNAPSHOT_MAGIC)+9:]))
+	count := binary.LittleEndian.Uint64(header[len(SNAPSHOT_MAGIC)+17:])
+	var previous uint64
+	for i := uint64(0); i < count; i++ {
+		delta, err := binary.ReadUvarint(reader)
+		if err != nil {
+			return 0, 0, 0, fmt.Errorf("%w: %v", ErrInvalidSnapshot, err)
+		}
+		previous += delta
+		into.Add(uint32(previous))
+	}
+	return segment, offset, int(count), nil
+}
+
+func appendUint64(buffer []byte, value uint64) []byte {
+	encoded := make([]byte, 8)
+	binary.LittleEndian.PutUint64(encoded, value)
+	return append(buffer, encoded...)
+}
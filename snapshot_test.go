@@ -0,0 +1,211 @@
+package numberserver
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/mountolive/numberserver/logformat"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSnapshotter(t *testing.T) {
+	// Creates a temporary directory with a log file holding the passed content
+	setup := func(t *testing.T, content string) (string, string, func()) {
+		dir, err := ioutil.TempDir("", "snapshot")
+		require.NoError(t, err)
+		logfile := filepath.Join(dir, "numbers.log")
+		require.NoError(t, ioutil.WriteFile(logfile, []byte(content), 0644))
+		return dir, logfile, func() { os.RemoveAll(dir) }
+	}
+	appendLog := func(t *testing.T, logfile, content string) {
+		file, err := os.OpenFile(logfile, os.O_APPEND|os.O_WRONLY, 0644)
+		require.NoError(t, err)
+		defer file.Close()
+		_, err = file.WriteString(content)
+		require.NoError(t, err)
+	}
+	newSnapshotter := func(dir, logfile string) *Snapshotter {
+		return NewSnapshotter(dir, logfile, logformat.Text, NewDefaultNumberChecker(), NewBitsetDeduplicatorForDigits(4))
+	}
+
+	t.Run("Snapshot and Restore", func(t *testing.T) {
+		dir, logfile, cleanup := setup(t, "1\n2\n3\n2\n")
+		defer cleanup()
+		snapshotter := newSnapshotter(dir, logfile)
+		require.NoError(t, snapshotter.Snapshot())
+		segment, offset := snapshotter.Position()
+		assert.Equal(t, 0, segment)
+		assert.Equal(t, int64(8), offset)
+		// Tail written after the snapshot, with a partial last line
+		appendLog(t, logfile, "4\nbad\n1\n5")
+
+		tracker := NewNumberTracker()
+		report, err := newSnapshotter(dir, logfile).Restore(tracker)
+		require.NoError(t, err)
+		assert.NoError(t, report.SnapshotError)
+		assert.Equal(t, 3, report.Snapshot)
+		assert.Equal(t, 4, report.Recovered)
+		assert.Equal(t, 1, report.Duplicates)
+		assert.Equal(t, 1, report.Corrupt)
+		assert.Equal(t, 4, tracker.Stats.Total)
+		for _, value := range []int{1, 2, 3, 4} {
+			assert.True(t, tracker.Seen(value), "Number %d should have been restored", value)
+		}
+		assert.False(t, tracker.Seen(5), "The partial last line shouldn't be restored")
+	})
+
+	t.Run("Binary log", func(t *testing.T) {
+		dir, logfile, cleanup := setup(t, "\x01\x00\x00\x00\x02\x00\x00\x00")
+		defer cleanup()
+		newBinary := func() *Snapshotter {
+			return NewSnapshotter(dir, logfile, logformat.Binary, NewDefaultNumberChecker(), NewMapDeduplicator())
+		}
+		snapshotter := newBinary()
+		require.NoError(t, snapshotter.Snapshot())
+		_, offset := snapshotter.Position()
+		assert.Equal(t, int64(8), offset)
+		// A complete record and a partial one
+		appendLog(t, logfile, "\x03\x00\x00\x00\x04\x00")
+		require.NoError(t, snapshotter.Snapshot())
+		_, offset = snapshotter.Position()
+		assert.Equal(t, int64(12), offset, "The partial record shouldn't be covered")
+
+		tracker := NewNumberTracker()
+		report, err := newBinary().Restore(tracker)
+		require.NoError(t, err)
+		assert.Equal(t, 3, report.Snapshot)
+		assert.Equal(t, 3, report.Recovered)
+		assert.False(t, tracker.Seen(4))
+	})
+
+	t.Run("No snapshot", func(t *testing.T) {
+		dir, logfile, cleanup := setup(t, "1\n2\n")
+		defer cleanup()
+		tracker := NewNumberTracker()
+		report, err := newSnapshotter(dir, logfile).Restore(tracker)
+		require.NoError(t, err)
+		assert.NoError(t, report.SnapshotError)
+		assert.Equal(t, 0, report.Snapshot)
+		assert.Equal(t, 2, report.Recovered)
+	})
+
+	t.Run("Corrupt snapshot", func(t *testing.T) {
+		dir, logfile, cleanup := setup(t, "1\n2\n3\n")
+		defer cleanup()
+		snapshotter := newSnapshotter(dir, logfile)
+		require.NoError(t, snapshotter.Snapshot())
+		content, err := ioutil.ReadFile(snapshotter.Path())
+		require.NoError(t, err)
+		content[len(content)/2] ^= 0xff
+		require.NoError(t, ioutil.WriteFile(snapshotter.Path(), content, 0644))
+
+		tracker := NewNumberTracker()
+		report, err := newSnapshotter(dir, logfile).Restore(tracker)
+		require.NoError(t, err)
+		assert.True(t, errors.Is(report.SnapshotError, ErrInvalidSnapshot), "Got: %v", report.SnapshotError)
+		assert.Equal(t, 0, report.Snapshot)
+		assert.Equal(t, 3, report.Recovered, "The whole log should have been replayed")
+	})
+
+	t.Run("Crash in the middle of a snapshot", func(t *testing.T) {
+		dir, logfile, cleanup := setup(t, "1\n2\n")
+		defer cleanup()
+		snapshotter := newSnapshotter(dir, logfile)
+		require.NoError(t, snapshotter.Snapshot())
+		previous, err := ioutil.ReadFile(snapshotter.Path())
+		require.NoError(t, err)
+		// The writer died before renaming its temporary file
+		appendLog(t, logfile, "3\n")
+		tmp := snapshotter.Path() + ".tmp-crashed"
+		require.NoError(t, ioutil.WriteFile(tmp, previous[:len(previous)-3], 0644))
+
+		tracker := NewNumberTracker()
+		report, err := newSnapshotter(dir, logfile).Restore(tracker)
+		require.NoError(t, err)
+		assert.NoError(t, report.SnapshotError)
+		assert.Equal(t, 2, report.Snapshot, "The previous snapshot should have been used")
+		assert.Equal(t, 3, report.Recovered)
+
+		// A truncated snapshot (i.e. written in place, without rename)
+		require.NoError(t, ioutil.WriteFile(snapshotter.Path(), previous[:len(previous)-3], 0644))
+		tracker = NewNumberTracker()
+		report, err = newSnapshotter(dir, logfile).Restore(tracker)
+		require.NoError(t, err)
+		assert.True(t, errors.Is(report.SnapshotError, ErrInvalidSnapshot), "Got: %v", report.SnapshotError)
+		assert.Equal(t, 3, report.Recovered)
+	})
+
+	t.Run("Log shorter than snapshot", func(t *testing.T) {
+		dir, logfile, cleanup := setup(t, "1\n2\n3\n")
+		defer cleanup()
+		snapshotter := newSnapshotter(dir, logfile)
+		require.NoError(t, snapshotter.Snapshot())
+		// Log recreated
+		require.NoError(t, ioutil.WriteFile(logfile, []byte("4\n"), 0644))
+
+		tracker := NewNumberTracker()
+		report, err := newSnapshotter(dir, logfile).Restore(tracker)
+		require.NoError(t, err)
+		assert.True(t, errors.Is(report.SnapshotError, ErrInvalidSnapshot), "Got: %v", report.SnapshotError)
+		assert.Equal(t, 1, report.Recovered)
+		assert.False(t, tracker.Seen(1), "Numbers from the stale snapshot shouldn't be restored")
+	})
+
+	t.Run("Active segment truncated while running", func(t *testing.T) {
+		dir, logfile, cleanup := setup(t, "1\n2\n3\n")
+		defer cleanup()
+		snapshotter := newSnapshotter(dir, logfile)
+		require.NoError(t, snapshotter.Snapshot())
+		// Copied away and truncated in place (logrotate's copytruncate)
+		require.NoError(t, os.Truncate(logfile, 0))
+		appendLog(t, logfile, "4\n")
+		require.NoError(t, snapshotter.Snapshot())
+		_, offset := snapshotter.Position()
+		assert.Equal(t, int64(2), offset)
+		snapshot := NewMapDeduplicator()
+		_, _, _, err := readSnapshot(snapshotter.Path(), snapshot)
+		require.NoError(t, err)
+		assert.True(t, snapshot.Contains(4))
+	})
+
+	t.Run("Snapshot across rotations", func(t *testing.T) {
+		dir, logfile, cleanup := setup(t, "1\n2\n")
+		defer cleanup()
+		snapshotter := newSnapshotter(dir, logfile)
+		require.NoError(t, snapshotter.Snapshot())
+		// The active segment grows and gets rotated twice
+		appendLog(t, logfile, "3\n")
+		require.NoError(t, os.Rename(logfile, segmentPath(logfile, 1)))
+		require.NoError(t, ioutil.WriteFile(logfile, []byte("4\n5\n"), 0644))
+		require.NoError(t, os.Rename(logfile, segmentPath(logfile, 2)))
+		require.NoError(t, ioutil.WriteFile(logfile, []byte("6\n"), 0644))
+
+		require.NoError(t, snapshotter.Snapshot())
+		segment, offset := snapshotter.Position()
+		assert.Equal(t, 2, segment)
+		assert.Equal(t, int64(2), offset)
+
+		appendLog(t, logfile, "7\n")
+		tracker := NewNumberTracker()
+		report, err := newSnapshotter(dir, logfile).Restore(tracker)
+		require.NoError(t, err)
+		assert.NoError(t, report.SnapshotError)
+		assert.Equal(t, 6, report.Snapshot)
+		assert.Equal(t, 7, report.Recovered)
+	})
+
+	t.Run("Reset", func(t *testing.T) {
+		dir, logfile, cleanup := setup(t, "1\n")
+		defer cleanup()
+		snapshotter := newSnapshotter(dir, logfile)
+		require.NoError(t, snapshotter.Snapshot())
+		require.NoError(t, snapshotter.Reset())
+		_, err := os.Stat(snapshotter.Path())
+		assert.True(t, os.IsNotExist(err), "Snapshot should have been removed")
+		assert.NoError(t, snapshotter.Reset(), "Removing a missing snapshot isn't an error")
+	})
+}
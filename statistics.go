@@ -1,8 +1,10 @@
-package main
+package numberserver
 
 import (
 	"fmt"
+	"os"
 	"sync"
+	"time"
 )
 
 // Bookkeeping struct for input count
@@ -11,6 +13,12 @@ type Statistics struct {
 	Received   int
 	Duplicates int
 	Total      int
+	// Connections turned away because the server was busy
+	// (see OverloadPolicy). It isn't reset after reporting
+	Rejected int
+	// Connections closed for exceeding their timeouts
+	// (see Config's IdleTimeout). It isn't reset after reporting
+	TimedOut int
 }
 
 // Prints to STDOUT the current statistics of the server,
@@ -18,12 +26,41 @@ type Statistics struct {
 // total number of unique numbers received (and logged) by the server.
 // Resets count of Received and Duplicates after reporting
 func (s *Statistics) PrintCurrent() {
+	report := s.Report(0)
+	if err := NewTextReporter(os.Stdout).Report(report); err != nil {
+		fmt.Printf("An error occurred while printing the statistics: %v\n", err)
+	}
+}
+
+// Current statistics, covering the passed interval (see StatsReporter).
+// Resets count of Received and Duplicates, same as PrintCurrent
+func (s *Statistics) Report(interval time.Duration) StatsReport {
 	s.Lock()
 	defer s.Unlock()
-	fmt.Printf("Received %d unique numbers, %d duplicates (Total processed: %d). "+
-		"Unique totals: %d \n", s.Received, s.Duplicates, s.Received+s.Duplicates, s.Total)
+	report := s.current(interval)
 	s.Received = 0
 	s.Duplicates = 0
+	return report
+}
+
+// Current statistics, without resetting any count
+func (s *Statistics) Current() StatsReport {
+	s.Lock()
+	defer s.Unlock()
+	return s.current(0)
+}
+
+// Must be called holding the lock
+func (s *Statistics) current(interval time.Duration) StatsReport {
+	return StatsReport{
+		Time:       time.Now(),
+		Interval:   interval,
+		Received:   s.Received,
+		Duplicates: s.Duplicates,
+		Total:      s.Total,
+		Rejected:   s.Rejected,
+		TimedOut:   s.TimedOut,
+	}
 }
 
 // Increases sessions' duplicate count by 1
@@ -40,3 +77,37 @@ func (s *Statistics) IncreaseReceived() {
 	s.Received += 1
 	s.Total += 1
 }
+
+// Undoes IncreaseReceived, for a number that couldn't be logged
+// (see NumberTracker's forget). Received isn't decreased if it was
+// already reported
+func (s *Statistics) DecreaseReceived() {
+	s.Lock()
+	defer s.Unlock()
+	if s.Received > 0 {
+		s.Received -= 1
+	}
+	s.Total -= 1
+}
+
+// Increases the unique totals count by the passed amount
+// (used when preloading numbers already logged)
+func (s *Statistics) IncreaseTotal(amount int) {
+	s.Lock()
+	defer s.Unlock()
+	s.Total += amount
+}
+
+// Increases the count of rejected connections by 1
+func (s *Statistics) IncreaseRejected() {
+	s.Lock()
+	defer s.Unlock()
+	s.Rejected += 1
+}
+
+// Increases the count of timed out connections by 1
+func (s *Statistics) IncreaseTimedOut() {
+	s.Lock()
+	defer s.Unlock()
+	s.TimedOut += 1
+}
@@ -1,9 +1,10 @@
-package main
+package numberserver
 
 import (
 	"math/rand"
 	"testing"
 	"testing/quick"
+	"time"
 )
 
 type bulkUpdateTestCase struct {
@@ -34,6 +35,17 @@ func TestStatistics(t *testing.T) {
 
 	})
 
+	t.Run("Report", func(t *testing.T) {
+		s := &Statistics{Total: 100, Received: 12, Duplicates: 32, Rejected: 1}
+		report := s.Report(time.Second)
+		if report.Received != 12 || report.Duplicates != 32 || report.Total != 100 || report.Rejected != 1 {
+			t.Errorf("Got report %+v, Expected the current statistics", report)
+		}
+		if s.Received != 0 || s.Duplicates != 0 || s.Total != 100 || s.Rejected != 1 {
+			t.Errorf("Got %+v, Expected only Received and Duplicates reset", s)
+		}
+	})
+
 	t.Run("Increse Duplicates", func(t *testing.T) {
 		s := &Statistics{Total: 100}
 		asserter := func() bool {
@@ -57,4 +69,32 @@ func TestStatistics(t *testing.T) {
 			t.Error(err)
 		}
 	})
+
+	t.Run("Increase Total", func(t *testing.T) {
+		s := &Statistics{Total: 100, Received: 3}
+		s.IncreaseTotal(20)
+		if s.Total != 120 || s.Received != 3 {
+			t.Errorf("Got Total %d and Received %d, Expected 120 and 3", s.Total, s.Received)
+		}
+	})
+
+	t.Run("Increase Rejected", func(t *testing.T) {
+		s := &Statistics{Total: 100}
+		s.IncreaseRejected()
+		s.IncreaseRejected()
+		s.PrintCurrent()
+		if s.Rejected != 2 || s.Total != 100 {
+			t.Errorf("Got Rejected %d and Total %d, Expected 2 and 100 (not reset after printing)",
+				s.Rejected, s.Total)
+		}
+	})
+
+	t.Run("Increase Timed Out", func(t *testing.T) {
+		s := &Statistics{}
+		s.IncreaseTimedOut()
+		s.PrintCurrent()
+		if s.TimedOut != 1 {
+			t.Errorf("Got TimedOut %d, Expected 1 (not reset after printing)", s.TimedOut)
+		}
+	})
 }
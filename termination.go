@@ -0,0 +1,161 @@
+package numberserver
+
+import (
+	"bufio"
+	"context"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+)
+
+// Who can shut the server down by sending the termination keyword
+// on the numbers' port (the admin socket always can, see AdminSocket)
+type TerminationAccess struct {
+	// Ignores the keyword on the numbers' port
+	Disabled bool
+	// Networks of the clients allowed to send it (any if empty)
+	Allow []*net.IPNet
+}
+
+// Parses who can send the termination keyword: any, none,
+// or a comma separated list of IPs and CIDRs (e.g. 127.0.0.1,10.0.0.0/8)
+func ParseTerminationAccess(value string) (TerminationAccess, error) {
+	switch value {
+	case "any", "":
+		return TerminationAccess{}, nil
+	case "none":
+		return TerminationAccess{Disabled: true}, nil
+	}
+	var access TerminationAccess
+	for _, item := range strings.Split(value, ",") {
+		item = strings.TrimSpace(item)
+		if !strings.Contains(item, "/") {
+			ip := net.ParseIP(item)
+			if ip == nil {
+				return access, fmt.Errorf("Invalid IP allowed to terminate: %s "+
+					"(expected any, none, or IPs and CIDRs)", item)
+			}
+			bits := 8 * net.IPv6len
+			if ip.To4() != nil {
+				ip, bits = ip.To4(), 8*net.IPv4len
+			}
+			access.Allow = append(access.Allow, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+		_, network, err := net.ParseCIDR(item)
+		if err != nil {
+			return access, fmt.Errorf("Invalid network allowed to terminate: %s "+
+				"(expected any, none, or IPs and CIDRs)", item)
+		}
+		access.Allow = append(access.Allow, network)
+	}
+	return access, nil
+}
+
+func (a TerminationAccess) String() string {
+	if a.Disabled {
+		return "none"
+	}
+	if len(a.Allow) == 0 {
+		return "any"
+	}
+	networks := make([]string, 0, len(a.Allow))
+	for _, network := range a.Allow {
+		networks = append(networks, network.String())
+	}
+	return strings.Join(networks, ",")
+}
+
+// Checks whether a client can send the termination keyword
+func (a TerminationAccess) check(client net.Addr) error {
+	if a.Disabled {
+		return errors.New("termination is disabled on this port")
+	}
+	if len(a.Allow) == 0 {
+		return nil
+	}
+	tcp, ok := client.(*net.TCPAddr)
+	if !ok {
+		// e.g. clients of Unix sockets
+		return errors.New("only clients of the allowed networks can terminate")
+	}
+	for _, network := range a.Allow {
+		if network.Contains(tcp.IP) {
+			return nil
+		}
+	}
+	return fmt.Errorf("%s isn't allowed to terminate", client)
+}
+
+// Decides whether a line shuts the server down: it must be the termination
+// keyword, followed by the token if there's one (e.g. "terminate s3cret"),
+// from a client with access
+type terminationGuard struct {
+	access TerminationAccess
+	token  string
+}
+
+// Whether the line asks for termination, and if so, why it's refused
+// (nil if it's granted)
+func (g terminationGuard) check(checker Checker, input string, client net.Addr) (bool, error) {
+	requested, err := g.checkToken(checker, input)
+	if !requested || err != nil {
+		return requested, err
+	}
+	return true, g.access.check(client)
+}
+
+// Same as check, without checking the client's access
+// (the admin socket's clients have it)
+func (g terminationGuard) checkToken(checker Checker, input string) (bool, error) {
+	if checker.CheckTermination(input) {
+		if g.token != "" {
+			return true, errors.New("missing token")
+		}
+		return true, nil
+	}
+	if g.token == "" {
+		return false, nil
+	}
+	// Tokens have no spaces (keywords can)
+	separator := strings.LastIndex(input, " ")
+	if separator < 0 || !checker.CheckTermination(input[:separator]) {
+		return false, nil
+	}
+	if subtle.ConstantTimeCompare([]byte(input[separator+1:]), []byte(g.token)) != 1 {
+		return true, errors.New("invalid token")
+	}
+	return true, nil
+}
+
+// Accepts connections on the admin socket until it's closed, shutting
+// the server down once one of them sends the termination keyword (with
+// the token, if there's one). Other lines are replied with an error line
+func (s *Server) serveAdminSocket(ctx context.Context, listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			scanner := bufio.NewScanner(conn)
+			for scanner.Scan() && ctx.Err() == nil {
+				requested, err := s.guard.checkToken(s.checker, scanner.Text())
+				if !requested {
+					err = errors.New("expected the termination keyword")
+				}
+				if err != nil {
+					fmt.Printf("Refused shutdown request from the admin socket: %v\n", err)
+					conn.Write([]byte(TERMINATION_REFUSED_REPLY))
+					continue
+				}
+				fmt.Println("Shutdown requested from the admin socket")
+				s.cancel()
+				return
+			}
+		}()
+	}
+}
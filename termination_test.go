@@ -0,0 +1,127 @@
+package numberserver
+
+import (
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type terminationGuardCase struct {
+	Name   string
+	Access string
+	Token  string
+	Input  string
+	// Client's IP (the admin socket's if empty, see checkToken)
+	Client    string
+	Requested bool
+	Refused   bool
+}
+
+func TestTerminationGuard(t *testing.T) {
+	checker := NewDefaultNumberChecker()
+	checker.SetTermination("shut down")
+	testCases := []terminationGuardCase{
+		{
+			Name:      "Keyword from anyone",
+			Access:    "any",
+			Input:     "shut down",
+			Client:    "10.0.0.1",
+			Requested: true,
+		},
+		{
+			Name:   "Number",
+			Access: "any",
+			Input:  "000000001",
+			Client: "10.0.0.1",
+		},
+		{
+			Name:      "Disabled",
+			Access:    "none",
+			Input:     "shut down",
+			Client:    "127.0.0.1",
+			Requested: true,
+			Refused:   true,
+		},
+		{
+			Name:      "Disabled but from the admin socket",
+			Access:    "none",
+			Input:     "shut down",
+			Requested: true,
+		},
+		{
+			Name:      "Allowed IP",
+			Access:    "127.0.0.1,10.0.0.0/8",
+			Input:     "shut down",
+			Client:    "10.1.2.3",
+			Requested: true,
+		},
+		{
+			Name:      "Not allowed IP",
+			Access:    "127.0.0.1,10.0.0.0/8",
+			Input:     "shut down",
+			Client:    "192.168.0.1",
+			Requested: true,
+			Refused:   true,
+		},
+		{
+			Name:      "Token",
+			Access:    "any",
+			Token:     "s3cret",
+			Input:     "shut down s3cret",
+			Client:    "10.0.0.1",
+			Requested: true,
+		},
+		{
+			Name:      "Missing token",
+			Access:    "any",
+			Token:     "s3cret",
+			Input:     "shut down",
+			Client:    "10.0.0.1",
+			Requested: true,
+			Refused:   true,
+		},
+		{
+			Name:      "Invalid token",
+			Access:    "any",
+			Token:     "s3cret",
+			Input:     "shut down s3cre",
+			Requested: true,
+			Refused:   true,
+		},
+		{
+			Name:   "Other line with a space",
+			Access: "any",
+			Token:  "s3cret",
+			Input:  "shut s3cret",
+			Client: "10.0.0.1",
+		},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.Name, func(t *testing.T) {
+			access, err := ParseTerminationAccess(tc.Access)
+			require.NoError(t, err)
+			guard := terminationGuard{access: access, token: tc.Token}
+			var requested bool
+			if tc.Client == "" {
+				requested, err = guard.checkToken(checker, tc.Input)
+			} else {
+				client := &net.TCPAddr{IP: net.ParseIP(tc.Client), Port: 4000}
+				requested, err = guard.check(checker, tc.Input, client)
+			}
+			assert.Equal(t, tc.Requested, requested)
+			assert.Equal(t, tc.Refused, err != nil, "Got: %v", err)
+		})
+	}
+
+	t.Run("Parse access", func(t *testing.T) {
+		access, err := ParseTerminationAccess("127.0.0.1, ::1, 10.0.0.0/8")
+		require.NoError(t, err)
+		assert.Equal(t, "127.0.0.1/32,::1/128,10.0.0.0/8", access.String())
+		_, err = ParseTerminationAccess("localhost")
+		assert.Error(t, err)
+		_, err = ParseTerminationAccess("10.0.0.0/33")
+		assert.Error(t, err)
+	})
+}
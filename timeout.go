@@ -0,0 +1,119 @@
+package numberserver
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+// Limits of a client connection's reads (0 disables each of them)
+type connTimeouts struct {
+	// Max time waiting for a new line (e.g. a client that never sends anything)
+	Idle time.Duration
+	// Max time to receive a whole line, once its first byte arrived
+	Line time.Duration
+	// Max time the connection can be kept open, whatever it sends
+	Lifetime time.Duration
+}
+
+// Reads from a connection, setting its read deadline before each read
+// according to the timeouts: idle while waiting for a line,
+// line while one is partially received, and never beyond its lifetime.
+// Once stopped, reads (and replies) fail right away (see stop)
+type deadlineReader struct {
+	conn     net.Conn
+	timeouts connTimeouts
+	// Connection's end of life (zero if unlimited)
+	expires time.Time
+	// When the partial line being received started (zero if none)
+	lineStart time.Time
+	// Guards stopped against the deadlines being set concurrently
+	mu      sync.Mutex
+	stopped bool
+	// Whether it wrote replies (see reply)
+	replied bool
+}
+
+func newDeadlineReader(conn net.Conn, timeouts connTimeouts) *deadlineReader {
+	reader := &deadlineReader{conn: conn, timeouts: timeouts}
+	if timeouts.Lifetime > 0 {
+		reader.expires = time.Now().Add(timeouts.Lifetime)
+	}
+	return reader
+}
+
+func (r *deadlineReader) Read(buffer []byte) (int, error) {
+	if err := r.setDeadline(); err != nil {
+		return 0, err
+	}
+	read, err := r.conn.Read(buffer)
+	if read > 0 {
+		if buffer[read-1] == '\n' {
+			r.lineStart = time.Time{}
+		} else if r.lineStart.IsZero() || bytes.IndexByte(buffer[:read], '\n') >= 0 {
+			// A new line began within this read
+			r.lineStart = time.Now()
+		}
+	}
+	return read, err
+}
+
+// Sets the read deadline for the next read (if any timeout is enabled)
+func (r *deadlineReader) setDeadline() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.stopped {
+		return errors.New("The connection's reading was stopped")
+	}
+	var deadline time.Time
+	switch {
+	case !r.lineStart.IsZero() && r.timeouts.Line > 0:
+		deadline = r.lineStart.Add(r.timeouts.Line)
+	case r.lineStart.IsZero() && r.timeouts.Idle > 0:
+		deadline = time.Now().Add(r.timeouts.Idle)
+	}
+	if !r.expires.IsZero() && (deadline.IsZero() || r.expires.Before(deadline)) {
+		deadline = r.expires
+	}
+	if deadline.IsZero() {
+		return nil
+	}
+	return r.conn.SetReadDeadline(deadline)
+}
+
+// Writes a reply to the client, failing if it isn't read within
+// ACK_WRITE_TIMEOUT, or right away once stopped
+func (r *deadlineReader) reply(line string) error {
+	r.mu.Lock()
+	if r.stopped {
+		r.mu.Unlock()
+		return errors.New("The connection's reading was stopped")
+	}
+	r.replied = true
+	r.conn.SetWriteDeadline(time.Now().Add(ACK_WRITE_TIMEOUT))
+	r.mu.Unlock()
+	_, err := r.conn.Write([]byte(line))
+	return err
+}
+
+// Unblocks any read (and reply) in progress and makes the next ones fail
+// (safe to call concurrently with Read and reply)
+func (r *deadlineReader) stop() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stopped = true
+	r.conn.SetReadDeadline(time.Now())
+	// The acknowledgements aren't written through the reader
+	// (see connAcker), and keep their own deadlines
+	if r.replied {
+		r.conn.SetWriteDeadline(time.Now())
+	}
+}
+
+// Whether err is a read deadline exceeded (i.e. a timeout, unless stopped)
+func isTimeout(err error) bool {
+	var netErr net.Error
+	return errors.As(err, &netErr) && netErr.Timeout()
+}
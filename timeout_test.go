@@ -0,0 +1,133 @@
+package numberserver
+
+import (
+	"bufio"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type deadlineReaderCase struct {
+	Name     string
+	Timeouts connTimeouts
+	// Writes of the fake client, each one after the delay
+	Writes []string
+	Delay  time.Duration
+	// Lines scanned (all of them if it doesn't time out)
+	Lines    int
+	TimedOut bool
+}
+
+func TestDeadlineReader(t *testing.T) {
+	testCases := []deadlineReaderCase{
+		{
+			Name:     "Idle client",
+			Timeouts: connTimeouts{Idle: 50 * time.Millisecond},
+			Writes:   []string{"1\n"},
+			Delay:    time.Second,
+			TimedOut: true,
+		},
+		{
+			Name:     "Lines within the idle timeout",
+			Timeouts: connTimeouts{Idle: time.Second},
+			Writes:   []string{"1\n", "2\n", "3\n"},
+			Delay:    20 * time.Millisecond,
+			Lines:    3,
+		},
+		{
+			Name:     "Slow line",
+			Timeouts: connTimeouts{Idle: time.Second, Line: 100 * time.Millisecond},
+			Writes:   []string{"1\n2", "0", "0", "0", "\n"},
+			Delay:    40 * time.Millisecond,
+			// The partial line is still scanned (as on EOF)
+			Lines:    2,
+			TimedOut: true,
+		},
+		{
+			Name:     "Line timeout restarts on each line",
+			Timeouts: connTimeouts{Line: 100 * time.Millisecond},
+			Writes:   []string{"1", "0\n2", "0\n3", "0\n"},
+			Delay:    60 * time.Millisecond,
+			Lines:    3,
+		},
+		{
+			Name:     "Lifetime",
+			Timeouts: connTimeouts{Idle: time.Second, Lifetime: 150 * time.Millisecond},
+			Writes:   []string{"1\n", "2\n", "3\n", "4\n", "5\n", "6\n"},
+			Delay:    60 * time.Millisecond,
+			Lines:    2,
+			TimedOut: true,
+		},
+	}
+	for _, tc := range testCases {
+		tc := tc
+		t.Run(tc.Name, func(t *testing.T) {
+			server, client := net.Pipe()
+			defer server.Close()
+			defer client.Close()
+			// Fake slow client
+			go func() {
+				for _, write := range tc.Writes {
+					time.Sleep(tc.Delay)
+					if _, err := client.Write([]byte(write)); err != nil {
+						return
+					}
+				}
+				client.Close()
+			}()
+			scanner := bufio.NewScanner(newDeadlineReader(server, tc.Timeouts))
+			lines := 0
+			for scanner.Scan() {
+				lines++
+			}
+			assert.Equal(t, tc.TimedOut, isTimeout(scanner.Err()), "Got: %v", scanner.Err())
+			assert.Equal(t, tc.Lines, lines)
+		})
+	}
+
+	t.Run("Stop", func(t *testing.T) {
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+		reader := newDeadlineReader(server, connTimeouts{Idle: time.Minute})
+		read := make(chan error)
+		go func() {
+			_, err := reader.Read(make([]byte, 16))
+			read <- err
+		}()
+		time.Sleep(20 * time.Millisecond)
+		reader.stop()
+		select {
+		case err := <-read:
+			require.Error(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("The read wasn't unblocked")
+		}
+		_, err := reader.Read(make([]byte, 16))
+		assert.Error(t, err, "Reads should fail once stopped")
+	})
+
+	t.Run("Stop while replying", func(t *testing.T) {
+		// The client never reads its replies
+		server, client := net.Pipe()
+		defer server.Close()
+		defer client.Close()
+		reader := newDeadlineReader(server, connTimeouts{})
+		replied := make(chan error)
+		go func() {
+			replied <- reader.reply("SEEN 000000001\n")
+		}()
+		time.Sleep(20 * time.Millisecond)
+		reader.stop()
+		select {
+		case err := <-replied:
+			require.Error(t, err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("The reply wasn't unblocked")
+		}
+		assert.Error(t, reader.reply("SEEN 000000001\n"), "Replies should fail once stopped")
+	})
+}
@@ -0,0 +1,69 @@
+package numberserver
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+	"sync/atomic"
+)
+
+// TLS settings of the clients' connections, loaded from files (see Config's
+// TLSCert), which can be loaded again while serving (see Server's Reload)
+type tlsLoader struct {
+	// *tls.Config used by the new connections
+	current atomic.Value
+}
+
+// Loads the TLS settings of the config (nil if TLS is disabled)
+func newTLSLoader(config Config) (*tlsLoader, error) {
+	if config.TLSCert == "" {
+		return nil, nil
+	}
+	loaded, err := loadTLSConfig(config)
+	if err != nil {
+		return nil, err
+	}
+	loader := &tlsLoader{}
+	loader.store(loaded)
+	return loader, nil
+}
+
+// Config of the listener: every new connection uses the last one stored
+func (l *tlsLoader) listenerConfig() *tls.Config {
+	return &tls.Config{
+		GetConfigForClient: func(*tls.ClientHelloInfo) (*tls.Config, error) {
+			return l.current.Load().(*tls.Config), nil
+		},
+	}
+}
+
+func (l *tlsLoader) store(config *tls.Config) {
+	l.current.Store(config)
+}
+
+// Reads the certificate and key (and the client CA bundle, requiring
+// the clients to present a certificate signed by one of them, if set)
+func loadTLSConfig(config Config) (*tls.Config, error) {
+	certificate, err := tls.LoadX509KeyPair(config.TLSCert, config.TLSKey)
+	if err != nil {
+		return nil, fmt.Errorf("An error occurred while loading the TLS certificate: %w", err)
+	}
+	loaded := &tls.Config{
+		Certificates: []tls.Certificate{certificate},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if config.TLSClientCA != "" {
+		bundle, err := ioutil.ReadFile(config.TLSClientCA)
+		if err != nil {
+			return nil, fmt.Errorf("An error occurred while loading the TLS client CA: %w", err)
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bundle) {
+			return nil, fmt.Errorf("No certificates found in the TLS client CA %s", config.TLSClientCA)
+		}
+		loaded.ClientCAs = pool
+		loaded.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return loaded, nil
+}
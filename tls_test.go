@@ -0,0 +1,182 @@
+package numberserver
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// A certificate generated for the tests, along with its key
+type testCertificate struct {
+	cert    *x509.Certificate
+	key     *ecdsa.PrivateKey
+	certPEM []byte
+	keyPEM  []byte
+}
+
+// Generates a certificate for 127.0.0.1 (both server and client), signed by
+// the parent (self-signed if nil). CAs can only sign other certificates
+func generateCertificate(t *testing.T, name string, parent *testCertificate, isCA bool) *testCertificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	serial, err := rand.Int(rand.Reader, big.NewInt(1<<62))
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if isCA {
+		template.IsCA = true
+		template.BasicConstraintsValid = true
+		template.KeyUsage |= x509.KeyUsageCertSign
+		template.ExtKeyUsage, template.IPAddresses = nil, nil
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+	return &testCertificate{
+		cert:    cert,
+		key:     key,
+		certPEM: pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}),
+		keyPEM:  pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}),
+	}
+}
+
+// Client's TLS config, trusting the CA and presenting the certificate (if not nil)
+func (c *testCertificate) clientConfig(t *testing.T, certificate *testCertificate) *tls.Config {
+	pool := x509.NewCertPool()
+	pool.AddCert(c.cert)
+	config := &tls.Config{RootCAs: pool}
+	if certificate != nil {
+		pair, err := tls.X509KeyPair(certificate.certPEM, certificate.keyPEM)
+		require.NoError(t, err)
+		config.Certificates = []tls.Certificate{pair}
+	}
+	return config
+}
+
+func TestTLS(t *testing.T) {
+	ca := generateCertificate(t, "Test CA", nil, true)
+	serverCert := generateCertificate(t, "Test server", ca, false)
+	// Sets up a server with TLS, writing the certificates into files
+	setupTLS := func(t *testing.T, certificate *testCertificate) (Config, func()) {
+		config, cleanup := setupServer(t)
+		dir := filepath.Dir(config.Logfile)
+		config.TLSCert = filepath.Join(dir, "server.crt")
+		config.TLSKey = filepath.Join(dir, "server.key")
+		require.NoError(t, ioutil.WriteFile(config.TLSCert, certificate.certPEM, 0644))
+		require.NoError(t, ioutil.WriteFile(config.TLSKey, certificate.keyPEM, 0600))
+		return config, cleanup
+	}
+	// Sends a number through TLS, returning the error of the exchange
+	sendTLS := func(t *testing.T, server *Server, config *tls.Config, number string) error {
+		conn, err := tls.Dial("tcp", server.Addr().String(), config)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		conn.SetDeadline(time.Now().Add(5 * time.Second))
+		// Replies are read to make sure the server accepted the client
+		fmt.Fprintf(conn, "ack\n%s\n", number)
+		reply := make([]byte, len("OK ack\n"))
+		_, err = conn.Read(reply)
+		return err
+	}
+
+	t.Run("Numbers over TLS", func(t *testing.T) {
+		config, cleanup := setupTLS(t, serverCert)
+		defer cleanup()
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		require.NoError(t, sendTLS(t, server, ca.clientConfig(t, nil), "000000001"))
+		require.Eventually(t, func() bool { return server.Tracker().Seen(1) }, 5*time.Second, time.Millisecond)
+		// Plain text isn't understood
+		sendLines(t, server, "000000002").Close()
+		time.Sleep(20 * time.Millisecond)
+		assert.False(t, server.Tracker().Seen(2))
+	})
+
+	t.Run("Mutual TLS", func(t *testing.T) {
+		config, cleanup := setupTLS(t, serverCert)
+		defer cleanup()
+		config.TLSClientCA = filepath.Join(filepath.Dir(config.Logfile), "clients.crt")
+		clientCA := generateCertificate(t, "Test clients CA", nil, true)
+		require.NoError(t, ioutil.WriteFile(config.TLSClientCA, clientCA.certPEM, 0644))
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		// Without a certificate, or with one signed by another CA
+		assert.Error(t, sendTLS(t, server, ca.clientConfig(t, nil), "000000001"))
+		assert.Error(t, sendTLS(t, server, ca.clientConfig(t, generateCertificate(t, "Other", ca, false)),
+			"000000001"))
+		require.NoError(t, sendTLS(t, server, ca.clientConfig(t, generateCertificate(t, "Client", clientCA, false)),
+			"000000002"))
+		require.Eventually(t, func() bool { return server.Tracker().Seen(2) }, 5*time.Second, time.Millisecond)
+		assert.False(t, server.Tracker().Seen(1))
+	})
+
+	t.Run("Certificates reloaded", func(t *testing.T) {
+		config, cleanup := setupTLS(t, serverCert)
+		defer cleanup()
+		server := startServer(t, config)
+		defer server.Shutdown(context.Background())
+		require.NoError(t, sendTLS(t, server, ca.clientConfig(t, nil), "000000001"))
+		// Invalid ones don't change anything
+		require.NoError(t, ioutil.WriteFile(config.TLSCert, []byte("garbage"), 0644))
+		_, err := server.Reload(config)
+		assert.Error(t, err)
+		require.NoError(t, sendTLS(t, server, ca.clientConfig(t, nil), "000000002"))
+		// Renewed by another CA
+		renewedCA := generateCertificate(t, "Renewed CA", nil, true)
+		renewed := generateCertificate(t, "Renewed server", renewedCA, false)
+		require.NoError(t, ioutil.WriteFile(config.TLSCert, renewed.certPEM, 0644))
+		require.NoError(t, ioutil.WriteFile(config.TLSKey, renewed.keyPEM, 0600))
+		report, err := server.Reload(config)
+		require.NoError(t, err)
+		assert.Equal(t, []string{"TLS: certificates reloaded"}, report.Applied)
+		var unknownAuthority x509.UnknownAuthorityError
+		err = sendTLS(t, server, ca.clientConfig(t, nil), "000000003")
+		assert.True(t, errors.As(err, &unknownAuthority), "Got: %v", err)
+		require.NoError(t, sendTLS(t, server, renewedCA.clientConfig(t, nil), "000000004"))
+	})
+
+	t.Run("Invalid config", func(t *testing.T) {
+		config, cleanup := setupTLS(t, serverCert)
+		defer cleanup()
+		config.TLSKey = ""
+		_, err := NewServer(config)
+		var configErr *ConfigError
+		require.True(t, errors.As(err, &configErr))
+		assert.Equal(t, "TLSKey", configErr.Field)
+		config.TLSKey = config.TLSCert
+		_, err = NewServer(config)
+		assert.Error(t, err)
+	})
+}
@@ -1,4 +1,4 @@
-package main
+package numberserver
 
 import (
 	"context"
@@ -9,66 +9,123 @@ import (
 // Keeps a set of processed numbers
 // and statistics book
 type NumberTracker struct {
-	sync.RWMutex
-	// Max value of Uint32 = 4294967295
-	KnownNumbers map[uint32]bool
+	// Set-book of the numbers already seen
+	// (max value of Uint32 = 4294967295)
+	KnownNumbers Deduplicator
 	Stats        *Statistics
 }
 
 // Creates a new NumberTracker.
 // It contains a set-book for known, found numbers,
-// and a Statistics tracker.
-func NewNumberTracker() *NumberTracker {
-	return &NumberTracker{KnownNumbers: make(map[uint32]bool), Stats: &Statistics{}}
+// and a Statistics tracker. If no option is passed,
+// the set-book is backed by a MapDeduplicator
+// example usages: NewNumberTracker(Backend(NewBitsetDeduplicatorForDigits(9)))
+func NewNumberTracker(options ...func(*NumberTracker)) *NumberTracker {
+	tracker := &NumberTracker{KnownNumbers: NewMapDeduplicator(), Stats: &Statistics{}}
+	for _, option := range options {
+		option(tracker)
+	}
+	return tracker
+}
+
+// Option for setting the tracker's dedup backend
+func Backend(backend Deduplicator) func(*NumberTracker) {
+	return func(tracker *NumberTracker) {
+		tracker.KnownNumbers = backend
+	}
 }
 
 // Processes a number, validates and passes it on to a channel
 // in a pipelined fashion (after converting it to a string)
 func (n *NumberTracker) ProcessNumber(ctx context.Context,
 	inputStream <-chan int) <-chan string {
+	return n.ProcessNumbers(ctx, 1, inputStream)
+}
+
+// Multi-producer version of ProcessNumber: the input stream is consumed
+// by the passed number of workers, fanning in into a single output channel.
+// Each unique number is emitted exactly once, no matter which worker got it.
+// The output is closed once every worker is done
+func (n *NumberTracker) ProcessNumbers(ctx context.Context, workers int,
+	inputStream <-chan int) <-chan string {
+	if workers < 1 {
+		workers = 1
+	}
 	output := make(chan string)
+	var wg sync.WaitGroup
+	wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go func() {
+			defer wg.Done()
+			n.processStream(ctx, inputStream, output)
+		}()
+	}
 	go func() {
-		defer close(output)
-		for input := range inputStream {
-			select {
-			case <-ctx.Done():
-				return
-			default:
-				if input >= 0 {
-					uintVal := uint32(input)
-					if n.checkUniqueness(uintVal) {
-						// Marking it as seen
-						n.registerNumber(uintVal)
-						// passing it on
-						output <- strconv.Itoa(input)
-						// Increasing unique received count
-						n.Stats.IncreaseReceived()
-					} else {
-						n.Stats.IncreaseDups()
-					}
-				}
-			}
-		}
+		wg.Wait()
+		close(output)
 	}()
 	return output
 }
 
+// Registers the number as seen, atomically (insert if absent).
+// Returns true only for the first caller registering it,
+// negative numbers are never registered
+func (n *NumberTracker) Register(input int) bool {
+	if input < 0 {
+		return false
+	}
+	return n.KnownNumbers.Add(uint32(input))
+}
+
+// Indicates whether the number was already registered
+func (n *NumberTracker) Seen(input int) bool {
+	if input < 0 {
+		return false
+	}
+	return n.KnownNumbers.Contains(uint32(input))
+}
+
 // Printing current statistics' state
 func (n *NumberTracker) PrintStatistics() {
 	n.Stats.PrintCurrent()
 }
 
-func (n *NumberTracker) registerNumber(input uint32) {
-	// Locking reading for consistency
-	// Any subsequent read will have the proper state
-	n.RLock()
-	defer n.RUnlock()
-	n.KnownNumbers[input] = true
+// Consumes the input stream until it's closed or ctx is canceled,
+// passing on the unique numbers to the output
+func (n *NumberTracker) processStream(ctx context.Context,
+	inputStream <-chan int, output chan<- string) {
+	for input := range inputStream {
+		select {
+		case <-ctx.Done():
+			return
+		default:
+			if n.track(input) {
+				// passing it on
+				output <- strconv.Itoa(input)
+			}
+		}
+	}
+}
+
+// Forgets a number marked as seen that couldn't be logged,
+// so that it's new again when it's retried (and isn't counted as unique)
+func (n *NumberTracker) forget(input int) {
+	if input >= 0 && n.KnownNumbers.Remove(uint32(input)) {
+		n.Stats.DecreaseReceived()
+	}
 }
 
-func (n *NumberTracker) checkUniqueness(input uint32) bool {
-	// Locking writing for consistency
-	n.Lock()
-	defer n.Unlock()
-	return !n.KnownNumbers[input]
+// Marks the number as seen, updating the statistics.
+// Returns true only the first time (the number should be passed on)
+func (n *NumberTracker) track(input int) bool {
+	if input < 0 {
+		return false
+	}
+	if n.Register(input) {
+		// Increasing unique received count
+		n.Stats.IncreaseReceived()
+		return true
+	}
+	n.Stats.IncreaseDups()
+	return false
 }
@@ -1,7 +1,8 @@
-package main
+package numberserver
 
 import (
 	"context"
+	"sync"
 	"testing"
 	"time"
 
@@ -92,4 +93,68 @@ func TestNumberTracker(t *testing.T) {
 			})
 		}
 	})
+
+	t.Run("Concurrent Register", func(t *testing.T) {
+		tracker := NewNumberTracker()
+		var wg sync.WaitGroup
+		var mu sync.Mutex
+		registered := make(map[int]int)
+		for i := 0; i < 16; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for value := 0; value < 500; value++ {
+					if tracker.Register(value) {
+						mu.Lock()
+						registered[value]++
+						mu.Unlock()
+					}
+				}
+			}()
+		}
+		wg.Wait()
+		require.Len(t, registered, 500)
+		for value, times := range registered {
+			assert.True(t, times == 1, "Number %d registered %d times", value, times)
+			assert.True(t, tracker.Seen(value), "Number %d should have been seen", value)
+		}
+		assert.False(t, tracker.Register(-1), "Negative numbers can't be registered")
+		assert.False(t, tracker.Seen(500), "Number 500 shouldn't have been seen")
+	})
+
+	t.Run("Process Numbers multi-producer", func(t *testing.T) {
+		tracker := NewNumberTracker()
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		producers := 16
+		perProducer := 1000
+		uniques := 250
+		inbound := make(chan int)
+		outbound := tracker.ProcessNumbers(ctx, 8, inbound)
+		// Every producer sends overlapping numbers
+		var wg sync.WaitGroup
+		for i := 0; i < producers; i++ {
+			wg.Add(1)
+			go func(offset int) {
+				defer wg.Done()
+				for j := 0; j < perProducer; j++ {
+					inbound <- (offset + j) % uniques
+				}
+			}(i)
+		}
+		go func() {
+			wg.Wait()
+			close(inbound)
+		}()
+		received := make(map[string]int)
+		for value := range outbound {
+			received[value]++
+		}
+		require.Len(t, received, uniques)
+		for value, times := range received {
+			assert.True(t, times == 1, "Number %s emitted %d times", value, times)
+		}
+		assert.Equal(t, uniques, tracker.Stats.Received)
+		assert.Equal(t, producers*perProducer-uniques, tracker.Stats.Duplicates)
+	})
 }